@@ -6,9 +6,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/op/go-logging"
 	"github.com/xjdrew/kone"
@@ -29,6 +33,7 @@ func main() {
 	version := flag.Bool("version", false, "Get version info")
 	debug := flag.Bool("debug", false, "Print debug info")
 	config := flag.String("config", "config.ini", "config file")
+	check := flag.Bool("check", false, "Check config file and exit, exit code is non-zero if config is invalid")
 	flag.Parse()
 
 	if *version {
@@ -43,9 +48,29 @@ func main() {
 	}
 
 	configFile := *config
-	if configFile == "" {
+	if configFile == "" || flag.NArg() > 0 {
 		configFile = flag.Arg(0)
 	}
+
+	if *check {
+		logging.SetLevel(logging.WARNING, "kone")
+		if _, err := kone.ParseConfig(configFile); err != nil {
+			var errs kone.ConfigErrors
+			if !errors.As(err, &errs) {
+				errs = kone.ConfigErrors{{Msg: err.Error()}}
+			}
+			for _, e := range errs {
+				if e.Line > 0 {
+					fmt.Fprintf(os.Stderr, "%s:%d: %s\n", configFile, e.Line, e.Msg)
+				} else {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, e.Msg)
+				}
+			}
+			os.Exit(2)
+		}
+		fmt.Printf("%s: ok\n", configFile)
+		return
+	}
 	logger.Infof("using config file: %v", configFile)
 
 	cfg, err := kone.ParseConfig(configFile)
@@ -54,10 +79,29 @@ func main() {
 		os.Exit(2)
 	}
 
+	if err := kone.SetupLogging(cfg, *debug); err != nil {
+		logger.Error(err.Error())
+		os.Exit(2)
+	}
+
 	one, err := kone.FromConfig(cfg)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(3)
 	}
-	one.Serve()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// reload config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Infof("reload config on SIGHUP")
+			if err := one.ReloadConfig(); err != nil {
+				logger.Errorf("reload config failed: %v", err)
+			}
+		}
+	}()
+	one.Serve(ctx)
 }
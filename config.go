@@ -6,7 +6,10 @@
 package kone
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"unicode"
 
@@ -25,74 +28,147 @@ const (
 )
 
 type GeneralConfig struct {
-	ManagerAddr string `ini:"manager-addr"`
-	LogLevel    string `ini:"log-level"`
+	ManagerAddr   string `ini:"manager-addr" json:"manager_addr"`
+	LogLevel      string `ini:"log-level" json:"log_level"`
+	LogFile       string `ini:"log-file" json:"log_file"`               // log to stdout if empty
+	LogMaxSize    uint   `ini:"log-max-size" json:"log_max_size"`       // in MB, rotate log file when it exceeds, 0 means never
+	LogMaxBackups uint   `ini:"log-max-backups" json:"log_max_backups"` // number of rotated log files to keep
+	LogFormat     string `ini:"log-format" json:"log_format"`           // text or json
+
+	ShutdownTimeout uint `ini:"shutdown-timeout" json:"shutdown_timeout"` // in seconds, wait in-flight connections to finish on shutdown
+	WatchConfig     uint `ini:"watch-config" json:"watch_config"`         // in seconds, interval to check config file and reload it if modified, 0 means never
+
+	RuleSetDir      string `ini:"rule-set-dir" json:"rule_set_dir"`           // cache dir of rule sets from url
+	RuleSetInterval uint   `ini:"rule-set-interval" json:"rule_set_interval"` // in seconds, interval to refresh rule sets
+
+	GeoIPDatabase string `ini:"geoip-database" json:"geoip_database"` // MaxMind DB or table of ip ranges, the embedded table is used if empty
+	ASNDatabase   string `ini:"asn-database" json:"asn_database"`     // MaxMind DB or table of ip ranges, for IP-ASN rules
+	GeoSiteDir    string `ini:"geosite-dir" json:"geosite_dir"`       // dir of v2ray domain lists, for GEOSITE rules
 }
 
 type CoreConfig struct {
-	Tun             string   `ini:"tun"`     // tun name
-	Network         string   `ini:"network"` // tun network
-	TcpListenPort   uint16   `ini:"tcp-listen-port"`
-	TcpNatPortStart uint16   `ini:"tcp-nat-port-start"`
-	TcpNatPortEnd   uint16   `ini:"tcp-nat-port-end"`
-	UdpListenPort   uint16   `ini:"udp-listen-port"`
-	UdpNatPortStart uint16   `ini:"udp-nat-port-start"`
-	UdpNatPortEnd   uint16   `ini:"udp-nat-port-end"`
-	DnsListenPort   uint16   `ini:"dns-listen-port"`
-	DnsTtl          uint     `ini:"dns-ttl"`
-	DnsPacketSize   uint16   `ini:"dns-packet-size"`
-	DnsReadTimeout  uint     `ini:"dns-read-timeout"`
-	DnsWriteTimeout uint     `ini:"dns-write-timeout"`
-	DnsServer       []string `ini:"dns-server" delim:","`
+	Tun             string   `ini:"tun" json:"tun"`           // tun name
+	Network         string   `ini:"network" json:"network"`   // tun network
+	Network6        string   `ini:"network6" json:"network6"` // tun IPv6 network, IPv6 is disabled if empty
+	TcpListenPort   uint16   `ini:"tcp-listen-port" json:"tcp_listen_port"`
+	TcpNatPortStart uint16   `ini:"tcp-nat-port-start" json:"tcp_nat_port_start"`
+	TcpNatPortEnd   uint16   `ini:"tcp-nat-port-end" json:"tcp_nat_port_end"`
+	UdpListenPort   uint16   `ini:"udp-listen-port" json:"udp_listen_port"`
+	UdpNatPortStart uint16   `ini:"udp-nat-port-start" json:"udp_nat_port_start"`
+	UdpNatPortEnd   uint16   `ini:"udp-nat-port-end" json:"udp_nat_port_end"`
+	DnsListenPort   uint16   `ini:"dns-listen-port" json:"dns_listen_port"`
+	DnsTtl          uint     `ini:"dns-ttl" json:"dns_ttl"`
+	DnsPacketSize   uint16   `ini:"dns-packet-size" json:"dns_packet_size"`
+	DnsReadTimeout  uint     `ini:"dns-read-timeout" json:"dns_read_timeout"`
+	DnsWriteTimeout uint     `ini:"dns-write-timeout" json:"dns_write_timeout"`
+	DnsServer       []string `ini:"dns-server" delim:"," json:"dns_server"`
+	DnsBootstrap    string   `ini:"dns-bootstrap" json:"dns_bootstrap,omitempty"` // dns server of ip to resolve hosts of DoT and DoH servers
+	DnsCacheSize    uint     `ini:"dns-cache-size" json:"dns_cache_size"`         // max answers cached, 0 to disable cache
+	DnsCacheStale   uint     `ini:"dns-cache-stale" json:"dns_cache_stale"`       // seconds to serve expired answers on failure
+	DnsLogSize      uint     `ini:"dns-log-size" json:"dns_log_size"`             // latest queries kept in memory, 0 to disable query log
+	DnsLogFile      string   `ini:"dns-log-file" json:"dns_log_file"`             // file to persist queries, optional
 }
 
 type RuleConfig struct {
-	Schema  string
-	Pattern string
-	Proxy   string
+	Schema  string `json:"schema"`
+	Pattern string `json:"pattern"`
+	Proxy   string `json:"proxy"`
+
+	line int // line in config file, 0 if unknown
+}
+
+// String returns rule in config format, such as DOMAIN-SUFFIX,google.com,Proxy1
+func (rc RuleConfig) String() string {
+	if rc.Pattern == "" {
+		return rc.Schema + "," + rc.Proxy
+	}
+	return rc.Schema + "," + rc.Pattern + "," + rc.Proxy
 }
 
 type KoneConfig struct {
 	source interface{} // config source: file name or raw ini data
 	inif   *ini.File   // parsed ini file
+	lines  sourceLines // lines of source, to report errors
 
-	General GeneralConfig
-	Core    CoreConfig
-	Proxy   map[string]string
-	Rule    []RuleConfig
+	General    GeneralConfig     `json:"general"`
+	Core       CoreConfig        `json:"core"`
+	Proxy      map[string]string `json:"proxy"`
+	ProxyGroup map[string]string `json:"proxy_group,omitempty"`
+	Rule       []RuleConfig      `json:"rule"`
+	Host       []HostConfig      `json:"host,omitempty"`
 }
 
-func (cfg *KoneConfig) parseRule(sec *ini.Section) (err error) {
-	keys := sec.KeyStrings()
+// path returns file path relative to dir of config file, if config is from file
+func (cfg *KoneConfig) path(file string) string {
+	if src, ok := cfg.source.(string); ok && !filepath.IsAbs(file) {
+		return filepath.Join(filepath.Dir(src), file)
+	}
+	return file
+}
+
+// pattern of these schemas may contain commas and spaces: a regex, or sub rules of AND, OR and NOT
+func hasCompoundPattern(schema string) bool {
+	switch strings.ToUpper(schema) {
+	case "DOMAIN-REGEX", "AND", "OR", "NOT":
+		return true
+	}
+	return false
+}
 
-	var ops []string
-	for _, key := range keys {
-		ops = strings.FieldsFunc(key, func(c rune) bool {
+func (cfg *KoneConfig) parseRule(sec *ini.Section) (errs ConfigErrors) {
+	line := 0
+	for _, key := range sec.KeyStrings() {
+		line = cfg.lines.find(sec.Name(), key, line)
+		ops := strings.FieldsFunc(key, func(c rune) bool {
 			if c == ',' || unicode.IsSpace(c) {
 				return true
 			}
 			return false
 		})
 		logger.Debugf("%s %v", key, ops)
-		if len(ops) == 3 { // ignore invalid format
+		switch {
+		case len(ops) > 0 && hasCompoundPattern(ops[0]):
+			i, j := strings.IndexByte(key, ','), strings.LastIndexByte(key, ',')
+			if i < 0 || i == j {
+				errs = append(errs, ConfigError{Line: line, Msg: fmt.Sprintf("invalid rule %q, want: schema, pattern, proxy", key)})
+				continue
+			}
+			cfg.Rule = append(cfg.Rule, RuleConfig{
+				Schema:  ops[0],
+				Pattern: strings.TrimSpace(key[i+1 : j]),
+				Proxy:   strings.TrimSpace(key[j+1:]),
+				line:    line,
+			})
+		case len(ops) == 3:
 			cfg.Rule = append(cfg.Rule, RuleConfig{
 				Schema:  ops[0],
 				Pattern: ops[1],
 				Proxy:   ops[2],
+				line:    line,
+			})
+		case len(ops) == 2 && strings.EqualFold(ops[0], "FINAL"): //final rule
+			cfg.Rule = append(cfg.Rule, RuleConfig{
+				Schema: ops[0],
+				Proxy:  ops[1],
+				line:   line,
 			})
+		default:
+			errs = append(errs, ConfigError{Line: line, Msg: fmt.Sprintf("invalid rule %q, want: schema, pattern, proxy", key)})
 		}
 	}
-	if len(ops) == 2 { //final rule
-		cfg.Rule = append(cfg.Rule, RuleConfig{
-			Schema: ops[0],
-			Proxy:  ops[1],
-		})
-	}
-	return nil
+	return errs
 }
 
-func (cfg *KoneConfig) check() (err error) {
-	return nil
+func (cfg *KoneConfig) parseHost(sec *ini.Section) {
+	line := 0
+	for _, key := range sec.Keys() {
+		line = cfg.lines.find(sec.Name(), key.Name(), line)
+		cfg.Host = append(cfg.Host, HostConfig{
+			Domain: key.Name(),
+			Value:  key.Value(),
+			line:   line,
+		})
+	}
 }
 
 func (cfg *KoneConfig) GetSystemDnsservers() (servers []string) {
@@ -109,6 +185,12 @@ func ParseConfig(source interface{}) (*KoneConfig, error) {
 	cfg.source = source
 
 	// set default value
+	cfg.General.LogMaxSize = 100
+	cfg.General.LogMaxBackups = 3
+	cfg.General.LogFormat = LogFormatText
+	cfg.General.ShutdownTimeout = 10
+	cfg.General.RuleSetInterval = RuleSetDefaultInterval
+
 	cfg.Core.Network = "10.192.0.1/16"
 	cfg.Core.TcpListenPort = 82
 	cfg.Core.TcpNatPortStart = 10000
@@ -123,6 +205,9 @@ func ParseConfig(source interface{}) (*KoneConfig, error) {
 	cfg.Core.DnsPacketSize = DnsDefaultPacketSize
 	cfg.Core.DnsReadTimeout = DnsDefaultReadTimeout
 	cfg.Core.DnsWriteTimeout = DnsDefaultWriteTimeout
+	cfg.Core.DnsCacheSize = DnsDefaultCacheSize
+	cfg.Core.DnsCacheStale = DnsDefaultCacheStale
+	cfg.Core.DnsLogSize = DnsDefaultLogSize
 
 	// decode config value
 	f, err := ini.LoadSources(ini.LoadOptions{AllowBooleanKeys: true, KeyValueDelimiters: "="}, source)
@@ -131,6 +216,7 @@ func ParseConfig(source interface{}) (*KoneConfig, error) {
 		return nil, err
 	}
 	cfg.inif = f
+	cfg.lines = newSourceLines(source)
 
 	err = f.MapTo(cfg)
 	if err != nil {
@@ -142,6 +228,11 @@ func ParseConfig(source interface{}) (*KoneConfig, error) {
 		cfg.Proxy = proxySection.KeysHash()
 	}
 
+	// init proxy group
+	if groupSection, err := f.GetSection("Proxy Group"); err == nil {
+		cfg.ProxyGroup = groupSection.KeysHash()
+	}
+
 	// read proxy from env
 	if os.Getenv(HTTP_PROXY) != "" {
 		cfg.Proxy[HTTP_PROXY] = os.Getenv(HTTP_PROXY)
@@ -163,14 +254,16 @@ func ParseConfig(source interface{}) (*KoneConfig, error) {
 		cfg.Core.DnsServer = cfg.GetSystemDnsservers()
 	}
 
-	// init rule
-	if err := cfg.parseRule(f.Section("Rule")); err != nil {
-		return nil, err
-	}
+	// init host
+	cfg.parseHost(f.Section("Host"))
 
-	err = cfg.check()
-	if err != nil {
-		return nil, err
+	// init rule, and report all problems at once
+	errs := cfg.parseRule(f.Section("Rule"))
+	if errs = append(errs, cfg.check()...); len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			return errs[i].Line < errs[j].Line
+		})
+		return nil, errs
 	}
 
 	return cfg, nil
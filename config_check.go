@@ -0,0 +1,376 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xjdrew/kone/proxy"
+)
+
+// DnsIPPoolMinSpace is the least number of fake ips a network should provide
+const DnsIPPoolMinSpace = 0xff
+
+// a problem of config, Line is 0 if the option is not in config file
+type ConfigError struct {
+	Line int
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return e.Msg
+}
+
+// all problems of config, ordered by line
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+type sourceLine struct {
+	no   int
+	text string // trimmed text
+}
+
+// lines of config source by section, ini.v1 doesn't keep line numbers
+type sourceLines map[string][]sourceLine
+
+func newSourceLines(source interface{}) sourceLines {
+	var data []byte
+	switch v := source.(type) {
+	case string:
+		data, _ = os.ReadFile(v)
+	case []byte:
+		data = v
+	}
+
+	lines := make(sourceLines)
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for no := 1; scanner.Scan(); no++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+		if text[0] == '[' && strings.HasSuffix(text, "]") {
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			continue
+		}
+		lines[section] = append(lines[section], sourceLine{no, text})
+	}
+	return lines
+}
+
+// find line of key in section after line `after`, returns 0 if not found
+func (lines sourceLines) find(section, key string, after int) int {
+	for _, line := range lines[section] {
+		if line.no <= after {
+			continue
+		}
+		if i := strings.IndexByte(line.text, '='); i >= 0 {
+			if strings.TrimSpace(line.text[:i]) == key {
+				return line.no
+			}
+		} else if strings.HasPrefix(line.text, key) { // boolean key, such as rules
+			return line.no
+		}
+	}
+	return 0
+}
+
+type configChecker struct {
+	cfg  *KoneConfig
+	errs ConfigErrors
+}
+
+func (c *configChecker) errorf(line int, format string, a ...interface{}) {
+	c.errs = append(c.errs, ConfigError{Line: line, Msg: fmt.Sprintf(format, a...)})
+}
+
+// line of option in [Core]
+func (c *configChecker) coreLine(key string) int {
+	return c.cfg.lines.find("Core", key, 0)
+}
+
+// line of option in [General]
+func (c *configChecker) generalLine(key string) int {
+	return c.cfg.lines.find("General", key, 0)
+}
+
+// log options are applied before kone starts, check them here to fail early
+func (c *configChecker) checkLogging() {
+	general := c.cfg.General
+	if general.LogLevel != "" {
+		if _, err := ParseLogLevel(general.LogLevel); err != nil {
+			c.errorf(c.generalLine("log-level"), "log-level: %v", err)
+		}
+	}
+	switch strings.ToLower(general.LogFormat) {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		c.errorf(c.generalLine("log-format"), "log-format: invalid log format %q, text or json", general.LogFormat)
+	}
+}
+
+func (c *configChecker) checkRules() {
+	cfg := c.cfg
+	var geoSite *GeoSite
+	for _, rc := range cfg.Rule {
+		pattern, err := parsePattern(rc)
+		if err != nil {
+			c.errorf(rc.line, "rule %s: %v", rc.Schema, err)
+		}
+
+		switch p := pattern.(type) {
+		case IPASNPattern:
+			if cfg.General.ASNDatabase == "" {
+				c.errorf(rc.line, "rule %s: asn-database is not set", rc.Schema)
+			}
+		case *GeoSitePattern:
+			if cfg.General.GeoSiteDir == "" {
+				c.errorf(rc.line, "rule %s: geosite-dir is not set", rc.Schema)
+				break
+			}
+			if geoSite == nil {
+				geoSite = NewGeoSite(cfg.path(cfg.General.GeoSiteDir))
+			}
+			if err := p.load(geoSite); err != nil {
+				c.errorf(rc.line, "rule %s: %v", rc.Schema, err)
+			}
+		}
+
+		switch rc.Proxy {
+		case PolicyDirect, PolicyReject, PolicyRejectDrop:
+			continue
+		}
+		_, isProxy := cfg.Proxy[rc.Proxy]
+		_, isGroup := cfg.ProxyGroup[rc.Proxy]
+		if !isProxy && !isGroup {
+			c.errorf(rc.line, "rule %s: undefined proxy %q", rc.Schema, rc.Proxy)
+		}
+	}
+}
+
+// check proxies and groups as NewProxies builds them
+func (c *configChecker) checkProxies() {
+	cfg := c.cfg
+	sorted := func(m map[string]string) []string {
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	members := make(map[string]*proxy.Proxy)
+	for _, name := range sorted(cfg.Proxy) {
+		members[name] = nil
+		line := cfg.lines.find("Proxy", name, 0)
+		url, via := parseProxyConfig(cfg.Proxy[name])
+		if _, err := proxy.FromUrl(url); err != nil {
+			c.errorf(line, "proxy %s: %v", name, err)
+		}
+		if via == "" || via == PolicyDirect {
+			continue
+		}
+		if _, ok := cfg.Proxy[via]; !ok {
+			c.errorf(line, "proxy %s: undefined proxy %q", name, via)
+			continue
+		}
+		// a cycle is reported by its members, undefined hops by themselves
+		chain := []string{name}
+		for hop := via; hop != "" && hop != PolicyDirect; _, hop = parseProxyConfig(cfg.Proxy[hop]) {
+			chain = append(chain, hop)
+			if hop == name {
+				c.errorf(line, "proxy %s: proxy chain has cycle: %s", name, strings.Join(chain, " -> "))
+				break
+			}
+			if len(chain) > len(cfg.Proxy) {
+				break
+			}
+		}
+	}
+
+	for _, name := range sorted(cfg.ProxyGroup) {
+		line := cfg.lines.find("Proxy Group", name, 0)
+		if _, ok := cfg.Proxy[name]; ok {
+			c.errorf(line, "group %s: conflict with proxy name", name)
+			continue
+		}
+		if _, err := NewProxyGroup(name, cfg.ProxyGroup[name], members); err != nil {
+			c.errorf(line, "%v", err)
+		}
+	}
+}
+
+func (c *configChecker) checkNetwork() {
+	core := c.cfg.Core
+
+	// the lowest 32 bits of network are fake ips, see NewDnsIPPool
+	checkPool := func(key string, subnet *net.IPNet) {
+		if space := ^low32(subnet.Mask); space < DnsIPPoolMinSpace {
+			c.errorf(c.coreLine(key), "%s: network %s is too small for dns ip pool, it has %d ips, at least %d",
+				key, subnet, space, DnsIPPoolMinSpace)
+		}
+	}
+
+	ip, subnet, err := net.ParseCIDR(core.Network)
+	if err != nil {
+		c.errorf(c.coreLine("network"), "network: invalid cidr %q", core.Network)
+	} else if ip.To4() == nil {
+		c.errorf(c.coreLine("network"), "network: %s is not an IPv4 network", core.Network)
+	} else {
+		checkPool("network", subnet)
+	}
+
+	if core.Network6 != "" {
+		ip6, subnet6, err := net.ParseCIDR(core.Network6)
+		if err != nil {
+			c.errorf(c.coreLine("network6"), "network6: invalid cidr %q", core.Network6)
+		} else if ip6.To4() != nil {
+			c.errorf(c.coreLine("network6"), "network6: %s is not an IPv6 network", core.Network6)
+		} else {
+			checkPool("network6", subnet6)
+		}
+	}
+}
+
+type listenPort struct {
+	key  string
+	port uint16
+	line int
+}
+
+// ports of nat range [start, end) are used as source port of relayed packets, which should not collide with ports kone listens on
+func (c *configChecker) checkPortRange(protocol string, start, end uint16, listens []listenPort) {
+	startKey := protocol + "-nat-port-start"
+	if start == 0 || start >= end {
+		c.errorf(c.coreLine(startKey), "%s nat port range [%d, %d) is invalid", protocol, start, end)
+		return
+	}
+	for _, l := range listens {
+		if l.port >= start && l.port < end {
+			c.errorf(l.line, "%s: port %d collides with %s nat port range [%d, %d)", l.key, l.port, protocol, start, end)
+		}
+	}
+}
+
+func (c *configChecker) checkPorts() {
+	core := c.cfg.Core
+
+	tcpListens := []listenPort{
+		{"tcp-listen-port", core.TcpListenPort, c.coreLine("tcp-listen-port")},
+	}
+	udpListens := []listenPort{
+		{"udp-listen-port", core.UdpListenPort, c.coreLine("udp-listen-port")},
+		{"dns-listen-port", core.DnsListenPort, c.coreLine("dns-listen-port")},
+	}
+
+	// manager listens on tun ip too if it listens on all addresses
+	if host, port, err := net.SplitHostPort(c.cfg.General.ManagerAddr); err == nil {
+		ip := net.ParseIP(host)
+		tunIP, _, _ := net.ParseCIDR(core.Network)
+		if host == "" || (ip != nil && (ip.IsUnspecified() || ip.Equal(tunIP))) {
+			if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+				line := c.cfg.lines.find("General", "manager-addr", 0)
+				tcpListens = append(tcpListens, listenPort{"manager-addr", uint16(n), line})
+			}
+		}
+	}
+
+	c.checkPortRange("tcp", core.TcpNatPortStart, core.TcpNatPortEnd, tcpListens)
+	c.checkPortRange("udp", core.UdpNatPortStart, core.UdpNatPortEnd, udpListens)
+
+	if core.UdpListenPort == core.DnsListenPort {
+		c.errorf(c.coreLine("dns-listen-port"), "dns-listen-port: port %d collides with udp-listen-port", core.DnsListenPort)
+	}
+	for _, l := range tcpListens[1:] {
+		if l.port == core.TcpListenPort {
+			c.errorf(l.line, "%s: port %d collides with tcp-listen-port", l.key, l.port)
+		}
+	}
+}
+
+// check dns server of option at line, bootstrap is address of bootstrap dns server of it
+func (c *configChecker) checkDnsServer(line int, option string, server string, bootstrap string) {
+	cfg := c.cfg
+	server, via := parseProxyConfig(server)
+	var dial proxyDialer
+	if via != "" && via != PolicyDirect {
+		_, isProxy := cfg.Proxy[via]
+		_, isGroup := cfg.ProxyGroup[via]
+		if !isProxy && !isGroup {
+			c.errorf(line, "%s: undefined proxy %q", option, via)
+			return
+		}
+		dial = func(string) (net.Conn, error) { return nil, nil }
+	}
+	if _, err := newUpstream(server, &upstreamOptions{}, nil, via, dial); err != nil {
+		c.errorf(line, "%s: %v", option, err)
+		return
+	}
+	if dial == nil && bootstrap == "" && needBootstrap(server) {
+		c.errorf(line, "%s: host of %q is not an ip, set dns-bootstrap or add a dns server of ip", option, server)
+	}
+}
+
+func (c *configChecker) checkDnsServers() {
+	core := &c.cfg.Core
+	if core.DnsBootstrap != "" && bootstrapAddr(core.DnsBootstrap) == "" {
+		c.errorf(c.coreLine("dns-bootstrap"), "dns-bootstrap: %q is not a dns server of ip", core.DnsBootstrap)
+	}
+	bootstrap := findBootstrap(core.DnsServer, "", core.DnsBootstrap)
+	for _, server := range core.DnsServer {
+		c.checkDnsServer(c.coreLine("dns-server"), "dns-server", server, bootstrap)
+	}
+}
+
+func (c *configChecker) checkHosts() {
+	for _, hc := range c.cfg.Host {
+		if _, _, err := parseHostDomain(hc.Domain); err != nil {
+			c.errorf(hc.line, "host: %v", err)
+			continue
+		}
+		_, servers, err := parseHostValue(hc.Value)
+		if err != nil {
+			c.errorf(hc.line, "host %s: %v", hc.Domain, err)
+			continue
+		}
+		bootstrap := findBootstrap(servers, "", c.cfg.Core.DnsBootstrap)
+		for _, server := range servers {
+			c.checkDnsServer(hc.line, "host "+hc.Domain, server, bootstrap)
+		}
+	}
+}
+
+// check reports all problems of config
+func (cfg *KoneConfig) check() ConfigErrors {
+	c := &configChecker{cfg: cfg}
+	c.checkLogging()
+	c.checkRules()
+	c.checkProxies()
+	c.checkNetwork()
+	c.checkPorts()
+	c.checkDnsServers()
+	c.checkHosts()
+	return c.errs
+}
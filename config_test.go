@@ -42,6 +42,9 @@ const (
 	# define a socks5 proxy named "Proxy2"
 	Proxy2 = socks5://127.0.0.1:9080
 
+	[Proxy Group]
+	Group1 = url-test, Proxy1, Proxy2, interval=60
+
 	[Rule]
 	IP-CIDR, 91.108.4.0/22, Proxy1 # rule 0
 	IP-CIDR,91.108.56.0/22,Proxy1 # rule 1
@@ -95,6 +98,7 @@ func TestParseConfig(t *testing.T) {
 
 	assert.Equal(t, "http://proxy.example.com:8080", cfg.Proxy["Proxy1"])
 	assert.Equal(t, "socks5://127.0.0.1:9080", cfg.Proxy["Proxy2"])
+	assert.Equal(t, "url-test, Proxy1, Proxy2, interval=60", cfg.ProxyGroup["Group1"])
 
 	assert.Len(t, cfg.Rule, 15)
 	assert.Equal(t, cfg.Rule[0].Schema, "IP-CIDR")
@@ -109,3 +113,138 @@ func TestParseConfig(t *testing.T) {
 	assert.Equal(t, cfg.Rule[14].Pattern, "")
 	assert.Equal(t, cfg.Rule[14].Proxy, "DIRECT")
 }
+
+func TestConfigCheck(t *testing.T) {
+	data := `[General]
+manager-addr = 0.0.0.0:10082
+
+[Core]
+network = 10.192.0.1/28
+network6 = 10.193.0.1/16
+tcp-listen-port = 10082
+tcp-nat-port-start = 10000
+tcp-nat-port-end = 60000
+udp-nat-port-start = 60000
+udp-nat-port-end = 10000
+dns-listen-port = 82
+
+[Proxy]
+Proxy1 = http://127.0.0.1:8080
+
+[Proxy Group]
+Group1 = fallback, Proxy1
+
+[Rule]
+IP-CIDR, 91.108.4.0/33, Proxy1
+IP-CIDR, 10.0.0.0/8, DIRECT
+DOMAIN-SUFIX, google.com, Proxy1
+DOMAIN, twitter.com, Proxy2
+DOMAIN, twitter.com, Group1
+DOMAIN, facebook.com
+FINAL, REJECT
+`
+	_, err := ParseConfig([]byte(data))
+	require.Error(t, err)
+
+	var errs ConfigErrors
+	require.ErrorAs(t, err, &errs)
+	lines := make([]int, len(errs))
+	for i, e := range errs {
+		lines[i] = e.Line
+	}
+	assert.Equal(t, []int{2, 2, 5, 6, 7, 10, 12, 21, 23, 24, 26}, lines, err.Error())
+	assert.Equal(t, `line 2: manager-addr: port 10082 collides with tcp nat port range [10000, 60000)`, errs[0].Error())
+	assert.Contains(t, errs[2].Msg, "too small for dns ip pool")
+	assert.Contains(t, errs[3].Msg, "not an IPv6 network")
+	assert.Contains(t, errs[5].Msg, "udp nat port range [60000, 10000) is invalid")
+	assert.Contains(t, errs[6].Msg, "collides with udp-listen-port")
+	assert.Contains(t, errs[7].Msg, `invalid cidr "91.108.4.0/33"`)
+	assert.Contains(t, errs[8].Msg, `unknown schema "DOMAIN-SUFIX"`)
+	assert.Contains(t, errs[9].Msg, `undefined proxy "Proxy2"`)
+	assert.Contains(t, errs[10].Msg, `invalid rule "DOMAIN, facebook.com"`)
+
+	// proxies and groups are built at startup, they are checked too
+	_, err = ParseConfig([]byte(`[Proxy]
+Proxy1 = sock5://127.0.0.1:1080
+Proxy2 = ss://aes-128-cfb:pass@127.0.0.1:8388
+Proxy3 = ss://aes-128-gcm:pass@127.0.0.1:8388?plugin=obfs-local
+Proxy4 = socks5://127.0.0.1:1080 via Proxy5
+Proxy5 = http://127.0.0.1:8080 via Proxy4
+Proxy6 = http://127.0.0.1:8080 via Group1
+Proxy7 = http://127.0.0.1:8080 via Proxy4
+
+[Proxy Group]
+Group1 = fallback, Proxy7, Proxy8
+Group2 = random, Proxy7
+Group3 = url-test, Proxy7, interval=0
+Proxy7 = fallback, Proxy7
+`))
+	require.ErrorAs(t, err, &errs)
+	lines = make([]int, len(errs))
+	for i, e := range errs {
+		lines[i] = e.Line
+	}
+	assert.Equal(t, []int{2, 3, 4, 5, 6, 7, 11, 12, 13, 14}, lines, err.Error())
+	assert.Contains(t, errs[0].Msg, "proxy Proxy1: proxy: unknown scheme: sock5")
+	assert.Contains(t, errs[1].Msg, "unsupported shadowsocks cipher")
+	assert.Contains(t, errs[2].Msg, "plugin is not supported")
+	assert.Contains(t, errs[3].Msg, "proxy chain has cycle: Proxy4 -> Proxy5 -> Proxy4")
+	assert.Contains(t, errs[4].Msg, "proxy chain has cycle: Proxy5 -> Proxy4 -> Proxy5")
+	assert.Contains(t, errs[5].Msg, `proxy Proxy6: undefined proxy "Group1"`)
+	assert.Equal(t, "group Group1: no proxy: Proxy8", errs[6].Msg)
+	assert.Contains(t, errs[7].Msg, `unknown type "random"`)
+	assert.Contains(t, errs[8].Msg, "invalid interval")
+	assert.Equal(t, "group Proxy7: conflict with proxy name", errs[9].Msg)
+
+	// log options fail at startup, they are checked too
+	_, err = ParseConfig([]byte(`[General]
+log-level = loud
+log-format = xml
+`))
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	assert.Equal(t, `line 2: log-level: invalid log level: loud`, errs[0].Error())
+	assert.Equal(t, `line 3: log-format: invalid log format "xml", text or json`, errs[1].Error())
+
+	_, err = ParseConfig([]byte(`[General]
+log-level = verbose
+log-format = JSON
+`))
+	assert.NoError(t, err)
+}
+
+func TestParseRegexRule(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+[Proxy]
+Proxy1 = http://127.0.0.1:8080
+
+[Rule]
+DOMAIN-REGEX, ^ad[0-9]{1,3}\.example\.com$, Proxy1
+DOMAIN-WILDCARD, *.example.com, DIRECT
+`))
+	require.NoError(t, err)
+	require.Len(t, cfg.Rule, 2)
+	assert.Equal(t, RuleConfig{Schema: "DOMAIN-REGEX", Pattern: `^ad[0-9]{1,3}\.example\.com$`, Proxy: "Proxy1", line: 6}, cfg.Rule[0])
+	assert.Equal(t, "DOMAIN-WILDCARD", cfg.Rule[1].Schema)
+
+	_, err = ParseConfig([]byte("[Rule]\nDOMAIN-REGEX, ^ad(, DIRECT\n"))
+	assert.ErrorContains(t, err, "line 2: rule DOMAIN-REGEX: invalid regex")
+}
+
+func TestParseLogicalRule(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+[Proxy]
+Proxy1 = http://127.0.0.1:8080
+
+[Rule]
+AND, ((IP-CIDR,1.2.3.0/24), (DST-PORT,443)), Proxy1
+NOT,((NETWORK,tcp)),REJECT
+`))
+	require.NoError(t, err)
+	require.Len(t, cfg.Rule, 2)
+	assert.Equal(t, RuleConfig{Schema: "AND", Pattern: "((IP-CIDR,1.2.3.0/24), (DST-PORT,443))", Proxy: "Proxy1", line: 6}, cfg.Rule[0])
+	assert.Equal(t, "((NETWORK,tcp))", cfg.Rule[1].Pattern)
+
+	_, err = ParseConfig([]byte("[Rule]\nOR,((DST-PORT,80),(NETWORK,icmp)),DIRECT\n"))
+	assert.ErrorContains(t, err, `line 2: rule OR: invalid network "icmp"`)
+}
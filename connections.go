@@ -0,0 +1,148 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// snapshot of an active connection
+type Connection struct {
+	ID       uint64    `json:"id"`
+	Network  string    `json:"network"` // tcp or udp
+	Src      string    `json:"src"`
+	Dst      string    `json:"dst"`
+	Proxy    string    `json:"proxy"`
+	Process  string    `json:"process,omitempty"` // name of local process, empty if unknown
+	Start    time.Time `json:"start"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+}
+
+type activeConn struct {
+	info     Connection // immutable fields
+	upload   atomic.Int64
+	download atomic.Int64
+	process  atomic.Pointer[string] // set when local process is found
+	closer   func()
+}
+
+func (c *activeConn) setProcess(name string) {
+	c.process.Store(&name)
+}
+
+// name of local process, empty if unknown
+func (c *activeConn) processName() string {
+	if name := c.process.Load(); name != nil {
+		return *name
+	}
+	return ""
+}
+
+// count bytes written to w
+type countWriter struct {
+	w       io.Writer
+	counter *atomic.Int64
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.counter.Add(int64(n))
+	return n, err
+}
+
+// registry of active tcp connections and udp tunnels
+type ConnTable struct {
+	lock   sync.Mutex
+	nextID uint64
+	conns  map[uint64]*activeConn
+}
+
+// add registers a connection, closer should make the relay of connection exit
+func (t *ConnTable) add(network, src, dst, proxy string, closer func()) *activeConn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.nextID++
+	c := &activeConn{
+		info: Connection{
+			ID:      t.nextID,
+			Network: network,
+			Src:     src,
+			Dst:     dst,
+			Proxy:   proxy,
+			Start:   time.Now(),
+		},
+		closer: closer,
+	}
+	t.conns[c.info.ID] = c
+	return c
+}
+
+func (t *ConnTable) remove(c *activeConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.conns, c.info.ID)
+}
+
+// List returns active connections ordered by id
+func (t *ConnTable) List() []Connection {
+	t.lock.Lock()
+	conns := make([]Connection, 0, len(t.conns))
+	for _, c := range t.conns {
+		info := c.info
+		info.Upload = c.upload.Load()
+		info.Download = c.download.Load()
+		info.Process = c.processName()
+		conns = append(conns, info)
+	}
+	t.lock.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+	return conns
+}
+
+// close connections matched by f, returns the number of closed connections
+func (t *ConnTable) closeIf(f func(c *activeConn) bool) int {
+	var matched []*activeConn
+	t.lock.Lock()
+	for _, c := range t.conns {
+		if f(c) {
+			matched = append(matched, c)
+		}
+	}
+	t.lock.Unlock()
+
+	// relay removes connection from table when it exits
+	for _, c := range matched {
+		logger.Infof("[conns] close %s %s > %s through %s", c.info.Network, c.info.Src, c.info.Dst, c.info.Proxy)
+		c.closer()
+	}
+	return len(matched)
+}
+
+func (t *ConnTable) Close(id uint64) bool {
+	return t.closeIf(func(c *activeConn) bool {
+		return c.info.ID == id
+	}) > 0
+}
+
+func (t *ConnTable) CloseByProxy(proxy string) int {
+	return t.closeIf(func(c *activeConn) bool {
+		return c.info.Proxy == proxy
+	})
+}
+
+func NewConnTable() *ConnTable {
+	return &ConnTable{
+		conns: make(map[uint64]*activeConn),
+	}
+}
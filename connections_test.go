@@ -0,0 +1,82 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnTable(t *testing.T) {
+	tbl := NewConnTable()
+
+	closed := make(map[string]bool)
+	add := func(network, src, proxy string) *activeConn {
+		var c *activeConn
+		c = tbl.add(network, src, "www.google.com:443", proxy, func() {
+			closed[src] = true
+			tbl.remove(c)
+		})
+		return c
+	}
+	c1 := add("tcp", "10.0.0.2:5000", "Proxy1")
+	add("udp", "10.0.0.2:5001", "Proxy1")
+	c3 := add("tcp", "10.0.0.3:5000", "Proxy2")
+
+	// live byte counters
+	b := bytes.NewBuffer(nil)
+	w := &countWriter{b, &c1.upload}
+	w.Write([]byte("kone"))
+	w.Write([]byte("kone"))
+	c1.download.Add(100)
+	c1.setProcess("curl")
+
+	conns := tbl.List()
+	require.Len(t, conns, 3)
+	assert.Equal(t, c1.info.ID, conns[0].ID)
+	assert.Equal(t, int64(8), conns[0].Upload)
+	assert.Equal(t, int64(100), conns[0].Download)
+	assert.Equal(t, "curl", conns[0].Process)
+	assert.Equal(t, "udp", conns[1].Network)
+	assert.Equal(t, "", conns[1].Process)
+
+	assert.True(t, tbl.Close(c3.info.ID))
+	assert.False(t, tbl.Close(c3.info.ID))
+	assert.True(t, closed["10.0.0.3:5000"])
+
+	assert.Equal(t, 2, tbl.CloseByProxy("Proxy1"))
+	assert.Equal(t, 0, tbl.CloseByProxy("Proxy1"))
+	assert.True(t, closed["10.0.0.2:5001"])
+	assert.Empty(t, tbl.List())
+}
+
+func TestManagerAPIConnections(t *testing.T) {
+	m, ts := newTestManager(t)
+	defer ts.Close()
+
+	var c *activeConn
+	c = m.one.conns.add("tcp", "10.0.0.2:5000", "www.google.com:443", "Proxy1", func() {
+		m.one.conns.remove(c)
+	})
+	m.one.conns.add("tcp", "10.0.0.2:5001", "www.google.com:443", "Proxy2", func() {})
+
+	var conns []Connection
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/connections", &conns))
+	require.Len(t, conns, 2)
+	assert.Equal(t, "Proxy1", conns[0].Proxy)
+
+	assert.Equal(t, http.StatusBadRequest, apiCall(t, "POST", ts.URL+"/api/v1/connections/close", nil))
+	assert.Equal(t, http.StatusBadRequest, apiCall(t, "POST", ts.URL+"/api/v1/connections/close?id=x", nil))
+
+	var result map[string]int
+	require.Equal(t, http.StatusOK, apiCall(t, "POST", ts.URL+"/api/v1/connections/close?proxy=Proxy1", &result))
+	assert.Equal(t, 1, result["closed"])
+	assert.Len(t, m.one.conns.List(), 1)
+}
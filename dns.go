@@ -6,8 +6,10 @@
 package kone
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -27,10 +29,139 @@ const (
 var ErrResolve = errors.New("resolve timeout")
 
 type Dns struct {
-	one         *One
-	server      *dns.Server
-	client      *dns.Client
-	nameservers []string
+	one          *One
+	server       *dns.Server
+	upstreamOpts upstreamOptions
+	listenAddr   string
+
+	nsLock      sync.RWMutex
+	servers     []string // configured dns servers
+	nameservers []upstream
+	proxied     map[string][]upstream // dns servers through proxy, by name of proxy
+	hosts       *dnsHosts             // static hosts and dns servers of domains
+
+	cache *dnsCache // cache of upstream answers, nil if disabled
+	log   *DnsLog   // log of queries, nil if disabled
+}
+
+func (d *Dns) upstreams() []upstream {
+	d.nsLock.RLock()
+	defer d.nsLock.RUnlock()
+	return d.nameservers
+}
+
+// Nameservers returns upstream dns servers
+func (d *Dns) Nameservers() []string {
+	var names []string
+	for _, ns := range d.upstreams() {
+		names = append(names, ns.String())
+	}
+	return names
+}
+
+// SetNameservers replaces upstream dns servers, queries in flight are not affected
+func (d *Dns) SetNameservers(servers []string) {
+	nameservers := parseNameservers(servers, d.listenAddr, &d.upstreamOpts, d.dialProxy)
+	d.nsLock.Lock()
+	d.servers = servers
+	d.nameservers = nameservers
+	d.proxied = make(map[string][]upstream)
+	d.nsLock.Unlock()
+	d.flushCache()
+	logger.Infof("[dns] updstream dns server: %v", d.Nameservers())
+}
+
+// SetHosts replaces static hosts and dns servers of domains
+func (d *Dns) SetHosts(hosts []HostConfig) {
+	h := newDnsHosts(hosts, d.listenAddr, &d.upstreamOpts, d.dialProxy)
+	d.nsLock.Lock()
+	d.hosts = h
+	d.nsLock.Unlock()
+	d.flushCache()
+	logger.Infof("[dns] %d hosts", len(h.hosts))
+}
+
+// host entry of domain, nil if none
+func (d *Dns) host(domain string) *dnsHost {
+	d.nsLock.RLock()
+	h := d.hosts
+	d.nsLock.RUnlock()
+	return h.lookup(domain)
+}
+
+// Hosts returns host entries in use, values are static ips or names of dns servers
+func (d *Dns) Hosts() []HostConfig {
+	d.nsLock.RLock()
+	h := d.hosts
+	d.nsLock.RUnlock()
+	if h == nil {
+		return nil
+	}
+
+	var hosts []HostConfig
+	for _, host := range h.hosts {
+		var values []string
+		for _, ip := range host.ips {
+			values = append(values, ip.String())
+		}
+		for _, ns := range host.nameservers {
+			values = append(values, ns.String())
+		}
+		value := strings.Join(values, ", ")
+		if len(host.nameservers) > 0 {
+			value = "server:" + value
+		}
+		hosts = append(hosts, HostConfig{Domain: host.domain, Value: value})
+	}
+	return hosts
+}
+
+// upstreamsOf returns dns servers of domain in [Host], or upstream dns servers
+func (d *Dns) upstreamsOf(domain string) []upstream {
+	if host := d.host(domain); host != nil && len(host.nameservers) > 0 {
+		return host.nameservers
+	}
+	return d.upstreams()
+}
+
+// dialer of proxy, it dials by proxies in use
+func (d *Dns) dialProxy(proxy string) proxyDialer {
+	return func(addr string) (net.Conn, error) {
+		rt := d.one.routing()
+		if rt == nil || rt.proxies == nil {
+			return nil, fmt.Errorf("no proxy: %s", proxy)
+		}
+		return rt.proxies.Dial(proxy, addr)
+	}
+}
+
+// proxiedUpstreams returns dns servers through proxy, including servers through other proxies
+func (d *Dns) proxiedUpstreams(proxy string) []upstream {
+	d.nsLock.RLock()
+	cache, servers := d.proxied, d.servers
+	nameservers, ok := cache[proxy]
+	d.nsLock.RUnlock()
+	if ok {
+		return nameservers
+	}
+
+	var vias []string
+	for _, server := range servers {
+		server, _ := parseProxyConfig(server)
+		if u, err := newUpstream(server, &d.upstreamOpts, nil, "", nil); err != nil || u.String() == d.listenAddr {
+			continue
+		}
+		if strings.HasPrefix(server, "udp://") {
+			server = "tcp://" + strings.TrimPrefix(server, "udp://")
+		}
+		vias = append(vias, server+" via "+proxy)
+	}
+	nameservers = parseNameservers(vias, d.listenAddr, &d.upstreamOpts, d.dialProxy)
+
+	d.nsLock.Lock()
+	cache[proxy] = nameservers
+	d.nsLock.Unlock()
+	return nameservers
 }
 
 // query synchronously
@@ -38,26 +169,116 @@ func (d *Dns) Resolve(domain string) (*dns.Msg, error) {
 	r := new(dns.Msg)
 	r.SetQuestion(dns.Fqdn(domain), dns.TypeA)
 
-	return d.resolve(r)
+	return d.resolve(r, new(DnsQuery))
+}
+
+// real ip of hijacked domain, resolve it if unknown. Domain of a proxy is resolved through the proxy,
+// so the ip is not polluted and the domain is not leaked, unless it has dns servers in [Host].
+func (d *Dns) RealIP(record *DomainRecord) (net.IP, error) {
+	table := d.one.dnsTable
+	if ip := table.RealIP(record); ip != nil {
+		return ip, nil
+	}
+
+	nameservers := d.upstreams()
+	if host := d.host(record.Hostname); host != nil && len(host.nameservers) > 0 {
+		nameservers = host.nameservers
+	} else if record.Proxy != PolicyDirect && !IsRejectPolicy(record.Proxy) {
+		nameservers = d.proxiedUpstreams(record.Proxy)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(record.Hostname), dns.TypeA)
+	msg, _, err := d.exchange(r, nameservers)
+	if err == nil {
+		if ip := table.SetRealIP(record, msg); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("resolve %s failed", record.Hostname)
+}
+
+// resolve by dns servers of the domain, answers are cached if cache is enabled.
+// Upstream of q is set to the dns server answered.
+func (d *Dns) resolve(r *dns.Msg, q *DnsQuery) (*dns.Msg, error) {
+	nameservers := d.upstreamsOf(dnsutil.TrimDomainName(r.Question[0].Name, "."))
+	if d.cache == nil {
+		msg, ns, err := d.exchange(r, nameservers)
+		if err == nil {
+			q.Upstream = ns.String()
+		}
+		return msg, err
+	}
+
+	now := time.Now()
+	if msg, prefetch := d.cache.get(r, now); msg != nil {
+		if prefetch {
+			go d.prefetch(r.Copy(), nameservers)
+		}
+		q.Upstream = "cache"
+		return msg, nil
+	}
+
+	msg, ns, err := d.exchange(r, nameservers)
+	if err != nil {
+		if stale := d.cache.getStale(r, now); stale != nil {
+			logger.Debugf("[dns] serve stale answer of %s", r.Question[0].Name)
+			q.Upstream = "cache (stale)"
+			return stale, nil
+		}
+		return nil, err
+	}
+	d.cache.set(r, msg, now)
+	q.Upstream = ns.String()
+	return msg, nil
 }
 
-func (d *Dns) resolve(r *dns.Msg) (*dns.Msg, error) {
+// refresh cached answer of r before it expires
+func (d *Dns) prefetch(r *dns.Msg, nameservers []upstream) {
+	msg, _, err := d.exchange(r, nameservers)
+	if err != nil {
+		d.cache.prefetchFailed(r)
+		return
+	}
+	d.cache.set(r, msg, time.Now())
+}
+
+func (d *Dns) flushCache() {
+	if d.cache != nil {
+		d.cache.Flush()
+	}
+}
+
+// CacheStats returns statistics of dns cache, ok is false if cache is disabled
+func (d *Dns) CacheStats() (stats DnsCacheStats, ok bool) {
+	if d.cache == nil {
+		return stats, false
+	}
+	return d.cache.Stats(), true
+}
+
+// query nameservers in turn every 100ms, returns the first success answer and its nameserver
+func (d *Dns) exchange(r *dns.Msg, nameservers []upstream) (*dns.Msg, upstream, error) {
+	type answer struct {
+		msg *dns.Msg
+		ns  upstream
+	}
 	var wg sync.WaitGroup
-	msgCh := make(chan *dns.Msg, 1)
+	msgCh := make(chan answer, 1)
 
 	qname := r.Question[0].Name
 
-	Q := func(ns string) {
+	Q := func(ns upstream) {
 		defer wg.Done()
 
-		r, rtt, err := d.client.Exchange(r, ns)
+		r, rtt, err := ns.Exchange(r)
 		if err != nil {
 			logger.Debugf("[dns] resolve %s on %s failed: %v", qname, ns, err)
 			return
 		}
 
-		// remove this code
-		if r.Rcode != dns.RcodeSuccess {
+		// NXDOMAIN is an answer too
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
 			logger.Debugf("[dns] resolve %s on %s failed: code %d", qname, ns, r.Rcode)
 			return
 		}
@@ -65,7 +286,7 @@ func (d *Dns) resolve(r *dns.Msg) (*dns.Msg, error) {
 		logger.Debugf("[dns] resolve %s on %s, code: %d, rtt: %d", qname, ns, r.Rcode, rtt)
 
 		select {
-		case msgCh <- r:
+		case msgCh <- answer{r, ns}:
 		default:
 		}
 	}
@@ -73,13 +294,13 @@ func (d *Dns) resolve(r *dns.Msg) (*dns.Msg, error) {
 	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
 
-	for _, ns := range d.nameservers {
+	for _, ns := range nameservers {
 		wg.Add(1)
 		go Q(ns)
 
 		select {
-		case r := <-msgCh:
-			return r, nil
+		case a := <-msgCh:
+			return a.msg, a.ns, nil
 		case <-ticker.C:
 			continue
 		}
@@ -88,91 +309,158 @@ func (d *Dns) resolve(r *dns.Msg) (*dns.Msg, error) {
 	wg.Wait()
 
 	select {
-	case r := <-msgCh:
-		return r, nil
+	case a := <-msgCh:
+		return a.msg, a.ns, nil
 	default:
 		logger.Errorf("[dns] query %s timeout", qname)
-		return nil, ErrResolve
+		return nil, nil, ErrResolve
 	}
 }
 
-func (d *Dns) doIPv4Query(r *dns.Msg) (*dns.Msg, error) {
+// A & AAAA query, q records how it's answered
+func (d *Dns) doIPQuery(r *dns.Msg, q *DnsQuery) (*dns.Msg, error) {
 	one := d.one
 
 	domain := dnsutil.TrimDomainName(r.Question[0].Name, ".")
 	// short circuit: non proxy
 	if one.dnsTable.IsNonProxyDomain(domain) {
-		return d.resolve(r)
+		msg, err := d.resolve(r, q)
+		if err == nil {
+			d.count(q, dnsNonProxy)
+		}
+		return msg, err
 	}
 
 	// short circuit: proxy
 	record := one.dnsTable.Get(domain)
 	if record != nil {
+		d.count(q, dnsHijacked)
 		return record.Answer(r), nil
 	}
 
 	// match by domain
-	proxy := one.rule.Proxy(domain)
-	if proxy != "DIRECT" {
+	rule := one.routing().rule
+	proxy, exact, matched := rule.MatchRule(&Flow{Domain: domain})
+	q.Rule = matched
+	if !exact { // depends on connections, hijack it and let relays decide
+		record := one.dnsTable.SetUndecided(domain, proxy)
+		d.count(q, dnsHijacked)
+		return record.Answer(r), nil
+	}
+	if IsRejectPolicy(proxy) {
+		return d.reject(r, q, domain, proxy), nil
+	}
+	if proxy != PolicyDirect {
 		record := one.dnsTable.Set(domain, proxy)
+		d.count(q, dnsHijacked)
 		return record.Answer(r), nil
 	}
 
 	// match by IP & CNAME
-	msg, err := d.resolve(r)
+	msg, err := d.resolve(r, q)
 	if err != nil || len(msg.Answer) == 0 {
+		if err == nil {
+			d.count(q, dnsNonProxy)
+		}
 		return msg, err
 	}
 
-	for _, item := range msg.Answer {
-		switch answer := item.(type) {
-		case *dns.A:
-			// test ip
-			proxy = one.rule.Proxy(answer.A)
-			if proxy != "DIRECT" {
-				break
-			}
-		case *dns.CNAME:
-			// test cname
-			proxy = one.rule.Proxy(answer.Target)
-			if proxy != "DIRECT" {
-				break
-			}
-		default:
-			logger.Noticef("[dns] unexpected response %s -> %v", domain, item)
-		}
-	}
+	flows := answerFlows(msg)
+	proxy, exact, matched = rule.MatchAnswer(flows)
+	q.Rule = matched
 
 	// if IP or CNAME use proxy
-	if proxy != "DIRECT" {
-		record := one.dnsTable.Set(domain, proxy)
-		record.SetRealIP(msg)
+	if !exact {
+		record := one.dnsTable.SetByAnswer(domain, proxy, true, msg, flows)
+		d.count(q, dnsHijacked)
+		return record.Answer(r), nil
+	} else if IsRejectPolicy(proxy) {
+		return d.reject(r, q, domain, proxy), nil
+	} else if proxy != PolicyDirect {
+		record := one.dnsTable.SetByAnswer(domain, proxy, false, msg, flows)
+		d.count(q, dnsHijacked)
 		return record.Answer(r), nil
 	} else {
-		// set domain as a non-proxy-domain
-		one.dnsTable.SetNonProxyDomain(domain, msg.Answer[0].Header().Ttl)
+		d.count(q, dnsNonProxy)
+		// set domain as a non-proxy-domain; only by A answer, as IP-CIDR rules are mostly IPv4
+		if r.Question[0].Qtype == dns.TypeA {
+			one.dnsTable.SetNonProxyDomain(domain, msg.Answer[0].Header().Ttl)
+		}
 		// final
 		return msg, err
 	}
 }
 
-func isIPv4Query(q dns.Question) bool {
-	if q.Qclass == dns.ClassINET && q.Qtype == dns.TypeA {
+// forge a reply for rejected domain: NXDOMAIN for REJECT, 0.0.0.0 or :: for REJECT-DROP
+func (d *Dns) reject(r *dns.Msg, q *DnsQuery, domain string, proxy string) *dns.Msg {
+	logger.Debugf("[dns] reject %s by %s", domain, proxy)
+	q.Decision = DnsDecisionRejected
+	if d.one.manager != nil {
+		d.one.manager.rejectDns.Add(1)
+	}
+
+	rsp := new(dns.Msg)
+	if proxy == PolicyRejectDrop {
+		rsp.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeAAAA {
+			rsp.Answer = append(rsp.Answer, forgeIPv6Answer(domain, net.IPv6zero))
+		} else {
+			rsp.Answer = append(rsp.Answer, forgeIPv4Answer(domain, net.IPv4zero))
+		}
+	} else {
+		rsp.SetRcode(r, dns.RcodeNameError)
+	}
+	rsp.RecursionAvailable = true
+	return rsp
+}
+
+// decisions of outcomes
+var dnsOutcomeDecisions = [dnsOutcomes]string{
+	dnsHijacked: DnsDecisionHijacked,
+	dnsNonProxy: DnsDecisionNonProxy,
+	dnsStatic:   DnsDecisionStatic,
+	dnsFailed:   DnsDecisionFailed,
+}
+
+// count outcome of query q
+func (d *Dns) count(q *DnsQuery, outcome int) {
+	q.Decision = dnsOutcomeDecisions[outcome]
+	if d.one.manager != nil {
+		d.one.manager.dnsQueries[outcome].Add(1)
+	}
+}
+
+func isIPQuery(q dns.Question) bool {
+	if q.Qclass == dns.ClassINET && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
 		return true
 	}
 	return false
 }
 
 func (d *Dns) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	isIPv4 := isIPv4Query(r.Question[0])
+	question := r.Question[0]
+	q := &DnsQuery{
+		Time: time.Now(),
+		Name: dnsutil.TrimDomainName(question.Name, "."),
+		Type: dns.Type(question.Qtype).String(),
+	}
+	if addr := w.RemoteAddr(); addr != nil {
+		q.Client = addr.String()
+		if host, _, err := net.SplitHostPort(q.Client); err == nil {
+			q.Client = host
+		}
+	}
 
-	var msg *dns.Msg
-	var err error
+	msg, err := d.serve(r, q)
+	if err != nil {
+		d.count(q, dnsFailed)
+	}
 
-	if isIPv4 {
-		msg, err = d.doIPv4Query(r)
-	} else {
-		msg, err = d.resolve(r)
+	q.Latency = time.Since(q.Time).Round(time.Microsecond)
+	logger.Debugf("[dns] %s %s from %s: %s, rule: %s, upstream: %s, latency: %v",
+		q.Type, q.Name, q.Client, q.Decision, q.Rule, q.Upstream, q.Latency)
+	if d.log != nil {
+		d.log.Add(*q)
 	}
 
 	if err != nil {
@@ -182,11 +470,54 @@ func (d *Dns) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
+// answer query r, q records how it's answered
+func (d *Dns) serve(r *dns.Msg, q *DnsQuery) (*dns.Msg, error) {
+	if !isIPQuery(r.Question[0]) {
+		msg, err := d.resolve(r, q)
+		if err == nil {
+			d.count(q, dnsNonProxy)
+			q.Decision = DnsDecisionForwarded
+		}
+		return msg, err
+	}
+
+	// static hosts first
+	if host := d.host(q.Name); host != nil && len(host.ips) > 0 {
+		d.count(q, dnsStatic)
+		return host.answer(r), nil
+	}
+	return d.doIPQuery(r, q)
+}
+
 func (d *Dns) Serve() error {
+	if d.cache != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			tick := time.NewTicker(60 * time.Second)
+			defer tick.Stop()
+			for {
+				select {
+				case now := <-tick.C:
+					d.cache.clearExpired(now)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
 	logger.Infof("[dns] listen on %s", d.server.Addr)
 	return d.server.ListenAndServe()
 }
 
+func (d *Dns) Shutdown(ctx context.Context) error {
+	err := d.server.ShutdownContext(ctx)
+	if d.log != nil {
+		d.log.Close()
+	}
+	return err
+}
+
 func NewDns(one *One, cfg CoreConfig) (*Dns, error) {
 	d := new(Dns)
 	d.one = one
@@ -201,25 +532,19 @@ func NewDns(one *One, cfg CoreConfig) (*Dns, error) {
 		WriteTimeout: time.Duration(cfg.DnsWriteTimeout) * time.Second,
 	}
 
-	client := &dns.Client{
-		Net:          "udp",
-		UDPSize:      cfg.DnsPacketSize,
-		ReadTimeout:  time.Duration(cfg.DnsReadTimeout) * time.Second,
-		WriteTimeout: time.Duration(cfg.DnsWriteTimeout) * time.Second,
+	d.upstreamOpts = upstreamOptions{
+		packetSize:   cfg.DnsPacketSize,
+		readTimeout:  time.Duration(cfg.DnsReadTimeout) * time.Second,
+		writeTimeout: time.Duration(cfg.DnsWriteTimeout) * time.Second,
+		bootstrap:    cfg.DnsBootstrap,
 	}
 
-	d.server = server
-	d.client = client
-
-	for _, addr := range cfg.DnsServer {
-		if !strings.Contains(addr, ":") {
-			addr = addr + ":53"
-		}
-
-		if addr != dnsListenAddr { // don't add self
-			d.nameservers = append(d.nameservers, addr)
-		}
+	if cfg.DnsCacheSize > 0 {
+		d.cache = newDnsCache(int(cfg.DnsCacheSize), time.Duration(cfg.DnsCacheStale)*time.Second)
 	}
-	logger.Infof("[dns] updstream dns server: %v", d.nameservers)
+
+	d.server = server
+	d.listenAddr = dnsListenAddr
+	d.SetNameservers(cfg.DnsServer)
 	return d, nil
 }
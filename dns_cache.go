@@ -0,0 +1,255 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DnsDefaultCacheSize  = 4096
+	DnsDefaultCacheStale = 3600 // seconds
+
+	dnsCacheMaxNegativeTtl = 300 // seconds
+	dnsCacheStaleTtl       = 30  // ttl of stale answers, RFC 8767
+)
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func dnsCacheKeyOf(r *dns.Msg) dnsCacheKey {
+	q := r.Question[0]
+	return dnsCacheKey{strings.ToLower(q.Name), q.Qtype, q.Qclass}
+}
+
+type dnsCacheEntry struct {
+	key         dnsCacheKey
+	msg         *dns.Msg
+	ttl         uint32    // ttl when stored
+	stored      time.Time // time when stored
+	prefetching bool
+}
+
+func (e *dnsCacheEntry) expires() time.Time {
+	return e.stored.Add(time.Duration(e.ttl) * time.Second)
+}
+
+// reply of r by cached answer, ttls are reduced by age, or set to ttl if it's not zero
+func (e *dnsCacheEntry) reply(r *dns.Msg, now time.Time, ttl uint32) *dns.Msg {
+	msg := e.msg.Copy()
+	msg.Id = r.Id
+	msg.Question = r.Question
+
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			switch {
+			case hdr.Rrtype == dns.TypeOPT:
+			case ttl > 0:
+				hdr.Ttl = ttl
+			case hdr.Ttl > age:
+				hdr.Ttl -= age
+			default:
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return msg
+}
+
+// DnsCacheStats is statistics of dns cache
+type DnsCacheStats struct {
+	Entries  int   `json:"entries"`
+	Capacity int   `json:"capacity"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Stale    int64 `json:"stale"` // stale answers served on upstream failure, not counted in misses
+}
+
+// HitRatio returns percentage of queries answered by cache, stale answers included
+func (s DnsCacheStats) HitRatio() float64 {
+	total := s.Hits + s.Misses + s.Stale
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.Stale) * 100 / float64(total)
+}
+
+// dnsCache caches upstream answers by question, until their ttls expire. Expired answers are kept
+// for stale seconds, to be served when upstream dns servers fail. The least recently used answer is
+// evicted when the cache is full.
+type dnsCache struct {
+	lock    sync.Mutex
+	size    int
+	stale   time.Duration
+	entries map[dnsCacheKey]*list.Element
+	lru     *list.List // front is the most recently used
+
+	hits, misses, staleHits int64
+}
+
+// ttl of answer to cache, 0 if it shouldn't be cached.
+// Negative answers are cached by SOA of authority section, see RFC 2308.
+func dnsCacheTtl(msg *dns.Msg) uint32 {
+	if msg.Truncated {
+		return 0
+	}
+	switch {
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0:
+		ttl := uint32(0)
+		for i, rr := range msg.Answer {
+			if i == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl
+	case msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError:
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				if ttl > dnsCacheMaxNegativeTtl {
+					ttl = dnsCacheMaxNegativeTtl
+				}
+				return ttl
+			}
+		}
+	}
+	return 0
+}
+
+// get returns cached answer of r, nil if missed. prefetch is true if the answer is going to expire,
+// and it's reported once for an answer.
+func (c *dnsCache) get(r *dns.Msg, now time.Time) (msg *dns.Msg, prefetch bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[dnsCacheKeyOf(r)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	e := elem.Value.(*dnsCacheEntry)
+	expires := e.expires()
+	if !now.Before(expires) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+
+	// prefetch in the last tenth of ttl
+	if !e.prefetching && expires.Sub(now) <= time.Duration(e.ttl)*time.Second/10 {
+		e.prefetching = true
+		prefetch = true
+	}
+	return e.reply(r, now, 0), prefetch
+}
+
+// getStale returns expired answer of r within stale seconds, nil if none.
+// It's called after get missed r, and moves the lookup from misses to stale if served.
+func (c *dnsCache) getStale(r *dns.Msg, now time.Time) *dns.Msg {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[dnsCacheKeyOf(r)]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*dnsCacheEntry)
+	if now.After(e.expires().Add(c.stale)) {
+		return nil
+	}
+	c.misses--
+	c.staleHits++
+	return e.reply(r, now, dnsCacheStaleTtl)
+}
+
+// set caches answer of r
+func (c *dnsCache) set(r *dns.Msg, msg *dns.Msg, now time.Time) {
+	ttl := dnsCacheTtl(msg)
+	if ttl == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := dnsCacheKeyOf(r)
+	e := &dnsCacheEntry{key: key, msg: msg.Copy(), ttl: ttl, stored: now}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// prefetchFailed allows answer of r to be prefetched again
+func (c *dnsCache) prefetchFailed(r *dns.Msg) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[dnsCacheKeyOf(r)]; ok {
+		elem.Value.(*dnsCacheEntry).prefetching = false
+	}
+}
+
+// clearExpired removes answers expired for more than stale seconds
+func (c *dnsCache) clearExpired(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, elem := range c.entries {
+		if now.After(elem.Value.(*dnsCacheEntry).expires().Add(c.stale)) {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Flush removes all answers
+func (c *dnsCache) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[dnsCacheKey]*list.Element)
+	c.lru.Init()
+}
+
+func (c *dnsCache) Stats() DnsCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return DnsCacheStats{
+		Entries:  c.lru.Len(),
+		Capacity: c.size,
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Stale:    c.staleHits,
+	}
+}
+
+func newDnsCache(size int, stale time.Duration) *dnsCache {
+	return &dnsCache{
+		size:    size,
+		stale:   stale,
+		entries: make(map[dnsCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
@@ -0,0 +1,214 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDnsQuery(name string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return r
+}
+
+func testDnsSOA(name string, ttl, minttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:    dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "ns.example.com.",
+		Mbox:   "admin.example.com.",
+		Minttl: minttl,
+	}
+}
+
+func TestDnsCache(t *testing.T) {
+	c := newDnsCache(2, time.Minute)
+	now := time.Now()
+
+	r := testDnsQuery("www.example.com")
+	msg := testDnsAnswer(r, "1.1.1.1") // ttl 60
+	c.set(r, msg, now)
+
+	rsp, prefetch := c.get(testDnsQuery("WWW.example.com"), now.Add(10*time.Second))
+	require.NotNil(t, rsp)
+	assert.False(t, prefetch)
+	assert.Equal(t, "WWW.example.com.", rsp.Question[0].Name)
+	assert.Equal(t, uint32(50), rsp.Answer[0].Header().Ttl)
+
+	// prefetch once in the last tenth of ttl
+	_, prefetch = c.get(r, now.Add(55*time.Second))
+	assert.True(t, prefetch)
+	_, prefetch = c.get(r, now.Add(56*time.Second))
+	assert.False(t, prefetch)
+
+	// expired answers are served on failure only
+	rsp, _ = c.get(r, now.Add(60*time.Second))
+	assert.Nil(t, rsp)
+	rsp = c.getStale(r, now.Add(90*time.Second))
+	require.NotNil(t, rsp)
+	assert.Equal(t, uint32(dnsCacheStaleTtl), rsp.Answer[0].Header().Ttl)
+	assert.Nil(t, c.getStale(r, now.Add(121*time.Second)))
+	c.clearExpired(now.Add(121 * time.Second))
+	assert.Equal(t, 0, c.Stats().Entries)
+
+	// least recently used answer is evicted
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		c.set(testDnsQuery(name), testDnsAnswer(testDnsQuery(name), "1.1.1.1"), now)
+	}
+	c.get(testDnsQuery("a.example.com"), now)
+	c.set(testDnsQuery("c.example.com"), testDnsAnswer(testDnsQuery("c.example.com"), "1.1.1.1"), now)
+	rsp, _ = c.get(testDnsQuery("b.example.com"), now)
+	assert.Nil(t, rsp)
+	rsp, _ = c.get(testDnsQuery("a.example.com"), now)
+	assert.NotNil(t, rsp)
+
+	stats := c.Stats()
+	assert.Equal(t, DnsCacheStats{Entries: 2, Capacity: 2, Hits: 5, Misses: 1, Stale: 1}, stats)
+	assert.InDelta(t, 85.7, stats.HitRatio(), 0.1)
+
+	c.Flush()
+	assert.Equal(t, 0, c.Stats().Entries)
+}
+
+func TestDnsCacheTtl(t *testing.T) {
+	r := testDnsQuery("www.example.com")
+
+	nx := new(dns.Msg)
+	nx.SetRcode(r, dns.RcodeNameError)
+	assert.Equal(t, uint32(0), dnsCacheTtl(nx)) // no SOA
+	nx.Ns = []dns.RR{testDnsSOA("example.com", 3600, 60)}
+	assert.Equal(t, uint32(60), dnsCacheTtl(nx))
+	nx.Ns = []dns.RR{testDnsSOA("example.com", 7200, 7200)}
+	assert.Equal(t, uint32(dnsCacheMaxNegativeTtl), dnsCacheTtl(nx))
+
+	nodata := new(dns.Msg)
+	nodata.SetReply(r)
+	nodata.Ns = []dns.RR{testDnsSOA("example.com", 30, 60)}
+	assert.Equal(t, uint32(30), dnsCacheTtl(nodata))
+
+	fail := new(dns.Msg)
+	fail.SetRcode(r, dns.RcodeServerFailure)
+	fail.Ns = nodata.Ns
+	assert.Equal(t, uint32(0), dnsCacheTtl(fail))
+
+	msg := testDnsAnswer(r, "1.1.1.1")
+	msg.Answer = append(msg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.ParseIP("1.1.1.2"),
+	})
+	assert.Equal(t, uint32(10), dnsCacheTtl(msg))
+}
+
+func TestDnsResolveCache(t *testing.T) {
+	var queries atomic.Int32
+	var failing atomic.Bool
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		if failing.Load() {
+			dns.HandleFailed(w, r)
+			return
+		}
+		if r.Question[0].Name == "missing.example.com." {
+			msg := new(dns.Msg)
+			msg.SetRcode(r, dns.RcodeNameError)
+			msg.Ns = []dns.RR{testDnsSOA("example.com", 600, 600)}
+			w.WriteMsg(msg)
+			return
+		}
+		w.WriteMsg(testDnsAnswer(r, "1.0.0.1"))
+	})})
+
+	d := newTestDns(nil)
+	d.cache = newDnsCache(16, time.Hour)
+	d.SetNameservers([]string{pc.LocalAddr().String()})
+
+	for i := 0; i < 2; i++ {
+		msg, err := d.Resolve("www.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "1.0.0.1", msg.Answer[0].(*dns.A).A.String())
+	}
+	assert.Equal(t, int32(1), queries.Load())
+
+	// negative answer is cached too
+	for i := 0; i < 2; i++ {
+		msg, err := d.Resolve("missing.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	}
+	assert.Equal(t, int32(2), queries.Load())
+
+	age := func(name string, by time.Duration) {
+		c := d.cache
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		e := c.entries[dnsCacheKeyOf(testDnsQuery(name))].Value.(*dnsCacheEntry)
+		e.stored = e.stored.Add(-by)
+	}
+
+	// prefetch before expiry
+	age("www.example.com", 55*time.Second)
+	_, err = d.Resolve("www.example.com")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return queries.Load() == 3 }, 3*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		msg, _ := d.cache.get(testDnsQuery("www.example.com"), time.Now())
+		return msg != nil && msg.Answer[0].Header().Ttl > 55
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// serve stale on failure
+	failing.Store(true)
+	age("www.example.com", 2*time.Minute)
+	msg, err := d.Resolve("www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(dnsCacheStaleTtl), msg.Answer[0].Header().Ttl)
+	_, err = d.Resolve("www.google.com")
+	assert.Error(t, err)
+
+	stats, ok := d.CacheStats()
+	require.True(t, ok)
+	assert.Equal(t, int64(1), stats.Stale)
+	misses := stats.Misses
+	_, err = d.Resolve("www.example.com")
+	require.NoError(t, err)
+	stats, _ = d.CacheStats()
+	assert.Equal(t, int64(2), stats.Stale)
+	assert.Equal(t, misses, stats.Misses) // a stale answer is not a miss
+
+	// new nameservers flush cache
+	d.SetNameservers([]string{pc.LocalAddr().String()})
+	stats, _ = d.CacheStats()
+	assert.Equal(t, 0, stats.Entries)
+}
+
+func TestManagerDnsCache(t *testing.T) {
+	m, ts := newTestManager(t)
+	defer ts.Close()
+
+	var b bytes.Buffer
+	require.NoError(t, m.dnsHandle(&b, httptest.NewRequest("GET", "/dns/", nil)))
+	assert.Contains(t, b.String(), "Answer cache: disabled")
+
+	m.one.dns.cache = newDnsCache(16, time.Hour)
+	r := testDnsQuery("www.example.com")
+	m.one.dns.cache.get(r, time.Now())
+	m.one.dns.cache.set(r, testDnsAnswer(r, "1.1.1.1"), time.Now())
+	m.one.dns.cache.get(r, time.Now())
+
+	b.Reset()
+	require.NoError(t, m.dnsHandle(&b, httptest.NewRequest("GET", "/dns/", nil)))
+	assert.Contains(t, b.String(), "Answer cache: 1/16 entries, hit ratio 50.0% (1 hits, 1 misses), 0 stale answers served")
+}
@@ -0,0 +1,131 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// HostConfig is an entry of [Host]: static ips of a domain, or dns servers of domains
+type HostConfig struct {
+	Domain string `json:"domain"` // domain, or *.domain for domain and its sub domains
+	Value  string `json:"value"`  // ip list, or server:dns-server list
+
+	line int // line in config file, 0 if unknown
+}
+
+// parse domain of host entry, suffix is true for *.domain
+func parseHostDomain(domain string) (name string, suffix bool, err error) {
+	name = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if strings.HasPrefix(name, "*.") {
+		name, suffix = name[2:], true
+	}
+	if name == "" || strings.ContainsAny(name, "* \t") {
+		return "", false, fmt.Errorf("invalid host domain %q", domain)
+	}
+	return name, suffix, nil
+}
+
+// parse value of host entry: "ip[, ip...]" or "server:dns-server[, dns-server...]"
+func parseHostValue(value string) (ips []net.IP, servers []string, err error) {
+	if rest, ok := strings.CutPrefix(strings.TrimSpace(value), "server:"); ok {
+		for _, server := range strings.Split(rest, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				servers = append(servers, server)
+			}
+		}
+		if len(servers) == 0 {
+			return nil, nil, fmt.Errorf("no dns server in %q", value)
+		}
+		return nil, servers, nil
+	}
+
+	for _, s := range strings.Split(value, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid ip %q", strings.TrimSpace(s))
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil, nil
+}
+
+// a static host, or dns servers of domains
+type dnsHost struct {
+	domain      string
+	ips         []net.IP
+	nameservers []upstream
+}
+
+// answer A or AAAA query by static ips, ips of the other family are skipped
+func (h *dnsHost) answer(r *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+
+	q := r.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: DnsDefaultTtl}
+	for _, ip := range h.ips {
+		switch {
+		case q.Qtype == dns.TypeA && len(ip) == net.IPv4len:
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: ip})
+		case q.Qtype == dns.TypeAAAA && len(ip) == net.IPv6len:
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return msg
+}
+
+// hosts of [Host], the first entry matches a domain wins
+type dnsHosts struct {
+	hosts   []*dnsHost
+	domains *domainTrie
+}
+
+// lookup returns host entry of domain, nil if none
+func (h *dnsHosts) lookup(domain string) *dnsHost {
+	if h == nil || len(h.hosts) == 0 {
+		return nil
+	}
+	if i := h.domains.lookup(strings.ToLower(domain)); i >= 0 {
+		return h.hosts[i]
+	}
+	return nil
+}
+
+// newDnsHosts parses host entries, invalid entries are skipped
+func newDnsHosts(configs []HostConfig, self string, opts *upstreamOptions, dialProxy func(proxy string) proxyDialer) *dnsHosts {
+	h := &dnsHosts{domains: newDomainTrie()}
+	for _, hc := range configs {
+		name, suffix, err := parseHostDomain(hc.Domain)
+		if err != nil {
+			logger.Errorf("[dns] %v", err)
+			continue
+		}
+		ips, servers, err := parseHostValue(hc.Value)
+		if err != nil {
+			logger.Errorf("[dns] host %s: %v", hc.Domain, err)
+			continue
+		}
+		host := &dnsHost{domain: hc.Domain, ips: ips}
+		if len(servers) > 0 {
+			if host.nameservers = parseNameservers(servers, self, opts, dialProxy); len(host.nameservers) == 0 {
+				logger.Errorf("[dns] host %s: no valid dns server", hc.Domain)
+				continue
+			}
+		}
+		h.domains.insert(name, len(h.hosts), suffix)
+		h.hosts = append(h.hosts, host)
+	}
+	return h
+}
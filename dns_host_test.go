@@ -0,0 +1,121 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDnsHosts(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: pc, Handler: testDnsHandler("1.0.0.1")})
+	corp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: corp, Handler: testDnsHandler("10.0.0.99")})
+
+	d := newTestDns(nil)
+	d.SetNameservers([]string{pc.LocalAddr().String()})
+	d.SetHosts([]HostConfig{
+		{Domain: "router.lan", Value: "192.168.1.1, fd00::1"},
+		{Domain: "git.corp.example", Value: "10.1.1.1"},
+		{Domain: "*.corp.example", Value: "server:" + corp.LocalAddr().String()},
+		{Domain: "bad domain", Value: "1.1.1.1"},
+		{Domain: "bad.example", Value: "1.2.3"},
+		{Domain: "bad.example", Value: "server:ftp://1.1.1.1"},
+	})
+	assert.Equal(t, []HostConfig{
+		{Domain: "router.lan", Value: "192.168.1.1, fd00::1"},
+		{Domain: "git.corp.example", Value: "10.1.1.1"},
+		{Domain: "*.corp.example", Value: "server:" + corp.LocalAddr().String()},
+	}, d.Hosts())
+
+	self, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: self, Handler: dns.HandlerFunc(d.ServeDNS)})
+
+	query := func(name string, qtype uint16) []string {
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(name), qtype)
+		msg, err := dns.Exchange(r, self.LocalAddr().String())
+		require.NoError(t, err, name)
+		var ips []string
+		for _, rr := range msg.Answer {
+			switch answer := rr.(type) {
+			case *dns.A:
+				ips = append(ips, answer.A.String())
+			case *dns.AAAA:
+				ips = append(ips, answer.AAAA.String())
+			}
+		}
+		return ips
+	}
+	assert.Equal(t, []string{"192.168.1.1"}, query("router.lan", dns.TypeA))
+	assert.Equal(t, []string{"fd00::1"}, query("Router.LAN", dns.TypeAAAA))
+	assert.Equal(t, []string{"10.1.1.1"}, query("git.corp.example", dns.TypeA))
+	assert.Equal(t, []string{"10.0.0.99"}, query("www.corp.example", dns.TypeA))
+	assert.Equal(t, []string{"10.0.0.99"}, query("corp.example", dns.TypeA))
+	assert.Equal(t, []string{"1.0.0.1"}, query("www.example.com", dns.TypeA))
+	assert.Equal(t, []string{"1.0.0.1"}, query("notcorp.example", dns.TypeA))
+
+	// real ip is resolved by dns servers of domain, instead of its proxy
+	ip, err := d.RealIP(&DomainRecord{Hostname: "www.corp.example", Proxy: "Proxy1"})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.99", ip.String())
+}
+
+func TestConfigHosts(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+[Host]
+router.lan = 192.168.1.1
+*.corp.example = server:10.0.0.53, tls://dns.corp.example
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []HostConfig{
+		{Domain: "router.lan", Value: "192.168.1.1", line: 3},
+		{Domain: "*.corp.example", Value: "server:10.0.0.53, tls://dns.corp.example", line: 4},
+	}, cfg.Host)
+
+	_, err = ParseConfig([]byte(`
+[Host]
+a.lan = 192.168.1
+*.b.* = 192.168.1.2
+c.lan = server:
+d.lan = server:ftp://10.0.0.53
+e.lan = server:10.0.0.53 via Proxy1
+`))
+	var errs ConfigErrors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 5)
+	for i, want := range []string{
+		`host a.lan: invalid ip "192.168.1"`,
+		`host: invalid host domain "*.b.*"`,
+		`host c.lan: no dns server`,
+		`host d.lan: invalid dns server "ftp://10.0.0.53"`,
+		`host e.lan: undefined proxy "Proxy1"`,
+	} {
+		assert.Equal(t, i+3, errs[i].Line)
+		assert.Contains(t, errs[i].Msg, want)
+	}
+}
+
+func TestManagerDnsHosts(t *testing.T) {
+	m, ts := newTestManager(t)
+	defer ts.Close()
+
+	m.one.dns.SetHosts([]HostConfig{{Domain: "router.lan", Value: "192.168.1.1"}})
+
+	var b bytes.Buffer
+	require.NoError(t, m.dnsHandle(&b, httptest.NewRequest("GET", "/dns/", nil)))
+	assert.Contains(t, b.String(), "<td>router.lan</td>\n<td>192.168.1.1</td>")
+}
@@ -6,33 +6,73 @@
 package kone
 
 import (
+	"bytes"
+	"encoding/binary"
 	"hash/adler32"
 	"net"
-
-	"github.com/xjdrew/kone/tcpip"
 )
 
 const DnsIPPoolMaxSpace = 0x3ffff // 4*65535
 
+// ip pool in a IPv4 or IPv6 subnet, the pool only spans the lowest 32 bits of address
 type DnsIPPool struct {
-	base  uint32
-	space uint32
-	flags []bool
+	prefix net.IP // IPv6 only: highest 96 bits shared by all ips
+	base   uint32
+	space  uint32
+	flags  []bool
+	used   int
+}
+
+// lowest 32 bits of ip or mask
+func low32(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b[len(b)-4:])
+}
+
+func (pool *DnsIPPool) index(ip net.IP) (uint32, bool) {
+	if pool.prefix == nil {
+		ip = ip.To4()
+		if ip == nil {
+			return 0, false
+		}
+	} else {
+		if ip.To4() != nil {
+			return 0, false
+		}
+		ip = ip.To16()
+		if ip == nil || !bytes.Equal(ip[:12], pool.prefix) {
+			return 0, false
+		}
+	}
+	index := low32(ip) - pool.base
+	return index, index < pool.space
+}
+
+func (pool *DnsIPPool) ip(index uint32) net.IP {
+	if pool.prefix == nil {
+		v := pool.base + index
+		return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	ip := append(net.IP{}, pool.prefix...)
+	return binary.BigEndian.AppendUint32(ip, pool.base+index)
 }
 
 func (pool *DnsIPPool) Capacity() int {
 	return int(pool.space)
 }
 
+func (pool *DnsIPPool) Used() int {
+	return pool.used
+}
+
 func (pool *DnsIPPool) Contains(ip net.IP) bool {
-	index := tcpip.ConvertIPv4ToUint32(ip) - pool.base
-	return index < pool.space
+	_, ok := pool.index(ip)
+	return ok
 }
 
 func (pool *DnsIPPool) Release(ip net.IP) {
-	index := tcpip.ConvertIPv4ToUint32(ip) - pool.base
-	if index < pool.space {
+	if index, ok := pool.index(ip); ok && pool.flags[index] {
 		pool.flags[index] = false
+		pool.used--
 	}
 }
 
@@ -53,29 +93,35 @@ func (pool *DnsIPPool) Alloc(tips string) net.IP {
 		return nil
 	}
 	pool.flags[index] = true
-	return tcpip.ConvertUint32ToIPv4(pool.base + index)
+	pool.used++
+	return pool.ip(index)
 }
 
 func NewDnsIPPool(ip net.IP, subnet *net.IPNet) *DnsIPPool {
-	base := tcpip.ConvertIPv4ToUint32(subnet.IP) + 1
-	max := base + ^tcpip.ConvertIPv4ToUint32(net.IP(subnet.Mask))
+	var prefix net.IP
+	if subnet.IP.To4() == nil {
+		prefix = subnet.IP.To16()[:12]
+	}
+
+	base := low32(subnet.IP) + 1
+	max := base + ^low32(subnet.Mask)
 
 	// space should not over 0x3ffff
 	space := max - base
 	if space > DnsIPPoolMaxSpace {
 		space = DnsIPPoolMaxSpace
 	}
-	flags := make([]bool, space)
 
-	// ip is used by tun
-	index := tcpip.ConvertIPv4ToUint32(ip) - base
-	if index < space {
-		flags[index] = true
+	pool := &DnsIPPool{
+		prefix: prefix,
+		base:   base,
+		space:  space,
+		flags:  make([]bool, space),
 	}
 
-	return &DnsIPPool{
-		base:  base,
-		space: space,
-		flags: flags,
+	// ip is used by tun
+	if index, ok := pool.index(ip); ok {
+		pool.flags[index] = true
 	}
+	return pool
 }
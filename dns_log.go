@@ -0,0 +1,153 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DnsDefaultLogSize = 1000
+
+// decisions of dns query
+const (
+	DnsDecisionHijacked  = "hijacked"  // answered by a fake ip
+	DnsDecisionNonProxy  = "non-proxy" // A or AAAA answered by upstream
+	DnsDecisionForwarded = "forwarded" // other types forwarded to upstream
+	DnsDecisionStatic    = "static"    // answered by static hosts
+	DnsDecisionRejected  = "rejected"  // answered by REJECT or REJECT-DROP rule
+	DnsDecisionFailed    = "failed"
+)
+
+// DnsQuery is a record of dns query
+type DnsQuery struct {
+	Time     time.Time     `json:"time"`
+	Client   string        `json:"client"`
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Decision string        `json:"decision"`
+	Rule     string        `json:"rule,omitempty"`     // matched rule
+	Upstream string        `json:"upstream,omitempty"` // dns server answered, or cache
+	Latency  time.Duration `json:"latency"`
+}
+
+// DnsLog keeps the latest dns queries in memory, and appends them to a file if it's set.
+// Queries in the file are loaded when it's opened, so history survives restarts.
+type DnsLog struct {
+	lock    sync.Mutex
+	queries []DnsQuery // ring buffer
+	next    int        // index to write
+	full    bool
+
+	w *RotateWriter // nil if not persisted
+}
+
+// Add records a query
+func (l *DnsLog) Add(q DnsQuery) {
+	l.lock.Lock()
+	l.add(q)
+	l.lock.Unlock()
+
+	if l.w != nil {
+		b, err := json.Marshal(q)
+		if err != nil {
+			return
+		}
+		if _, err := l.w.Write(append(b, '\n')); err != nil {
+			logger.Warningf("[dns] write query log failed: %v", err)
+		}
+	}
+}
+
+// add to ring buffer, must hold lock
+func (l *DnsLog) add(q DnsQuery) {
+	l.queries[l.next] = q
+	l.next = (l.next + 1) % len(l.queries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Query returns the latest queries first, filtered by prefix of client and substring of domain.
+// At most limit queries are returned, 0 for no limit.
+func (l *DnsLog) Query(client, domain string, limit int) []DnsQuery {
+	domain = strings.ToLower(domain)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.queries)
+	}
+	var queries []DnsQuery
+	for i := 1; i <= n; i++ {
+		q := l.queries[(l.next-i+len(l.queries))%len(l.queries)]
+		if !strings.HasPrefix(q.Client, client) || !strings.Contains(strings.ToLower(q.Name), domain) {
+			continue
+		}
+		queries = append(queries, q)
+		if limit > 0 && len(queries) >= limit {
+			break
+		}
+	}
+	return queries
+}
+
+// Size returns capacity of log
+func (l *DnsLog) Size() int {
+	return len(l.queries)
+}
+
+func (l *DnsLog) Close() error {
+	if l.w != nil {
+		return l.w.Close()
+	}
+	return nil
+}
+
+// load queries from file, broken lines are skipped
+func (l *DnsLog) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var q DnsQuery
+		if json.Unmarshal(scanner.Bytes(), &q) == nil {
+			l.add(q)
+		}
+	}
+	return scanner.Err()
+}
+
+// NewDnsLog keeps size queries in memory. If file isn't empty, queries are appended to it,
+// which is rotated as log file by maxSize and maxBackups.
+func NewDnsLog(size int, file string, maxSize int64, maxBackups int) (*DnsLog, error) {
+	l := &DnsLog{queries: make([]DnsQuery, size)}
+	if file == "" {
+		return l, nil
+	}
+	if err := l.load(file); err != nil {
+		return nil, err
+	}
+	w, err := NewRotateWriter(file, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	l.w = w
+	return l, nil
+}
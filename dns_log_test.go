@@ -0,0 +1,152 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dnsQueryNames(queries []DnsQuery) []string {
+	var names []string
+	for _, q := range queries {
+		names = append(names, q.Name)
+	}
+	return names
+}
+
+func TestDnsLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dns.log")
+	l, err := NewDnsLog(3, file, 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, l.Query("", "", 0))
+
+	now := time.Now().Round(0)
+	for i, q := range []DnsQuery{
+		{Client: "10.0.0.2", Name: "www.google.com"},
+		{Client: "10.0.0.2", Name: "www.example.com"},
+		{Client: "10.0.0.3", Name: "mail.google.com"},
+		{Client: "10.0.0.20", Name: "Docs.Google.com"},
+	} {
+		q.Time = now.Add(time.Duration(i) * time.Second)
+		q.Decision = DnsDecisionNonProxy
+		l.Add(q)
+	}
+
+	// the latest first, and the oldest is dropped
+	assert.Equal(t, []string{"Docs.Google.com", "mail.google.com", "www.example.com"}, dnsQueryNames(l.Query("", "", 0)))
+	assert.Equal(t, []string{"Docs.Google.com"}, dnsQueryNames(l.Query("", "", 1)))
+	assert.Equal(t, []string{"Docs.Google.com", "www.example.com"}, dnsQueryNames(l.Query("10.0.0.2", "", 0)))
+	assert.Equal(t, []string{"Docs.Google.com", "mail.google.com"}, dnsQueryNames(l.Query("", "google", 0)))
+	assert.Equal(t, []string{"www.example.com"}, dnsQueryNames(l.Query("10.0.0.2", "example", 0)))
+	require.NoError(t, l.Close())
+
+	// history is loaded from file, broken lines are skipped
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	f.WriteString("{broken\n")
+	f.Close()
+
+	l, err = NewDnsLog(2, file, 0, 0)
+	require.NoError(t, err)
+	defer l.Close()
+	queries := l.Query("", "", 0)
+	assert.Equal(t, []string{"Docs.Google.com", "mail.google.com"}, dnsQueryNames(queries))
+	assert.True(t, now.Add(3*time.Second).Equal(queries[0].Time))
+	assert.Equal(t, DnsDecisionNonProxy, queries[0].Decision)
+}
+
+func TestDnsQueryLog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: pc, Handler: testDnsHandler("1.0.0.1")})
+	upstream := pc.LocalAddr().String()
+
+	d := newTestDns([]RuleConfig{
+		{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "Proxy1"},
+		{Schema: "DOMAIN-KEYWORD", Pattern: "ads", Proxy: PolicyReject},
+		{Schema: "IP-CIDR", Pattern: "1.0.0.0/24", Proxy: "Proxy2"},
+	})
+	d.SetNameservers([]string{upstream})
+	d.SetHosts([]HostConfig{{Domain: "router.lan", Value: "192.168.1.1"}})
+	d.log, err = NewDnsLog(10, "", 0, 0)
+	require.NoError(t, err)
+
+	self, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: self, Handler: dns.HandlerFunc(d.ServeDNS)})
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"www.google.com", dns.TypeA},
+		{"ads.example.com", dns.TypeA},
+		{"example.com", dns.TypeA},
+		{"www.example.com", dns.TypeA},
+		{"www.example.com", dns.TypeTXT},
+		{"router.lan", dns.TypeA},
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(q.name), q.qtype)
+		_, err := dns.Exchange(r, self.LocalAddr().String())
+		require.NoError(t, err)
+	}
+
+	queries := d.log.Query("", "", 0)
+	require.Len(t, queries, 6)
+	for i := range queries {
+		assert.Equal(t, "127.0.0.1", queries[i].Client)
+		assert.False(t, queries[i].Time.IsZero())
+		queries[i].Client, queries[i].Time, queries[i].Latency = "", time.Time{}, 0
+	}
+	assert.Equal(t, []DnsQuery{
+		{Name: "router.lan", Type: "A", Decision: DnsDecisionStatic},
+		{Name: "www.example.com", Type: "TXT", Decision: DnsDecisionForwarded, Upstream: upstream},
+		{Name: "www.example.com", Type: "A", Decision: DnsDecisionHijacked, Rule: "IP-CIDR,1.0.0.0/24,Proxy2", Upstream: upstream},
+		{Name: "example.com", Type: "A", Decision: DnsDecisionNonProxy, Upstream: upstream},
+		{Name: "ads.example.com", Type: "A", Decision: DnsDecisionRejected, Rule: "DOMAIN-KEYWORD,ads,REJECT"},
+		{Name: "www.google.com", Type: "A", Decision: DnsDecisionHijacked, Rule: "DOMAIN-SUFFIX,google.com,Proxy1"},
+	}, queries)
+}
+
+func TestManagerDnsLog(t *testing.T) {
+	m, ts := newTestManager(t)
+	defer ts.Close()
+
+	var b bytes.Buffer
+	require.NoError(t, m.dnsLogHandle(&b, httptest.NewRequest("GET", "/dns/log/", nil)))
+	assert.Contains(t, b.String(), "Query log is disabled")
+	assert.Equal(t, http.StatusNotFound, apiCall(t, "GET", ts.URL+"/api/v1/dns/log", nil))
+
+	var err error
+	m.one.dns.log, err = NewDnsLog(10, "", 0, 0)
+	require.NoError(t, err)
+	m.one.dns.log.Add(DnsQuery{Time: time.Now(), Client: "10.0.0.2", Name: "www.google.com", Type: "A", Decision: DnsDecisionHijacked})
+	m.one.dns.log.Add(DnsQuery{Time: time.Now(), Client: "10.0.0.3", Name: "www.example.com", Type: "A", Decision: DnsDecisionNonProxy})
+
+	b.Reset()
+	require.NoError(t, m.dnsLogHandle(&b, httptest.NewRequest("GET", "/dns/log/?client=10.0.0.2", nil)))
+	assert.Contains(t, b.String(), "<td><a href=\"/dns/log/?domain=www.google.com\">www.google.com</a></td>")
+	assert.NotContains(t, b.String(), "www.example.com")
+
+	var queries []DnsQuery
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/dns/log?domain=example&limit=5", &queries))
+	assert.Equal(t, []string{"www.example.com"}, dnsQueryNames(queries))
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/dns/log?domain=nothing", &queries))
+	assert.Empty(t, queries)
+	assert.Equal(t, http.StatusBadRequest, apiCall(t, "GET", ts.URL+"/api/v1/dns/log?limit=x", nil))
+}
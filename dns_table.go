@@ -12,21 +12,28 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/miekg/dns/dnsutil"
 )
 
 // hijacked domain
 type DomainRecord struct {
-	Hostname string // hostname
-	Proxy    string // proxy
-
-	IP      net.IP // nat ip
-	RealIP  net.IP // real ip
-	Hits    int
-	Expires time.Time
-
-	answer *dns.A // cache dns answer
+	Hostname  string `json:"hostname"`            // hostname
+	Proxy     string `json:"proxy"`               // proxy
+	Undecided bool   `json:"undecided,omitempty"` // proxy depends on port, network or source, and is decided per connection
+
+	IP      net.IP    `json:"ip"`            // nat ip
+	IP6     net.IP    `json:"ip6,omitempty"` // nat ipv6, nil if IPv6 is disabled
+	RealIP  net.IP    `json:"real_ip"`       // real ip
+	Hits    int       `json:"hits"`
+	Expires time.Time `json:"expires"`
+
+	answer  *dns.A    // cache dns answer
+	answer6 *dns.AAAA // cache dns AAAA answer
+	answers []*Flow   // ips and cnames of the upstream answer which decided proxy, nil if decided by domain
 }
 
+// SetRealIP sets real ip by the first A record of msg, if it's unknown. Lock of the table must be held,
+// for the record is read by api concurrently.
 func (record *DomainRecord) SetRealIP(msg *dns.Msg) {
 	if record.RealIP != nil {
 		return
@@ -42,11 +49,37 @@ func (record *DomainRecord) SetRealIP(msg *dns.Msg) {
 	}
 }
 
+// flows to match of upstream answer: its ips and cnames in order
+func answerFlows(msg *dns.Msg) []*Flow {
+	var flows []*Flow
+	for _, item := range msg.Answer {
+		switch answer := item.(type) {
+		case *dns.A:
+			flows = append(flows, &Flow{DstIP: answer.A})
+		case *dns.AAAA:
+			flows = append(flows, &Flow{DstIP: answer.AAAA})
+		case *dns.CNAME:
+			flows = append(flows, &Flow{Domain: dnsutil.TrimDomainName(answer.Target, ".")})
+		default:
+			logger.Noticef("[dns] unexpected response %s -> %v", item.Header().Name, item)
+		}
+	}
+	return flows
+}
+
+// answer A or AAAA query
 func (record *DomainRecord) Answer(request *dns.Msg) *dns.Msg {
 	rsp := new(dns.Msg)
 	rsp.SetReply(request)
 	rsp.RecursionAvailable = true
-	rsp.Answer = append(rsp.Answer, record.answer)
+	if request.Question[0].Qtype == dns.TypeAAAA {
+		// no AAAA record if IPv6 is disabled, so client falls back to IPv4
+		if record.answer6 != nil {
+			rsp.Answer = append(rsp.Answer, record.answer6)
+		}
+	} else {
+		rsp.Answer = append(rsp.Answer, record.answer)
+	}
 	return rsp
 }
 
@@ -55,20 +88,34 @@ func (record *DomainRecord) Touch() {
 	record.Expires = time.Now().Add(DnsDefaultTtl * time.Second)
 }
 
+// ip released from a record, which is kept out of pool until answers cached by clients expire
+type heldIP struct {
+	ip    net.IP
+	until time.Time
+}
+
 type DnsTable struct {
-	ipNet  *net.IPNet // local network
-	ipPool *DnsIPPool // dns ip pool
+	ipNet   *net.IPNet // local network
+	ipPool  *DnsIPPool // dns ip pool
+	ipNet6  *net.IPNet // local IPv6 network, optional
+	ipPool6 *DnsIPPool // dns IPv6 pool, optional
 
 	// hijacked domain records
 	records     map[string]*DomainRecord // domain -> record
 	ip2Domain   map[string]string        // ip -> domain: map hijacked ip address to domain
-	recordsLock sync.Mutex               // protect records and ip2Domain
+	held        []heldIP                 // released ips still cached by clients
+	recordsLock sync.Mutex               // protect records, ip2Domain, held and ip pools
 
 	nonProxyDomains map[string]time.Time // non proxy domain
 	npdLock         sync.Mutex           // protect non proxy domain
+
+	done chan struct{} // closed to stop Serve
 }
 
 func (c *DnsTable) IsLocalIP(ip net.IP) bool {
+	if c.ipNet6 != nil && c.ipNet6.Contains(ip) {
+		return true
+	}
 	return c.ipNet.Contains(ip)
 }
 
@@ -90,6 +137,9 @@ func (c *DnsTable) GetByIP(ip net.IP) *DomainRecord {
 }
 
 func (c *DnsTable) Contains(ip net.IP) bool {
+	if c.ipPool6 != nil && c.ipPool6.Contains(ip) {
+		return true
+	}
 	return c.ipPool.Contains(ip)
 }
 
@@ -107,7 +157,29 @@ func forgeIPv4Answer(domain string, ip net.IP) *dns.A {
 	return rr
 }
 
+// forge a IPv6 dns reply
+func forgeIPv6Answer(domain string, ip net.IP) *dns.AAAA {
+	rr := new(dns.AAAA)
+	rr.Hdr = dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: DnsDefaultTtl}
+	rr.AAAA = ip.To16()
+	return rr
+}
+
 func (c *DnsTable) Set(domain string, proxy string) *DomainRecord {
+	return c.set(domain, proxy, false, nil, nil)
+}
+
+// SetUndecided hijacks domain whose proxy is decided by relays per connection
+func (c *DnsTable) SetUndecided(domain string, proxy string) *DomainRecord {
+	return c.set(domain, proxy, true, nil, nil)
+}
+
+// SetByAnswer hijacks domain whose proxy is decided by flows of its upstream answer msg
+func (c *DnsTable) SetByAnswer(domain string, proxy string, undecided bool, msg *dns.Msg, flows []*Flow) *DomainRecord {
+	return c.set(domain, proxy, undecided, msg, flows)
+}
+
+func (c *DnsTable) set(domain string, proxy string, undecided bool, msg *dns.Msg, flows []*Flow) *DomainRecord {
 	c.recordsLock.Lock()
 	defer c.recordsLock.Unlock()
 	record := c.records[domain]
@@ -126,12 +198,28 @@ func (c *DnsTable) Set(domain string, proxy string) *DomainRecord {
 	record.IP = ip
 	record.Hostname = domain
 	record.Proxy = proxy
+	record.Undecided = undecided
 	record.answer = forgeIPv4Answer(domain, ip)
+	if msg != nil {
+		record.answers = flows
+		record.SetRealIP(msg)
+	}
 
 	c.records[domain] = record
 	c.ip2Domain[ip.String()] = domain
 	logger.Debugf("[dns] hijack %s -> %s", domain, ip.String())
 
+	if c.ipPool6 != nil {
+		if ip6 := c.ipPool6.Alloc(domain); ip6 != nil {
+			record.IP6 = ip6
+			record.answer6 = forgeIPv6Answer(domain, ip6)
+			c.ip2Domain[ip6.String()] = domain
+			logger.Debugf("[dns] hijack %s -> %s", domain, ip6.String())
+		} else {
+			logger.Warningf("[dns] ipv6 space is used up, domain:%s", domain)
+		}
+	}
+
 	record.Touch()
 	return record
 }
@@ -171,6 +259,120 @@ func (c *DnsTable) ClearNonProxyDomain() {
 	}
 }
 
+// release record's ips, must hold recordsLock. Ips of a record not expired yet may be cached by
+// clients, so they are held until the record expires, instead of being allocated to other domains.
+func (c *DnsTable) release(domain string, record *DomainRecord, now time.Time) {
+	delete(c.records, domain)
+	ips := []net.IP{record.IP}
+	if record.IP6 != nil {
+		ips = append(ips, record.IP6)
+	}
+	for _, ip := range ips {
+		delete(c.ip2Domain, ip.String())
+		if record.Expires.After(now) {
+			c.held = append(c.held, heldIP{ip: ip, until: record.Expires})
+		} else {
+			c.releaseIP(ip)
+		}
+	}
+	logger.Debugf("[dns] release %s -> %s, hit: %d", domain, record.IP.String(), record.Hits)
+}
+
+// return ip to its pool, must hold recordsLock
+func (c *DnsTable) releaseIP(ip net.IP) {
+	if c.ipPool6 != nil && c.ipPool6.Contains(ip) {
+		c.ipPool6.Release(ip)
+	} else {
+		c.ipPool.Release(ip)
+	}
+}
+
+// return held ips to pools once they expire
+func (c *DnsTable) releaseHeld(now time.Time) {
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+
+	held := c.held[:0]
+	for _, h := range c.held {
+		if h.until.After(now) {
+			held = append(held, h)
+		} else {
+			c.releaseIP(h.ip)
+		}
+	}
+	c.held = held
+}
+
+// PoolUsage returns used and capacity of ip pool, zero if the pool is disabled. Held ips are used.
+func (c *DnsTable) PoolUsage(v6 bool) (used int, capacity int) {
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+	pool := c.ipPool
+	if v6 {
+		pool = c.ipPool6
+	}
+	if pool == nil {
+		return 0, 0
+	}
+	return pool.Used(), pool.Capacity()
+}
+
+// RealIP returns real ip of record, nil if unknown
+func (c *DnsTable) RealIP(record *DomainRecord) net.IP {
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+	return record.RealIP
+}
+
+// SetRealIP sets real ip of record by answer msg if it's unknown, and returns the real ip
+func (c *DnsTable) SetRealIP(record *DomainRecord, msg *dns.Msg) net.IP {
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+	record.SetRealIP(msg)
+	return record.RealIP
+}
+
+// Records returns a snapshot of hijacked domain records
+func (c *DnsTable) Records() []DomainRecord {
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+	records := make([]DomainRecord, 0, len(c.records))
+	for _, record := range c.records {
+		records = append(records, *record)
+	}
+	return records
+}
+
+// Clear releases all hijacked domains and non proxy domains, returns the number of released records
+func (c *DnsTable) Clear() int {
+	c.recordsLock.Lock()
+	n := len(c.records)
+	now := time.Now()
+	for domain, record := range c.records {
+		c.release(domain, record, now)
+	}
+	c.recordsLock.Unlock()
+
+	c.ClearNonProxyDomain()
+	return n
+}
+
+// Invalidate releases records matched by f, returns the number of released records
+func (c *DnsTable) Invalidate(f func(record *DomainRecord) bool) int {
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+
+	n := 0
+	now := time.Now()
+	for domain, record := range c.records {
+		if f(record) {
+			c.release(domain, record, now)
+			n += 1
+		}
+	}
+	return n
+}
+
 func (c *DnsTable) clearExpiredDomain(now time.Time) {
 	c.recordsLock.Lock()
 	defer c.recordsLock.Unlock()
@@ -188,29 +390,43 @@ func (c *DnsTable) clearExpiredDomain(now time.Time) {
 		if !record.Expires.Before(now) {
 			continue
 		}
-		delete(c.records, domain)
-		delete(c.ip2Domain, record.IP.String())
-		c.ipPool.Release(record.IP)
-		logger.Debugf("[dns] release %s -> %s, hit: %d", domain, record.IP.String(), record.Hits)
+		c.release(domain, record, now)
 	}
 }
 
 func (c *DnsTable) Serve() error {
 	tick := time.NewTicker(60 * time.Second)
-	for now := range tick.C {
-		c.clearExpiredDomain(now)
-		//TODO: is it necessary?
-		c.clearExpiredNonProxyDomain(now)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			c.clearExpiredDomain(now)
+			c.releaseHeld(now)
+			//TODO: is it necessary?
+			c.clearExpiredNonProxyDomain(now)
+		case <-c.done:
+			return nil
+		}
 	}
+}
+
+func (c *DnsTable) Close() error {
+	close(c.done)
 	return nil
 }
 
-func NewDnsTable(ip net.IP, subnet *net.IPNet) *DnsTable {
+// ip6 & subnet6 are optional
+func NewDnsTable(ip net.IP, subnet *net.IPNet, ip6 net.IP, subnet6 *net.IPNet) *DnsTable {
 	c := new(DnsTable)
 	c.ipNet = subnet
 	c.ipPool = NewDnsIPPool(ip, subnet)
+	if subnet6 != nil {
+		c.ipNet6 = subnet6
+		c.ipPool6 = NewDnsIPPool(ip6, subnet6)
+	}
 	c.records = make(map[string]*DomainRecord)
 	c.ip2Domain = make(map[string]string)
 	c.nonProxyDomains = make(map[string]time.Time)
+	c.done = make(chan struct{})
 	return c
 }
@@ -0,0 +1,117 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDns(rcs []RuleConfig) *Dns {
+	ip, subnet, _ := net.ParseCIDR("10.192.0.1/16")
+	ip6, subnet6, _ := net.ParseCIDR("fd00:6b6f:6e65::1/64")
+	one := &One{
+		ip:       ip.To4(),
+		subnet:   subnet,
+		ip6:      ip6,
+		subnet6:  subnet6,
+		dnsTable: NewDnsTable(ip, subnet, ip6, subnet6),
+	}
+	one.setRouting(NewRule(rcs), nil)
+	one.dns = &Dns{one: one}
+	return one.dns
+}
+
+// replace proxies of one, rule in use is kept
+func setTestProxies(t *testing.T, one *One, proxies map[string]string, groups map[string]string) {
+	rule := one.routing().rule
+	p, err := NewProxies(rule, proxies, groups)
+	require.NoError(t, err)
+	one.setRouting(rule, p)
+}
+
+func TestDnsReject(t *testing.T) {
+	d := newTestDns([]RuleConfig{
+		{Schema: "DOMAIN-KEYWORD", Pattern: "baidu", Proxy: PolicyReject},
+		{Schema: "DOMAIN-SUFFIX", Pattern: "ads.example.com", Proxy: PolicyRejectDrop},
+	})
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.baidu.com.", dns.TypeA)
+	msg, err := d.doIPQuery(r, new(DnsQuery))
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	assert.Empty(t, msg.Answer)
+
+	r = new(dns.Msg)
+	r.SetQuestion("x.ads.example.com.", dns.TypeA)
+	msg, err = d.doIPQuery(r, new(DnsQuery))
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	require.Len(t, msg.Answer, 1)
+	assert.True(t, msg.Answer[0].(*dns.A).A.Equal(net.IPv4zero))
+
+	// rejected domain is never hijacked
+	assert.Nil(t, d.one.dnsTable.Get("www.baidu.com"))
+	assert.Nil(t, d.one.dnsTable.Get("x.ads.example.com"))
+}
+
+func TestDnsHijackIPv6(t *testing.T) {
+	d := newTestDns([]RuleConfig{
+		{Schema: "DOMAIN-SUFFIX", Pattern: "twitter.com", Proxy: "Proxy1"},
+	})
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.twitter.com.", dns.TypeAAAA)
+	msg, err := d.doIPQuery(r, new(DnsQuery))
+	require.NoError(t, err)
+	require.Len(t, msg.Answer, 1)
+	ip6 := msg.Answer[0].(*dns.AAAA).AAAA
+	assert.True(t, d.one.subnet6.Contains(ip6))
+
+	r = new(dns.Msg)
+	r.SetQuestion("www.twitter.com.", dns.TypeA)
+	msg, err = d.doIPQuery(r, new(DnsQuery))
+	require.NoError(t, err)
+	require.Len(t, msg.Answer, 1)
+	ip := msg.Answer[0].(*dns.A).A
+	assert.True(t, d.one.subnet.Contains(ip))
+
+	// both address map to the same record
+	table := d.one.dnsTable
+	assert.True(t, table.Contains(ip6))
+	assert.True(t, table.IsLocalIP(ip6))
+	assert.Equal(t, "www.twitter.com", table.GetByIP(ip6).Hostname)
+	assert.Equal(t, table.GetByIP(ip), table.GetByIP(ip6))
+}
+
+func TestDnsIPPool(t *testing.T) {
+	for _, network := range []string{"10.192.0.1/16", "fd00:6b6f:6e65::1/64", "fd00::1/120"} {
+		ip, subnet, _ := net.ParseCIDR(network)
+		pool := NewDnsIPPool(ip, subnet)
+		assert.True(t, pool.Contains(ip))
+
+		a := pool.Alloc("example.com")
+		require.NotNil(t, a)
+		assert.True(t, subnet.Contains(a), network)
+		assert.True(t, pool.Contains(a), network)
+		assert.False(t, a.Equal(ip), network)
+
+		// stable
+		pool.Release(a)
+		assert.True(t, a.Equal(pool.Alloc("example.com")), network)
+	}
+
+	_, subnet, _ := net.ParseCIDR("fd00::1/120")
+	pool := NewDnsIPPool(net.ParseIP("fd00::1"), subnet)
+	assert.Equal(t, 255, pool.Capacity())
+	assert.False(t, pool.Contains(net.ParseIP("fd01::1")))
+	assert.False(t, pool.Contains(net.ParseIP("10.192.0.2")))
+}
@@ -0,0 +1,321 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DnsDefaultTLSPort  = 853
+	DnsDefaultDialTime = 5 // seconds
+)
+
+// upstream dns server
+type upstream interface {
+	Exchange(r *dns.Msg) (*dns.Msg, time.Duration, error)
+	String() string
+}
+
+// options of upstream clients
+type upstreamOptions struct {
+	packetSize   uint16
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	tlsConfig    *tls.Config // base tls config of DoT and DoH, nil to verify by system roots
+	bootstrap    string      // dns server of ip to resolve hosts of DoT and DoH servers, optional
+}
+
+// dial tcp connection to addr through a proxy
+type proxyDialer func(addr string) (net.Conn, error)
+
+// resolver of hosts of DoT and DoH servers, it queries bootstrap directly to avoid resolving by itself,
+// for system resolver is often kone itself
+func bootstrapResolver(bootstrap string) *net.Resolver {
+	if bootstrap == "" {
+		return nil
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, bootstrap)
+		},
+	}
+}
+
+func (opts *upstreamOptions) tls(serverName string) *tls.Config {
+	var cfg *tls.Config
+	if opts.tlsConfig != nil {
+		cfg = opts.tlsConfig.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+	cfg.ServerName = serverName
+	return cfg
+}
+
+// plain dns, or dns over tls
+type dnsUpstream struct {
+	name   string
+	addr   string
+	client *dns.Client
+	dial   proxyDialer // nil to connect directly
+}
+
+func (u *dnsUpstream) Exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if u.dial == nil {
+		return u.client.Exchange(r, u.addr)
+	}
+
+	conn, err := u.dial(u.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.client.Net == "tcp-tls" {
+		conn = tls.Client(conn, u.client.TLSConfig)
+	}
+	co := &dns.Conn{Conn: conn}
+	defer co.Close()
+	return u.client.ExchangeWithConn(r, co)
+}
+
+func (u *dnsUpstream) String() string {
+	return u.name
+}
+
+// dns over https, RFC 8484
+type dohUpstream struct {
+	name   string // url, and proxy if queried through it
+	url    string
+	client *http.Client
+}
+
+func (u *dohUpstream) Exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// id should be 0 to be cache friendly
+	q := r.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	rsp, err := u.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("doh %s: %s", u.url, rsp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	msg.Id = r.Id
+	return msg, time.Since(start), nil
+}
+
+func (u *dohUpstream) String() string {
+	return u.name
+}
+
+// split host and port of addr, port is def if missing
+func splitHostPort(addr string, def int) (host string, port string) {
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		return h, p
+	}
+	return strings.Trim(addr, "[]"), fmt.Sprint(def)
+}
+
+// newUpstream parses dns server: ip[:port], or url of udp://, tcp://, tls:// and https://.
+// Hosts of tls:// and https:// servers are resolved by resolver if dial is nil, or else by the proxy.
+// Queries through proxy are sent over tcp, for proxies don't support udp well.
+func newUpstream(server string, opts *upstreamOptions, resolver *net.Resolver, proxy string, dial proxyDialer) (upstream, error) {
+	scheme, rest := "", server
+	if i := strings.Index(server, "://"); i >= 0 {
+		scheme, rest = strings.ToLower(server[:i]), server[i+3:]
+	}
+	switch {
+	case scheme == "udp" && dial != nil:
+		return nil, fmt.Errorf("invalid dns server %q: udp is not supported through proxy", server)
+	case scheme == "" && dial != nil:
+		scheme = "tcp"
+	case scheme == "":
+		scheme = "udp"
+	}
+	via := ""
+	if dial != nil {
+		via = " via " + proxy
+	}
+
+	dialer := &net.Dialer{Timeout: DnsDefaultDialTime * time.Second, Resolver: resolver}
+	client := &dns.Client{
+		UDPSize:      opts.packetSize,
+		ReadTimeout:  opts.readTimeout,
+		WriteTimeout: opts.writeTimeout,
+		Dialer:       dialer,
+	}
+
+	switch scheme {
+	case "udp", "tcp":
+		host, port := splitHostPort(rest, DnsDefaultPort)
+		if host == "" {
+			return nil, fmt.Errorf("invalid dns server %q", server)
+		}
+		client.Net = scheme
+		u := &dnsUpstream{addr: net.JoinHostPort(host, port), client: client, dial: dial}
+		u.name = u.addr
+		if scheme == "tcp" {
+			u.name = "tcp://" + u.addr + via
+		}
+		return u, nil
+	case "tls":
+		host, port := splitHostPort(rest, DnsDefaultTLSPort)
+		if host == "" {
+			return nil, fmt.Errorf("invalid dns server %q", server)
+		}
+		client.Net = "tcp-tls"
+		client.TLSConfig = opts.tls(host)
+		addr := net.JoinHostPort(host, port)
+		return &dnsUpstream{name: "tls://" + addr + via, addr: addr, client: client, dial: dial}, nil
+	case "https":
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid dns server %q", server)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		dialContext := dialer.DialContext
+		if dial != nil {
+			dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(addr)
+			}
+		}
+		transport := &http.Transport{
+			DialContext:         dialContext,
+			TLSClientConfig:     opts.tls(u.Hostname()),
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		timeout := opts.readTimeout + opts.writeTimeout
+		if timeout <= 0 {
+			timeout = (DnsDefaultReadTimeout + DnsDefaultWriteTimeout) * time.Second
+		}
+		return &dohUpstream{
+			name:   u.String() + via,
+			url:    u.String(),
+			client: &http.Client{Transport: transport, Timeout: timeout},
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid dns server %q: unsupported scheme %q", server, scheme)
+}
+
+// address of plain dns server of ip, empty if server is not
+func bootstrapAddr(server string) string {
+	if strings.Contains(server, "://") && !strings.HasPrefix(server, "udp://") {
+		return ""
+	}
+	host, port := splitHostPort(strings.TrimPrefix(server, "udp://"), DnsDefaultPort)
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// findBootstrap returns address of bootstrap dns server: bootstrap if set,
+// or else the first plain dns server of ip connected directly, excluding self
+func findBootstrap(servers []string, self string, bootstrap string) string {
+	if bootstrap != "" {
+		return bootstrapAddr(bootstrap)
+	}
+	for _, server := range servers {
+		server, via := parseProxyConfig(server)
+		if via != "" && via != PolicyDirect {
+			continue
+		}
+		if addr := bootstrapAddr(server); addr != "" && addr != self {
+			return addr
+		}
+	}
+	return ""
+}
+
+// needBootstrap tests whether server is DoT or DoH whose host is not an ip
+func needBootstrap(server string) bool {
+	var host string
+	switch i := strings.Index(server, "://"); {
+	case i < 0:
+		return false
+	case strings.EqualFold(server[:i], "tls"):
+		host, _ = splitHostPort(server[i+3:], DnsDefaultTLSPort)
+	case strings.EqualFold(server[:i], "https"):
+		u, err := url.Parse(server)
+		if err != nil {
+			return false
+		}
+		host = u.Hostname()
+	default:
+		return false
+	}
+	return host != "" && net.ParseIP(host) == nil
+}
+
+// parseNameservers parses dns servers and excludes self, invalid servers are skipped.
+// A server is "server" or "server via proxy", dialProxy returns dialer of the proxy.
+// Hosts of DoT and DoH servers are resolved by bootstrap of opts, or the first plain dns server of ip;
+// servers of host need one of them, unless they are queried through proxy.
+func parseNameservers(servers []string, self string, opts *upstreamOptions, dialProxy func(proxy string) proxyDialer) []upstream {
+	bootstrap := findBootstrap(servers, self, opts.bootstrap)
+	resolver := bootstrapResolver(bootstrap)
+
+	var nameservers []upstream
+	for _, server := range servers {
+		server, via := parseProxyConfig(server)
+		var dial proxyDialer
+		if via != "" && via != PolicyDirect {
+			dial = dialProxy(via)
+		}
+		if dial == nil && bootstrap == "" && needBootstrap(server) {
+			logger.Errorf("[dns] dns server %q: no bootstrap dns server to resolve its host", server)
+			continue
+		}
+		u, err := newUpstream(server, opts, resolver, via, dial)
+		if err != nil {
+			logger.Errorf("[dns] %v", err)
+			continue
+		}
+		if u.String() != self { // don't add self
+			nameservers = append(nameservers, u)
+		}
+	}
+	return nameservers
+}
@@ -0,0 +1,297 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dns handler answers A record of ip, and 127.0.0.1 for example.com
+func testDnsHandler(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(testDnsAnswer(r, ip))
+	}
+}
+
+func testDnsAnswer(r *dns.Msg, ip string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	q := r.Question[0]
+	if q.Qtype != dns.TypeA {
+		return msg
+	}
+	if q.Name == "example.com." {
+		ip = "127.0.0.1"
+	}
+	msg.Answer = append(msg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	})
+	return msg
+}
+
+func startTestDnsServer(t *testing.T, server *dns.Server) {
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+}
+
+func TestDnsUpstreams(t *testing.T) {
+	// udp
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: pc, Handler: testDnsHandler("1.0.0.1")})
+	udpAddr := pc.LocalAddr().String()
+
+	// tcp
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{Listener: ln, Handler: testDnsHandler("1.0.0.2")})
+	tcpAddr := ln.Addr().String()
+
+	// doh, its certificate is valid for 127.0.0.1 and example.com
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(body); err != nil || q.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		buf, _ := testDnsAnswer(q, "1.0.0.4").Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(buf)
+	}))
+	defer doh.Close()
+	tlsConfig := doh.Client().Transport.(*http.Transport).TLSClientConfig
+
+	// dot
+	tlsLn, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates})
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{Listener: tlsLn, Net: "tcp-tls", Handler: testDnsHandler("1.0.0.3")})
+	dotAddr := tlsLn.Addr().String()
+	_, dotPort, _ := net.SplitHostPort(dotAddr)
+	_, dohPort, _ := net.SplitHostPort(doh.Listener.Addr().String())
+
+	opts := &upstreamOptions{tlsConfig: tlsConfig}
+	servers := []string{
+		"tcp://" + tcpAddr,
+		"tls://" + dotAddr,
+		doh.URL + "/dns-query",
+		"https://example.com:" + dohPort, // resolved by bootstrap, path is /dns-query by default
+		"tls://example.com:" + dotPort,
+		udpAddr,
+	}
+	nameservers := parseNameservers(servers, "", opts, nil)
+	require.Len(t, nameservers, len(servers))
+	assert.Equal(t, "https://example.com:"+dohPort+"/dns-query", nameservers[3].String())
+
+	for i, want := range []string{"1.0.0.2", "1.0.0.3", "1.0.0.4", "1.0.0.4", "1.0.0.3", "1.0.0.1"} {
+		r := new(dns.Msg)
+		r.SetQuestion("www.google.com.", dns.TypeA)
+		msg, _, err := nameservers[i].Exchange(r)
+		require.NoError(t, err, nameservers[i].String())
+		assert.Equal(t, r.Id, msg.Id)
+		require.Len(t, msg.Answer, 1)
+		assert.Equal(t, want, msg.Answer[0].(*dns.A).A.String(), nameservers[i].String())
+	}
+
+	// an untrusted server is rejected
+	untrusted := parseNameservers([]string{"tls://" + dotAddr}, "", &upstreamOptions{}, nil)
+	r := new(dns.Msg)
+	r.SetQuestion("www.google.com.", dns.TypeA)
+	_, _, err = untrusted[0].Exchange(r)
+	assert.Error(t, err)
+
+	// upstreams race in resolve
+	d := newTestDns(nil)
+	d.upstreamOpts = *opts
+	d.SetNameservers([]string{doh.URL, "tls://" + dotAddr})
+	msg, err := d.Resolve("www.google.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.0.4", msg.Answer[0].(*dns.A).A.String())
+}
+
+func TestDnsThroughProxy(t *testing.T) {
+	// udp and tcp servers on the same port answer differently
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{Listener: ln, Handler: testDnsHandler("1.0.0.2")})
+	addr := ln.Addr().String()
+	pc, err := net.ListenPacket("udp", addr)
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: pc, Handler: testDnsHandler("1.0.0.1")})
+
+	targets := make(chan string, 4)
+	proxy := serveConnect(t, targets)
+	defer proxy.Close()
+
+	d := newTestDns(nil)
+	setTestProxies(t, d.one, map[string]string{"Proxy1": "http://" + proxy.Addr().String()}, nil)
+
+	d.SetNameservers([]string{addr + " via Proxy1", "udp://" + addr + " via Proxy1"})
+	assert.Equal(t, []string{"tcp://" + addr + " via Proxy1"}, d.Nameservers())
+	msg, err := d.Resolve("www.google.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.0.2", msg.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, addr, <-targets)
+
+	// real ip of proxy domain is resolved through the proxy
+	d.SetNameservers([]string{addr})
+	ip, err := d.RealIP(&DomainRecord{Hostname: "www.google.com", Proxy: "Proxy1"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.0.2", ip.String())
+	assert.Equal(t, addr, <-targets)
+
+	ip, err = d.RealIP(&DomainRecord{Hostname: "www.google.com", Proxy: PolicyDirect})
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.0.1", ip.String())
+	assert.Empty(t, targets)
+
+	// doh through proxy
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		q := new(dns.Msg)
+		if r.URL.Path != "/dns-query" || q.Unpack(body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		buf, _ := testDnsAnswer(q, "1.0.0.4").Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(buf)
+	}))
+	defer doh.Close()
+	d.upstreamOpts.tlsConfig = doh.Client().Transport.(*http.Transport).TLSClientConfig
+	d.SetNameservers([]string{doh.URL + " via Proxy1"})
+	assert.Equal(t, []string{doh.URL + "/dns-query via Proxy1"}, d.Nameservers())
+	msg, err = d.Resolve("www.google.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.0.4", msg.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, doh.Listener.Addr().String(), <-targets)
+
+	// no proxies
+	d.one.setRouting(d.one.routing().rule, nil)
+	_, err = d.RealIP(&DomainRecord{Hostname: "www.google.com", Proxy: "Proxy2"})
+	assert.Error(t, err)
+}
+
+func TestParseNameservers(t *testing.T) {
+	nameservers := parseNameservers([]string{
+		"8.8.8.8",
+		"1.1.1.1:5353",
+		"udp://9.9.9.9",
+		"2001:4860:4860::8888",
+		"[2001:4860:4860::8844]:53",
+		"tcp://8.8.4.4",
+		"tls://dns.google",
+		"https://dns.google",
+		"https://cloudflare-dns.com/dns-query",
+		"10.192.0.1:53", // self
+		"ftp://8.8.8.8",
+		"tls://",
+		"https:///dns-query",
+	}, "10.192.0.1:53", &upstreamOptions{}, nil)
+
+	var names []string
+	for _, ns := range nameservers {
+		names = append(names, ns.String())
+	}
+	assert.Equal(t, []string{
+		"8.8.8.8:53",
+		"1.1.1.1:5353",
+		"9.9.9.9:53",
+		"[2001:4860:4860::8888]:53",
+		"[2001:4860:4860::8844]:53",
+		"tcp://8.8.4.4:53",
+		"tls://dns.google:853",
+		"https://dns.google/dns-query",
+		"https://cloudflare-dns.com/dns-query",
+	}, names)
+
+	// hosts of DoT and DoH servers need a bootstrap server, unless they are queried through proxy
+	dialProxy := func(string) proxyDialer { return func(string) (net.Conn, error) { return nil, nil } }
+	servers := []string{"tls://dns.google", "https://1.1.1.1/dns-query", "https://dns.google via Proxy1", "8.8.8.8 via Proxy1"}
+	names = nil
+	for _, ns := range parseNameservers(servers, "", &upstreamOptions{}, dialProxy) {
+		names = append(names, ns.String())
+	}
+	assert.Equal(t, []string{"https://1.1.1.1/dns-query", "https://dns.google/dns-query via Proxy1", "tcp://8.8.8.8:53 via Proxy1"}, names)
+	assert.Len(t, parseNameservers(servers, "", &upstreamOptions{bootstrap: "223.5.5.5"}, dialProxy), 4)
+}
+
+func TestConfigCheckDnsServer(t *testing.T) {
+	_, err := ParseConfig([]byte(`
+[Core]
+dns-server = 8.8.8.8, tls://dns.google, ftp://8.8.8.8
+`))
+	var errs ConfigErrors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 1)
+	assert.Equal(t, 3, errs[0].Line)
+	assert.Contains(t, errs[0].Msg, `unsupported scheme "ftp"`)
+
+	_, err = ParseConfig([]byte(`
+[Core]
+dns-server = 8.8.8.8 via Proxy1, udp://8.8.4.4 via Proxy1, tls://dns.google via Proxy2, 1.1.1.1 via DIRECT
+
+[Proxy]
+Proxy1 = socks5://127.0.0.1:1080
+`))
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Msg, "udp is not supported through proxy")
+	assert.Contains(t, errs[1].Msg, `undefined proxy "Proxy2"`)
+
+	_, err = ParseConfig([]byte(`
+[Core]
+dns-server = tls://dns.google, https://1.1.1.1/dns-query, https://dns.google via Proxy1
+
+[Proxy]
+Proxy1 = socks5://127.0.0.1:1080
+
+[Host]
+example.com = server:https://dns.google
+`))
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	assert.Equal(t, 3, errs[0].Line)
+	assert.Contains(t, errs[0].Msg, `dns-server: host of "tls://dns.google" is not an ip`)
+	assert.Contains(t, errs[1].Msg, `host example.com: host of "https://dns.google" is not an ip`)
+
+	_, err = ParseConfig([]byte(`
+[Core]
+dns-server = tls://dns.google
+dns-bootstrap = 223.5.5.5
+
+[Host]
+example.com = server:https://dns.google
+`))
+	assert.NoError(t, err)
+
+	_, err = ParseConfig([]byte(`
+[Core]
+dns-server = 8.8.8.8
+dns-bootstrap = dns.google
+`))
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 1)
+	assert.Equal(t, 4, errs[0].Line)
+	assert.Contains(t, errs[0].Msg, "dns-bootstrap")
+}
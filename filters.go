@@ -12,16 +12,16 @@ import (
 )
 
 type PacketFilter interface {
-	Filter(wr io.Writer, p tcpip.IPv4Packet)
+	Filter(wr io.Writer, p tcpip.IPPacket)
 }
 
-type PacketFilterFunc func(wr io.Writer, p tcpip.IPv4Packet)
+type PacketFilterFunc func(wr io.Writer, p tcpip.IPPacket)
 
-func (f PacketFilterFunc) Filter(wr io.Writer, p tcpip.IPv4Packet) {
+func (f PacketFilterFunc) Filter(wr io.Writer, p tcpip.IPPacket) {
 	f(wr, p)
 }
 
-func icmpFilterFunc(wr io.Writer, ipPacket tcpip.IPv4Packet) {
+func icmpFilterFunc(wr io.Writer, ipPacket tcpip.IPPacket) {
 	icmpPacket := tcpip.ICMPPacket(ipPacket.Payload())
 	if icmpPacket.Type() == tcpip.ICMPRequest && icmpPacket.Code() == 0 {
 		logger.Debugf("[icmp filter] ping %s > %s", ipPacket.SourceIP(), ipPacket.DestinationIP())
@@ -34,8 +34,26 @@ func icmpFilterFunc(wr io.Writer, ipPacket tcpip.IPv4Packet) {
 
 		icmpPacket.ResetChecksum()
 		ipPacket.ResetChecksum()
-		wr.Write(ipPacket)
+		wr.Write(ipPacket.Bytes())
 	} else {
 		logger.Debugf("icmp: %s -> %s", ipPacket.SourceIP(), ipPacket.DestinationIP())
 	}
 }
+
+func icmpv6FilterFunc(wr io.Writer, ipPacket tcpip.IPPacket) {
+	icmpPacket := tcpip.ICMPPacket(ipPacket.Payload())
+	if icmpPacket.Type() == tcpip.ICMPv6Request && icmpPacket.Code() == 0 {
+		logger.Debugf("[icmpv6 filter] ping %s > %s", ipPacket.SourceIP(), ipPacket.DestinationIP())
+		// forge a reply
+		icmpPacket.SetType(tcpip.ICMPv6Echo)
+		srcIP := ipPacket.SourceIP()
+		dstIP := ipPacket.DestinationIP()
+		ipPacket.SetSourceIP(dstIP)
+		ipPacket.SetDestinationIP(srcIP)
+
+		icmpPacket.ResetChecksumV6(ipPacket.PseudoSum())
+		wr.Write(ipPacket.Bytes())
+	} else {
+		logger.Debugf("icmpv6: %s -> %s type %d", ipPacket.SourceIP(), ipPacket.DestinationIP(), icmpPacket.Type())
+	}
+}
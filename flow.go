@@ -0,0 +1,347 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/xjdrew/kone/tcpip"
+)
+
+// Flow describes a connection to be matched by rules. Fields are zero if unknown: dns query knows
+// only the domain, while relays know all fields but domain of traffic routed by IP-CIDR rules.
+type Flow struct {
+	Network string // tcp or udp
+	SrcIP   net.IP
+	DstIP   net.IP
+	DstPort uint16
+	Domain  string
+}
+
+func (f *Flow) String() string {
+	dst := f.Domain
+	if dst == "" {
+		dst = f.DstIP.String()
+	}
+	if f.DstPort == 0 {
+		return dst
+	}
+	return fmt.Sprintf("%s %s > %s", f.Network, f.SrcIP, net.JoinHostPort(dst, strconv.Itoa(int(f.DstPort))))
+}
+
+// domain of val to match: a domain, or domain of flow
+func domainOf(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case *Flow:
+		return v.Domain, v.Domain != ""
+	}
+	return "", false
+}
+
+// ip of val to match: an ip, or destination ip of flow
+func ipOf(val interface{}) (net.IP, bool) {
+	switch v := val.(type) {
+	case net.IP:
+		return v, true
+	case uint32:
+		return tcpip.ConvertUint32ToIPv4(v), true
+	case *Flow:
+		return v.DstIP, v.DstIP != nil
+	}
+	return nil, false
+}
+
+// flow of val to match: a flow, or a flow to a domain or an ip
+func flowOf(val interface{}) *Flow {
+	if flow, ok := val.(*Flow); ok {
+		return flow
+	}
+	flow := &Flow{}
+	if domain, ok := domainOf(val); ok {
+		flow.Domain = domain
+	} else if ip, ok := ipOf(val); ok {
+		flow.DstIP = ip
+	}
+	return flow
+}
+
+// result of matching a flow: maybe if the pattern depends on unknown fields of flow
+type matchResult int
+
+const (
+	matchNo matchResult = iota
+	matchYes
+	matchMaybe
+)
+
+// flowMatcher is implemented by patterns depend on fields of flow other than domain and destination ip
+type flowMatcher interface {
+	matchFlow(flow *Flow) matchResult
+}
+
+func matchFlow(pattern Pattern, flow *Flow) matchResult {
+	if m, ok := pattern.(flowMatcher); ok {
+		return m.matchFlow(flow)
+	}
+	if pattern.Match(flow) {
+		return matchYes
+	}
+	return matchNo
+}
+
+// a pattern matches a flow unless it's surely not matched
+func matchFlowValue(m flowMatcher, val interface{}) bool {
+	flow, ok := val.(*Flow)
+	return ok && m.matchFlow(flow) != matchNo
+}
+
+// DST-PORT: ports or port ranges separated by '/', such as 80/443/8000-9000
+type DstPortPattern struct {
+	proxy  string
+	ranges [][2]uint16
+}
+
+func (p DstPortPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p DstPortPattern) matchFlow(flow *Flow) matchResult {
+	if flow.DstPort == 0 {
+		return matchMaybe
+	}
+	for _, r := range p.ranges {
+		if flow.DstPort >= r[0] && flow.DstPort <= r[1] {
+			return matchYes
+		}
+	}
+	return matchNo
+}
+
+func (p DstPortPattern) Match(val interface{}) bool {
+	return matchFlowValue(p, val)
+}
+
+func NewDstPortPattern(proxy string, ports string) (Pattern, error) {
+	var ranges [][2]uint16
+	for _, s := range strings.Split(ports, "/") {
+		low, high, isRange := strings.Cut(strings.TrimSpace(s), "-")
+		if !isRange {
+			high = low
+		}
+		start, err1 := strconv.ParseUint(low, 10, 16)
+		end, err2 := strconv.ParseUint(high, 10, 16)
+		if err1 != nil || err2 != nil || start == 0 || start > end {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		ranges = append(ranges, [2]uint16{uint16(start), uint16(end)})
+	}
+	return DstPortPattern{
+		proxy:  proxy,
+		ranges: ranges,
+	}, nil
+}
+
+// SRC-IP-CIDR
+type SrcIPCIDRPattern struct {
+	proxy string
+	ipNet *net.IPNet
+}
+
+func (p SrcIPCIDRPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p SrcIPCIDRPattern) matchFlow(flow *Flow) matchResult {
+	if flow.SrcIP == nil {
+		return matchMaybe
+	}
+	if p.ipNet.Contains(flow.SrcIP) {
+		return matchYes
+	}
+	return matchNo
+}
+
+func (p SrcIPCIDRPattern) Match(val interface{}) bool {
+	return matchFlowValue(p, val)
+}
+
+func NewSrcIPCIDRPattern(proxy string, ipNet *net.IPNet) Pattern {
+	return SrcIPCIDRPattern{
+		proxy: proxy,
+		ipNet: ipNet,
+	}
+}
+
+// NETWORK: tcp or udp
+type NetworkPattern struct {
+	proxy   string
+	network string
+}
+
+func (p NetworkPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p NetworkPattern) matchFlow(flow *Flow) matchResult {
+	if flow.Network == "" {
+		return matchMaybe
+	}
+	if flow.Network == p.network {
+		return matchYes
+	}
+	return matchNo
+}
+
+func (p NetworkPattern) Match(val interface{}) bool {
+	return matchFlowValue(p, val)
+}
+
+func NewNetworkPattern(proxy string, network string) (Pattern, error) {
+	network = strings.ToLower(network)
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("invalid network %q, want: tcp or udp", network)
+	}
+	return NetworkPattern{
+		proxy:   proxy,
+		network: network,
+	}, nil
+}
+
+// AND, OR, NOT: combine rules without proxy, such as AND,((DOMAIN-SUFFIX,google.com),(DST-PORT,443)),Proxy1
+type LogicalPattern struct {
+	proxy    string
+	op       string
+	patterns []Pattern
+}
+
+func (p LogicalPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p LogicalPattern) matchFlow(flow *Flow) matchResult {
+	switch p.op {
+	case "AND":
+		result := matchYes
+		for _, pattern := range p.patterns {
+			switch matchFlow(pattern, flow) {
+			case matchNo:
+				return matchNo
+			case matchMaybe:
+				result = matchMaybe
+			}
+		}
+		return result
+	case "OR":
+		result := matchNo
+		for _, pattern := range p.patterns {
+			switch matchFlow(pattern, flow) {
+			case matchYes:
+				return matchYes
+			case matchMaybe:
+				result = matchMaybe
+			}
+		}
+		return result
+	default: // NOT
+		switch matchFlow(p.patterns[0], flow) {
+		case matchYes:
+			return matchNo
+		case matchNo:
+			return matchYes
+		}
+		return matchMaybe
+	}
+}
+
+func (p LogicalPattern) Match(val interface{}) bool {
+	return matchFlowValue(p, val)
+}
+
+// routes of IP-CIDR sub rules, which should be output to tun. ips excluded by NOT are not routed.
+func (p LogicalPattern) cidrs() []*net.IPNet {
+	if p.op == "NOT" {
+		return nil
+	}
+	var ipNets []*net.IPNet
+	for _, pattern := range p.patterns {
+		switch sub := pattern.(type) {
+		case IPCIDRPattern:
+			ipNets = append(ipNets, sub.ipNet)
+		case LogicalPattern:
+			ipNets = append(ipNets, sub.cidrs()...)
+		}
+	}
+	return ipNets
+}
+
+// split sub rules: ((schema,pattern),(schema,pattern))
+func splitSubRules(expr string) ([]RuleConfig, error) {
+	expr = strings.TrimSpace(expr)
+	if len(expr) < 2 || expr[0] != '(' || expr[len(expr)-1] != ')' {
+		return nil, fmt.Errorf("invalid sub rules %q, want: ((schema,pattern),...)", expr)
+	}
+
+	var rcs []RuleConfig
+	inner := expr[1 : len(expr)-1]
+	depth, start := 0, 0
+	for i, c := range inner {
+		switch {
+		case c == '(':
+			if depth == 0 {
+				start = i + 1
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses in %q", expr)
+			}
+			if depth == 0 {
+				sub := inner[start:i]
+				schema, pattern, _ := strings.Cut(sub, ",")
+				rcs = append(rcs, RuleConfig{Schema: strings.TrimSpace(schema), Pattern: strings.TrimSpace(pattern)})
+			}
+		case depth == 0 && c != ',' && c != ' ':
+			return nil, fmt.Errorf("invalid sub rules %q, want: ((schema,pattern),...)", expr)
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses in %q", expr)
+	}
+	return rcs, nil
+}
+
+func NewLogicalPattern(proxy string, op string, expr string) (Pattern, error) {
+	rcs, err := splitSubRules(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(rcs) == 0 {
+		return nil, fmt.Errorf("%s wants sub rules", op)
+	}
+	if op == "NOT" && len(rcs) != 1 {
+		return nil, fmt.Errorf("NOT wants one sub rule, got %d", len(rcs))
+	}
+
+	p := LogicalPattern{proxy: proxy, op: op}
+	for _, rc := range rcs {
+		switch strings.ToUpper(rc.Schema) {
+		case "FINAL", "RULE-SET", "GEOSITE", "PROCESS-NAME", "UID":
+			return nil, fmt.Errorf("%s is not allowed in %s", rc.Schema, op)
+		}
+		pattern, err := parsePattern(rc)
+		if err != nil {
+			return nil, err
+		}
+		p.patterns = append(p.patterns, pattern)
+	}
+	return p, nil
+}
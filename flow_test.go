@@ -0,0 +1,140 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowPatterns(t *testing.T) {
+	https := &Flow{Network: "tcp", SrcIP: net.ParseIP("10.0.0.2"), DstIP: net.ParseIP("1.2.3.4"), DstPort: 443}
+	quic := &Flow{Network: "udp", SrcIP: net.ParseIP("10.0.1.2"), DstPort: 443, Domain: "www.google.com"}
+	query := &Flow{Domain: "www.google.com"} // flow of dns query
+
+	for _, c := range []struct {
+		schema  string
+		pattern string
+		flow    *Flow
+		result  matchResult
+	}{
+		{"DST-PORT", "443", https, matchYes},
+		{"DST-PORT", "80/8000-9000", https, matchNo},
+		{"DST-PORT", "80/400-500", https, matchYes},
+		{"DST-PORT", "443", query, matchMaybe},
+		{"NETWORK", "UDP", https, matchNo},
+		{"NETWORK", "udp", quic, matchYes},
+		{"NETWORK", "udp", query, matchMaybe},
+		{"SRC-IP-CIDR", "10.0.0.0/24", https, matchYes},
+		{"SRC-IP-CIDR", "10.0.0.0/24", quic, matchNo},
+		{"SRC-IP-CIDR", "10.0.0.0/24", query, matchMaybe},
+
+		{"AND", "((IP-CIDR,1.2.3.0/24),(DST-PORT,443))", https, matchYes},
+		{"AND", "((IP-CIDR,1.2.3.0/24),(DST-PORT,80))", https, matchNo},
+		{"AND", "((DOMAIN-SUFFIX,google.com),(NETWORK,udp))", quic, matchYes},
+		{"AND", "((DOMAIN-SUFFIX,google.com),(NETWORK,udp))", query, matchMaybe},
+		{"AND", "((DOMAIN-SUFFIX,twitter.com),(NETWORK,udp))", query, matchNo},
+		{"OR", "((DST-PORT,80),(NETWORK,udp))", https, matchNo},
+		{"OR", "((DST-PORT,80),(NETWORK,udp))", quic, matchYes},
+		{"OR", "((DOMAIN,www.google.com),(NETWORK,udp))", query, matchYes},
+		{"OR", "((DOMAIN,google.com),(NETWORK,udp))", query, matchMaybe},
+		{"NOT", "((DST-PORT,443))", https, matchNo},
+		{"NOT", "((DST-PORT,22))", https, matchYes},
+		{"NOT", "((DST-PORT,22))", query, matchMaybe},
+		{"NOT", "((OR,((DST-PORT,22),(AND,((NETWORK,udp),(DST-PORT,443))))))", quic, matchNo},
+		{"AND", "( (DOMAIN-REGEX,^www\\.(google|youtube)\\.com$) , (DST-PORT,443) )", quic, matchYes},
+	} {
+		pattern, err := parsePattern(RuleConfig{Schema: c.schema, Pattern: c.pattern, Proxy: "A"})
+		require.NoError(t, err, "%s,%s", c.schema, c.pattern)
+		assert.Equal(t, c.result, matchFlow(pattern, c.flow), "%s,%s %v", c.schema, c.pattern, c.flow)
+		assert.Equal(t, c.result != matchNo, pattern.Match(c.flow), "%s,%s %v", c.schema, c.pattern, c.flow)
+	}
+
+	// patterns of domain and ip match a flow by its domain and destination ip
+	assert.True(t, NewDomainSuffixPattern("A", "google.com").Match(quic))
+	assert.False(t, NewDomainSuffixPattern("A", "google.com").Match(https))
+	_, ipNet, _ := net.ParseCIDR("1.2.3.0/24")
+	assert.True(t, NewIPCIDRPattern("A", ipNet).Match(https))
+	assert.False(t, NewIPCIDRPattern("A", ipNet).Match(quic))
+}
+
+func TestInvalidFlowPatterns(t *testing.T) {
+	for _, rc := range []RuleConfig{
+		{Schema: "DST-PORT", Pattern: "0"},
+		{Schema: "DST-PORT", Pattern: "443-80"},
+		{Schema: "DST-PORT", Pattern: "https"},
+		{Schema: "NETWORK", Pattern: "icmp"},
+		{Schema: "SRC-IP-CIDR", Pattern: "10.0.0.0"},
+		{Schema: "AND", Pattern: "(DOMAIN,google.com)"},
+		{Schema: "AND", Pattern: "((DOMAIN,google.com),(DST-PORT,443)"},
+		{Schema: "AND", Pattern: "((DOMAIN,google.com),DST-PORT,443)"},
+		{Schema: "AND", Pattern: "()"},
+		{Schema: "NOT", Pattern: "((DST-PORT,22),(DST-PORT,23))"},
+		{Schema: "OR", Pattern: "((FINAL,),(DST-PORT,443))"},
+		{Schema: "OR", Pattern: "((DST-PORT,0),(DST-PORT,443))"},
+	} {
+		rc.Proxy = "A"
+		_, err := parsePattern(rc)
+		assert.Error(t, err, "%s,%s", rc.Schema, rc.Pattern)
+	}
+}
+
+func TestRuleMatchFlow(t *testing.T) {
+	d := newTestDns([]RuleConfig{
+		{Schema: "AND", Pattern: "((IP-CIDR,1.2.3.0/24),(DST-PORT,443))", Proxy: "Proxy1"},
+		{Schema: "AND", Pattern: "((DOMAIN-SUFFIX,google.com),(NETWORK,udp))", Proxy: PolicyReject},
+		{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "Proxy2"},
+		{Schema: "AND", Pattern: "((DOMAIN-SUFFIX,example.com),(DST-PORT,22))", Proxy: "Proxy2"},
+		{Schema: "IP-CIDR", Pattern: "93.184.0.0/16", Proxy: "Proxy1"},
+	})
+	one := d.one
+	rule := one.routing().rule
+
+	proxy, exact := rule.Match(&Flow{Domain: "www.google.com"})
+	assert.Equal(t, PolicyReject, proxy)
+	assert.False(t, exact)
+	proxy, exact = rule.Match(&Flow{Domain: "www.twitter.com"})
+	assert.Equal(t, PolicyDirect, proxy)
+	assert.True(t, exact)
+	assert.Equal(t, "Proxy1", rule.Proxy(&Flow{Network: "tcp", DstIP: net.ParseIP("1.2.3.4"), DstPort: 443}))
+	assert.Equal(t, PolicyDirect, rule.Proxy(&Flow{Network: "tcp", DstIP: net.ParseIP("1.2.3.4"), DstPort: 80}))
+
+	// ip of AND rule is routed to tun
+	_, ipNet, _ := net.ParseCIDR("1.2.3.0/24")
+	_, ipNet2, _ := net.ParseCIDR("93.184.0.0/16")
+	assert.Equal(t, []*net.IPNet{ipNet, ipNet2}, one.ruleRoutes(rule))
+
+	// domain depends on connections is hijacked by dns, and decided by relays
+	r := new(dns.Msg)
+	r.SetQuestion("www.google.com.", dns.TypeA)
+	msg, err := d.doIPQuery(r, new(DnsQuery))
+	require.NoError(t, err)
+	require.Len(t, msg.Answer, 1)
+	record := one.dnsTable.GetByIP(msg.Answer[0].(*dns.A).A)
+	require.NotNil(t, record)
+	assert.True(t, record.Undecided)
+
+	tcp := &Flow{Network: "tcp", SrcIP: one.ip, DstPort: 443, Domain: record.Hostname}
+	udp := &Flow{Network: "udp", SrcIP: one.ip, DstPort: 443, Domain: record.Hostname}
+	assert.Equal(t, "Proxy2", one.flowProxy(rule, tcp, record))
+	assert.Equal(t, PolicyReject, one.flowProxy(rule, udp, record))
+
+	// a domain is matched before its real ip
+	record = one.dnsTable.SetUndecided("www.example.com", PolicyDirect)
+	record.RealIP = net.ParseIP("93.184.216.34")
+	ssh := &Flow{Network: "tcp", SrcIP: one.ip, DstPort: 22, Domain: record.Hostname}
+	assert.Equal(t, "Proxy2", one.flowProxy(rule, ssh, record))
+	ssh.DstPort = 2222
+	assert.Equal(t, "Proxy1", one.flowProxy(rule, ssh, record))
+
+	// decided domain is proxied by its record
+	record = one.dnsTable.Set("www.twitter.com", "Proxy1")
+	assert.Equal(t, "Proxy1", one.flowProxy(rule, &Flow{Network: "udp", DstPort: 443, Domain: record.Hostname}, record))
+}
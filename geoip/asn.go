@@ -0,0 +1,78 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ASNDatabase maps ip to autonomous system number
+type ASNDatabase interface {
+	ASN(ip net.IP) uint32
+}
+
+type asnSource struct {
+	db   ASNDatabase
+	path string
+}
+
+// asn database in use, there is no embedded one
+var currentASN atomic.Pointer[asnSource]
+
+// UseASN replaces asn database in use, nil db removes it
+func UseASN(db ASNDatabase, path string) {
+	if db == nil {
+		currentASN.Store(nil)
+		return
+	}
+	currentASN.Store(&asnSource{db: db, path: path})
+}
+
+// LoadASN loads asn database from file, such as GeoLite2-ASN.mmdb, and uses it if succeed.
+// The database in use is kept if failed.
+func LoadASN(path string) error {
+	db, err := Open(path)
+	if err != nil {
+		return err
+	}
+	UseASN(db, path)
+	return nil
+}
+
+// ResetASN removes asn database in use
+func ResetASN() {
+	UseASN(nil, "")
+}
+
+// ASNPath returns file of asn database in use, empty if none
+func ASNPath() string {
+	if s := currentASN.Load(); s != nil {
+		return s.path
+	}
+	return ""
+}
+
+// QueryASN returns autonomous system number of ip, 0 if unknown
+func QueryASN(ip net.IP) uint32 {
+	if s := currentASN.Load(); s != nil {
+		return s.db.ASN(ip)
+	}
+	return 0
+}
+
+// ParseASN parses an asn like 13335 or AS13335
+func ParseASN(s string) (uint32, error) {
+	v := strings.TrimPrefix(strings.ToUpper(s), "AS")
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid asn %q", s)
+	}
+	return uint32(n), nil
+}
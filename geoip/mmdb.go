@@ -0,0 +1,327 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// metadata of mmdb starts after the last marker
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// MMDB is a reader of MaxMind DB, see https://maxmind.github.io/MaxMind-DB/
+type MMDB struct {
+	buf          []byte
+	data         []byte // data section
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint // node of ::/96 in ipv6 tree, which holds ipv4 addresses
+	DatabaseType string
+}
+
+// IsMMDB tests whether buf is a MaxMind DB
+func IsMMDB(buf []byte) bool {
+	return bytes.LastIndex(buf, mmdbMetadataMarker) >= 0
+}
+
+func OpenMMDB(buf []byte) (*MMDB, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: metadata not found")
+	}
+	meta, _, err := (&mmdbDecoder{buf: buf[i+len(mmdbMetadataMarker):]}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: invalid metadata: %v", err)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("mmdb: invalid metadata")
+	}
+
+	db := &MMDB{buf: buf}
+	db.nodeCount = uint(toUint(m["node_count"]))
+	db.recordSize = uint(toUint(m["record_size"]))
+	db.ipVersion = uint(toUint(m["ip_version"]))
+	db.DatabaseType, _ = m["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported ip version %d", db.ipVersion)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("mmdb: invalid search tree size")
+	}
+	db.data = buf[treeSize+16 : i]
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for n := 0; n < 96 && node < db.nodeCount; n++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record of node on bit
+func (db *MMDB) record(node uint, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup returns data of ip, nil if not found
+func (db *MMDB) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node == db.nodeCount { // not found
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("mmdb: invalid search tree")
+	}
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, errors.New("mmdb: invalid data pointer")
+	}
+	v, _, err := (&mmdbDecoder{buf: db.data}).decode(offset, 0)
+	return v, err
+}
+
+// Country returns iso code of country of ip, or registered country if country is unknown
+func (db *MMDB) Country(ip net.IP) string {
+	v, err := db.Lookup(ip)
+	if err != nil {
+		return ""
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if code, ok := Field(v, key, "iso_code").(string); ok {
+			return code
+		}
+	}
+	return ""
+}
+
+// ASN returns autonomous system number of ip, 0 if not found
+func (db *MMDB) ASN(ip net.IP) uint32 {
+	v, err := db.Lookup(ip)
+	if err != nil {
+		return 0
+	}
+	return uint32(toUint(Field(v, "autonomous_system_number")))
+}
+
+// Field returns field of data by path of keys, nil if not found
+func Field(v interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func toUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	}
+	return 0
+}
+
+// limits of decoding a value, so a corrupt database fails instead of exhausting stack or memory
+const (
+	mmdbMaxDepth  = 512     // nesting of maps, arrays and pointers
+	mmdbMaxValues = 1 << 20 // values decoded, pointers may share data many times
+)
+
+// decoder of mmdb data section
+type mmdbDecoder struct {
+	buf    []byte
+	values int // values decoded
+}
+
+var errMMDBData = errors.New("mmdb: invalid data")
+
+func (d *mmdbDecoder) bytes(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buf)) || offset+size < offset {
+		return nil, errMMDBData
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+// bytes after offset
+func (d *mmdbDecoder) remains(offset uint) uint {
+	if offset > uint(len(d.buf)) {
+		return 0
+	}
+	return uint(len(d.buf)) - offset
+}
+
+func (d *mmdbDecoder) uint(offset, size uint) (uint64, error) {
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// decode value at offset in depth of nesting, returns the value and offset of next value
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("mmdb: data nested too deep")
+	}
+	if d.values++; d.values > mmdbMaxValues {
+		return nil, 0, errors.New("mmdb: too many values")
+	}
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == 1 { // pointer
+		ss := uint(ctrl>>3) & 0x3
+		p, err := d.uint(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch ss {
+		case 0, 1, 2:
+			p |= uint64(ctrl&0x7) << (8 * (ss + 1))
+			p += []uint64{0, 2048, 526336}[ss]
+		}
+		// a pointer to a pointer is invalid
+		if b, err := d.bytes(uint(p), 1); err != nil || b[0]>>5 == 1 {
+			return nil, 0, errMMDBData
+		}
+		v, _, err := d.decode(uint(p), depth+1)
+		return v, offset + ss + 1, err
+	}
+
+	if typ == 0 { // extended type
+		t, err := d.uint(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(t)
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		extra, err := d.uint(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		size = []uint{29, 285, 65821}[n-1] + uint(extra)
+	}
+
+	switch typ {
+	case 2: // utf-8 string
+		b, err := d.bytes(offset, size)
+		return string(b), offset + size, err
+	case 3: // double
+		n, err := d.uint(offset, 8)
+		return math.Float64frombits(n), offset + 8, err
+	case 4, 10: // bytes, uint128
+		b, err := d.bytes(offset, size)
+		return b, offset + size, err
+	case 5, 6, 9: // uint16, uint32, uint64
+		if size > 8 {
+			return nil, 0, errMMDBData
+		}
+		n, err := d.uint(offset, size)
+		return n, offset + size, err
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, errMMDBData
+		}
+		n, err := d.uint(offset, size)
+		return int64(int32(uint32(n) << (32 - 8*size) >> (32 - 8*size))), offset + size, err
+	case 7: // map
+		if size > d.remains(offset) { // every entry takes bytes
+			return nil, 0, errMMDBData
+		}
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBData
+			}
+			m[key], offset, err = d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		if size > d.remains(offset) { // every element takes bytes
+			return nil, 0, errMMDBData
+		}
+		a := make([]interface{}, size)
+		for i := range a {
+			a[i], offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	case 15: // float
+		n, err := d.uint(offset, 4)
+		return float64(math.Float32frombits(uint32(n))), offset + 4, err
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type %d", typ)
+}
@@ -0,0 +1,302 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writer of a minimal MaxMind DB: ipv6 tree, 24 bits record
+type testMMDB struct {
+	nodes [][2]int // >= 0: node, -1: empty, < -1: data -2-i
+	data  []byte
+	datas map[string]int // offset of data by its encoding
+}
+
+func encodeMMDBString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func encodeMMDBUint(typ byte, n uint32, size int) []byte {
+	b := []byte{typ<<5 | byte(size)}
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(n>>(8*i)))
+	}
+	return b
+}
+
+// {"country": {"iso_code": country}}
+func encodeMMDBCountry(country string) []byte {
+	b := []byte{7<<5 | 1}
+	b = append(b, encodeMMDBString("country")...)
+	b = append(b, 7<<5|1)
+	b = append(b, encodeMMDBString("iso_code")...)
+	return append(b, encodeMMDBString(country)...)
+}
+
+// {"autonomous_system_number": asn}
+func encodeMMDBASN(asn uint32) []byte {
+	b := []byte{7<<5 | 1}
+	b = append(b, encodeMMDBString("autonomous_system_number")...)
+	return append(b, encodeMMDBUint(6, asn, 4)...)
+}
+
+func (w *testMMDB) insert(cidr string, data []byte) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ip := ipNet.IP.To16()
+	mask, bits := ipNet.Mask.Size()
+	if bits == 32 { // ipv4 in ::/96
+		ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+		mask += 96
+	}
+
+	offset, ok := w.datas[string(data)]
+	if !ok {
+		offset = len(w.data)
+		w.datas[string(data)] = offset
+		w.data = append(w.data, data...)
+	}
+
+	if len(w.nodes) == 0 {
+		w.nodes = append(w.nodes, [2]int{-1, -1})
+	}
+	node := 0
+	for i := 0; i < mask; i++ {
+		bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+		if i == mask-1 {
+			w.nodes[node][bit] = -2 - offset
+			break
+		}
+		next := w.nodes[node][bit]
+		if next < 0 {
+			w.nodes = append(w.nodes, [2]int{-1, -1})
+			next = len(w.nodes) - 1
+			w.nodes[node][bit] = next
+		}
+		node = next
+	}
+}
+
+func (w *testMMDB) bytes() []byte {
+	count := len(w.nodes)
+	var buf []byte
+	for _, node := range w.nodes {
+		for _, r := range node {
+			v := r
+			switch {
+			case r == -1:
+				v = count
+			case r < -1:
+				v = count + 16 + (-2 - r)
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, w.data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	buf = append(buf, 7<<5|4)
+	buf = append(buf, encodeMMDBString("node_count")...)
+	buf = append(buf, encodeMMDBUint(6, uint32(count), 4)...)
+	buf = append(buf, encodeMMDBString("record_size")...)
+	buf = append(buf, encodeMMDBUint(5, 24, 2)...)
+	buf = append(buf, encodeMMDBString("ip_version")...)
+	buf = append(buf, encodeMMDBUint(5, 6, 2)...)
+	buf = append(buf, encodeMMDBString("database_type")...)
+	buf = append(buf, encodeMMDBString("Test-Country")...)
+	return buf
+}
+
+func newTestMMDB(nets map[string]string) []byte {
+	w := &testMMDB{datas: map[string]int{}}
+	for cidr, country := range nets {
+		w.insert(cidr, encodeMMDBCountry(country))
+	}
+	return w.bytes()
+}
+
+func newTestASNMMDB(nets map[string]uint32) []byte {
+	w := &testMMDB{datas: map[string]int{}}
+	for cidr, asn := range nets {
+		w.insert(cidr, encodeMMDBASN(asn))
+	}
+	return w.bytes()
+}
+
+var mmdbCases = map[string]string{
+	"1.2.3.4":        "AU",
+	"1.2.4.4":        "",
+	"8.8.8.8":        "US",
+	"2001:db8::1":    "JP",
+	"2001:db8:1::1":  "JP",
+	"2001:db9::1":    "",
+	"::ffff:8.8.4.4": "US",
+}
+
+func TestMMDB(t *testing.T) {
+	buf := newTestMMDB(map[string]string{
+		"1.2.3.0/24":    "AU",
+		"8.8.0.0/16":    "US",
+		"2001:db8::/32": "JP",
+	})
+	if !IsMMDB(buf) {
+		t.Fatal("not a mmdb")
+	}
+	db, err := OpenMMDB(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.DatabaseType != "Test-Country" {
+		t.Errorf("database type: %q", db.DatabaseType)
+	}
+	for ip, country := range mmdbCases {
+		if result := db.Country(net.ParseIP(ip)); country != result {
+			t.Errorf("failed on: %s:%s ! %s", ip, country, result)
+		}
+	}
+
+	if _, err := OpenMMDB(buf[:len(buf)-10]); err == nil {
+		t.Error("open truncated mmdb succeed")
+	}
+}
+
+func TestMMDBMalformed(t *testing.T) {
+	var nested []byte
+	for i := 0; i < 1000; i++ {
+		nested = append(nested, 0<<5|1, 11-7) // array of 1 element
+	}
+	for name, data := range map[string][]byte{
+		"pointer to itself":  {1 << 5, 0},
+		"pointer loop":       append(append([]byte{7<<5 | 1}, encodeMMDBString("a")...), 1<<5, 0),
+		"nested too deep":    append(nested, encodeMMDBString("a")...),
+		"huge array":         {0<<5 | 31, 11 - 7, 0xff, 0xff, 0xff},
+		"huge map":           {7<<5 | 31, 0xff, 0xff, 0xff},
+		"truncated map":      append([]byte{7<<5 | 2}, encodeMMDBString("a")...),
+		"pointer out of buf": {1<<5 | 7, 0xff},
+	} {
+		buf := append(append([]byte{}, mmdbMetadataMarker...), data...)
+		if _, err := OpenMMDB(buf); err == nil {
+			t.Errorf("open mmdb of %s succeed", name)
+		}
+	}
+}
+
+func TestTable(t *testing.T) {
+	table, err := ParseTable([]byte(`
+# start,end,country
+16909056,16909311,AU
+8.8.0.0, 8.8.255.255, us
+2001:db8::, 2001:db8:ffff:ffff:ffff:ffff:ffff:ffff, JP
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, country := range mmdbCases {
+		if result := table.Country(net.ParseIP(ip)); country != result {
+			t.Errorf("failed on: %s:%s ! %s", ip, country, result)
+		}
+	}
+
+	for _, invalid := range []string{
+		"1.2.3.0,AU",
+		"1.2.3.255,1.2.3.0,AU",
+		"1.2.3.0,example.com,AU",
+		"1.2.3.0,1.2.3.255,AU\n1.2.3.128,1.2.4.0,US",
+	} {
+		if _, err := ParseTable([]byte(invalid)); err == nil {
+			t.Errorf("parse %q succeed", invalid)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	defer Reset()
+	dir := t.TempDir()
+	mmdb := filepath.Join(dir, "country.mmdb")
+	table := filepath.Join(dir, "country.txt")
+	os.WriteFile(mmdb, newTestMMDB(map[string]string{"8.8.0.0/16": "JP", "2001:db8::/32": "JP"}), 0644)
+	os.WriteFile(table, []byte("8.8.0.0,8.8.255.255,AU\n"), 0644)
+
+	if err := Load(filepath.Join(dir, "missing.mmdb")); err == nil {
+		t.Error("load missing database succeed")
+	}
+	if Path() != "" || QueryCountryByString("8.8.8.8") != "US" {
+		t.Error("embedded table is not used")
+	}
+	if QueryCountryByString("2001:db8::1") != "" {
+		t.Error("embedded table has IPv6 data")
+	}
+
+	if err := Load(mmdb); err != nil {
+		t.Fatal(err)
+	}
+	if Path() != mmdb || QueryCountryByString("8.8.8.8") != "JP" || QueryCountry(0x08080808) != "JP" {
+		t.Error("mmdb is not used")
+	}
+	if QueryCountryByString("2001:db8::1") != "JP" {
+		t.Error("IPv6 of mmdb is not found")
+	}
+
+	// database in use is kept if load failed
+	os.WriteFile(table, []byte("invalid"), 0644)
+	if err := Load(table); err == nil {
+		t.Error("load invalid table succeed")
+	}
+	if Path() != mmdb {
+		t.Error("mmdb is not kept")
+	}
+
+	os.WriteFile(table, []byte("8.8.0.0,8.8.255.255,AU\n"), 0644)
+	if err := Load(table); err != nil {
+		t.Fatal(err)
+	}
+	if QueryCountryByString("8.8.8.8") != "AU" {
+		t.Error("table is not used")
+	}
+
+	Reset()
+	if QueryCountryByString("8.8.8.8") != "US" {
+		t.Error("embedded table is not restored")
+	}
+}
+
+func TestASN(t *testing.T) {
+	defer ResetASN()
+	dir := t.TempDir()
+	mmdb := filepath.Join(dir, "asn.mmdb")
+	table := filepath.Join(dir, "asn.txt")
+	os.WriteFile(mmdb, newTestASNMMDB(map[string]uint32{"1.1.1.0/24": 13335, "2606:4700::/32": 13335}), 0644)
+	os.WriteFile(table, []byte("8.8.8.0,8.8.8.255,AS15169\n"), 0644)
+
+	if QueryASN(net.ParseIP("1.1.1.1")) != 0 || ASNPath() != "" {
+		t.Error("asn without database")
+	}
+	if err := LoadASN(mmdb); err != nil {
+		t.Fatal(err)
+	}
+	for ip, asn := range map[string]uint32{"1.1.1.1": 13335, "2606:4700::1111": 13335, "8.8.8.8": 0} {
+		if result := QueryASN(net.ParseIP(ip)); asn != result {
+			t.Errorf("failed on: %s:%d ! %d", ip, asn, result)
+		}
+	}
+
+	if err := LoadASN(table); err != nil {
+		t.Fatal(err)
+	}
+	if ASNPath() != table || QueryASN(net.ParseIP("8.8.8.8")) != 15169 {
+		t.Error("asn table is not used")
+	}
+
+	for _, invalid := range []string{"", "AS", "ASN1", "0", "-1", "4294967296"} {
+		if _, err := ParseASN(invalid); err == nil {
+			t.Errorf("parse asn %q succeed", invalid)
+		}
+	}
+	if n, err := ParseASN("as13335"); err != nil || n != 13335 {
+		t.Errorf("parse asn: %d, %v", n, err)
+	}
+}
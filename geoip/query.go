@@ -8,13 +8,60 @@ package geoip
 import (
 	"net"
 	"sort"
+	"sync/atomic"
 )
 
 var (
 	geoIPLen = len(geoIP)
 )
 
-func QueryCountry(ip uint32) string {
+// Database maps ip to iso code of country
+type Database interface {
+	Country(ip net.IP) string
+}
+
+type source struct {
+	db   Database // nil for the embedded table
+	path string
+}
+
+// database in use
+var current atomic.Pointer[source]
+
+// Use replaces database in use, nil db restores the embedded table
+func Use(db Database, path string) {
+	if db == nil {
+		current.Store(nil)
+		return
+	}
+	current.Store(&source{db: db, path: path})
+}
+
+// Load loads database from file, and uses it if succeed.
+// The database in use is kept if failed.
+func Load(path string) error {
+	db, err := Open(path)
+	if err != nil {
+		return err
+	}
+	Use(db, path)
+	return nil
+}
+
+// Reset restores the embedded table
+func Reset() {
+	Use(nil, "")
+}
+
+// Path returns file of database in use, empty for the embedded table
+func Path() string {
+	if s := current.Load(); s != nil {
+		return s.path
+	}
+	return ""
+}
+
+func queryEmbedded(ip uint32) string {
 	i := sort.Search(geoIPLen, func(i int) bool {
 		n := geoIP[i]
 		return n.End >= ip
@@ -30,7 +77,19 @@ func QueryCountry(ip uint32) string {
 	return country
 }
 
+func QueryCountry(ip uint32) string {
+	if s := current.Load(); s != nil {
+		return s.db.Country(net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)))
+	}
+	return queryEmbedded(ip)
+}
+
+// QueryCountryByIP supports IPv6 if database in use has IPv6 data, the embedded table hasn't
 func QueryCountryByIP(ip net.IP) string {
+	if s := current.Load(); s != nil {
+		return s.db.Country(ip)
+	}
+
 	ip = ip.To4()
 	if ip == nil {
 		return ""
@@ -40,7 +99,7 @@ func QueryCountryByIP(ip net.IP) string {
 	v += uint32(ip[1]) << 16
 	v += uint32(ip[2]) << 8
 	v += uint32(ip[3])
-	return QueryCountry(v)
+	return queryEmbedded(v)
 }
 
 func QueryCountryByString(v string) string {
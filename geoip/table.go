@@ -0,0 +1,114 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package geoip
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ipRange struct {
+	start, end net.IP // 16 bytes
+	value      string // country or asn
+}
+
+// Table is a database of sorted ip ranges, the format of the embedded table
+type Table []ipRange
+
+func (t Table) lookup(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	i := sort.Search(len(t), func(i int) bool {
+		return bytes.Compare(t[i].end, ip) >= 0
+	})
+	if i < len(t) && bytes.Compare(t[i].start, ip) <= 0 {
+		return t[i].value
+	}
+	return ""
+}
+
+func (t Table) Country(ip net.IP) string {
+	return t.lookup(ip)
+}
+
+// ASN returns 0 if ip is not found
+func (t Table) ASN(ip net.IP) uint32 {
+	n, _ := ParseASN(t.lookup(ip))
+	return n
+}
+
+// ip of table is an uint32 like the embedded table, or an IPv4 or IPv6 address
+func parseTableIP(s string) net.IP {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return net.ParseIP(s).To16()
+}
+
+// ParseTable parses lines of `start,end,country` or `start,end,asn`, empty lines and lines
+// start with # are ignored. Ranges must not overlap.
+func ParseTable(buf []byte) (Table, error) {
+	var t Table
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: invalid range %q", n, line)
+		}
+		r := ipRange{
+			start: parseTableIP(strings.TrimSpace(fields[0])),
+			end:   parseTableIP(strings.TrimSpace(fields[1])),
+			value: strings.ToUpper(strings.TrimSpace(fields[2])),
+		}
+		if r.start == nil || r.end == nil || bytes.Compare(r.start, r.end) > 0 {
+			return nil, fmt.Errorf("line %d: invalid range %q", n, line)
+		}
+		t = append(t, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(t, func(i, j int) bool {
+		return bytes.Compare(t[i].start, t[j].start) < 0
+	})
+	for i := 1; i < len(t); i++ {
+		if bytes.Compare(t[i-1].end, t[i].start) >= 0 {
+			return nil, fmt.Errorf("range %s-%s overlaps %s-%s", t[i-1].start, t[i-1].end, t[i].start, t[i].end)
+		}
+	}
+	return t, nil
+}
+
+// FileDatabase is a database from file, it answers both country and asn
+type FileDatabase interface {
+	Database
+	ASNDatabase
+}
+
+// Open opens a MaxMind DB or a table file
+func Open(path string) (FileDatabase, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if IsMMDB(buf) {
+		return OpenMMDB(buf)
+	}
+	return ParseTable(buf)
+}
@@ -0,0 +1,249 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// entry of v2ray domain list
+type geoSiteEntry struct {
+	kind  string // domain, full, keyword or regexp
+	value string
+	attrs []string
+}
+
+func (e geoSiteEntry) hasAttrs(attrs []string) bool {
+	for _, attr := range attrs {
+		found := false
+		for _, a := range e.attrs {
+			if a == attr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// GeoSite reads v2ray domain lists from a dir, such as data of v2fly/domain-list-community.
+// Each file is a category named by the file, lines of a file are:
+//
+//	google.com              # google.com and its sub domains, same as domain:google.com
+//	full:www.google.com     # www.google.com only
+//	keyword:google          # domains contain google
+//	regexp:^ads?\.          # domains match the regular expression
+//	include:google-ads      # entries of category google-ads
+//	domain:doubleclick.net @ads
+//
+// Entries can be selected by attributes, for example category google@ads has entries of google with attribute @ads.
+type GeoSite struct {
+	dir   string
+	lists map[string][]geoSiteEntry // parsed categories
+}
+
+var geoSiteCategoryRegexp = regexp.MustCompile(`^[a-z0-9!._-]+$`)
+
+// parse category with optional attributes: name@attr1@attr2
+func parseGeoSiteCategory(category string) (name string, attrs []string, err error) {
+	parts := strings.Split(strings.ToLower(category), "@")
+	name, attrs = parts[0], parts[1:]
+	if !geoSiteCategoryRegexp.MatchString(name) || strings.HasPrefix(name, ".") {
+		return "", nil, fmt.Errorf("invalid geosite category %q", category)
+	}
+	for _, attr := range attrs {
+		if attr == "" {
+			return "", nil, fmt.Errorf("invalid geosite category %q", category)
+		}
+	}
+	return name, attrs, nil
+}
+
+// entries of category, attributes of category select entries
+func (g *GeoSite) Entries(category string) ([]geoSiteEntry, error) {
+	name, attrs, err := parseGeoSiteCategory(category)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := g.load(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) == 0 {
+		return entries, nil
+	}
+	var selected []geoSiteEntry
+	for _, e := range entries {
+		if e.hasAttrs(attrs) {
+			selected = append(selected, e)
+		}
+	}
+	return selected, nil
+}
+
+// load category and its includes, loading are categories being loaded to detect include cycles
+func (g *GeoSite) load(name string, loading []string) ([]geoSiteEntry, error) {
+	if entries, ok := g.lists[name]; ok {
+		return entries, nil
+	}
+	for _, n := range loading {
+		if n == name {
+			return nil, fmt.Errorf("geosite %s: include cycle %s", name, strings.Join(append(loading, name), " > "))
+		}
+	}
+	loading = append(loading, name)
+
+	data, err := os.ReadFile(filepath.Join(g.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("geosite %s: %v", name, err)
+	}
+
+	var entries []geoSiteEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for no := 1; scanner.Scan(); no++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		e := geoSiteEntry{kind: "domain", value: fields[0]}
+		if i := strings.IndexByte(fields[0], ':'); i >= 0 {
+			e.kind, e.value = fields[0][:i], fields[0][i+1:]
+		}
+		for _, attr := range fields[1:] {
+			if !strings.HasPrefix(attr, "@") || len(attr) == 1 {
+				return nil, fmt.Errorf("geosite %s line %d: invalid attribute %q", name, no, attr)
+			}
+			e.attrs = append(e.attrs, strings.ToLower(attr[1:]))
+		}
+		if e.value == "" {
+			return nil, fmt.Errorf("geosite %s line %d: invalid entry %q", name, no, fields[0])
+		}
+
+		switch e.kind {
+		case "domain", "full", "keyword":
+			e.value = strings.ToLower(e.value)
+		case "regexp":
+		case "include": // attributes of include select entries of included category
+			sub, err := g.load(strings.ToLower(e.value), loading)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range sub {
+				if s.hasAttrs(e.attrs) {
+					entries = append(entries, s)
+				}
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("geosite %s line %d: unknown type %q", name, no, e.kind)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("geosite %s: %v", name, err)
+	}
+	g.lists[name] = entries
+	return entries, nil
+}
+
+func NewGeoSite(dir string) *GeoSite {
+	return &GeoSite{
+		dir:   dir,
+		lists: make(map[string][]geoSiteEntry),
+	}
+}
+
+// GEOSITE
+type GeoSitePattern struct {
+	proxy    string
+	category string
+	full     []string
+	suffixes []string
+	others   []Pattern // keyword and regexp entries
+	domains  *domainTrie
+}
+
+func (p *GeoSitePattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *GeoSitePattern) Match(val interface{}) bool {
+	v, ok := domainOf(val)
+	if !ok {
+		return false
+	}
+	if p.domains.lookup(strings.ToLower(v)) >= 0 {
+		return true
+	}
+	for _, pattern := range p.others {
+		if pattern.Match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Size returns number of domains of category
+func (p *GeoSitePattern) Size() int {
+	return len(p.full) + len(p.suffixes) + len(p.others)
+}
+
+// load domains of category from g, pattern matches nothing until it's loaded
+func (p *GeoSitePattern) load(g *GeoSite) error {
+	entries, err := g.Entries(p.category)
+	if err != nil {
+		return err
+	}
+
+	var full, suffixes []string
+	var others []Pattern
+	domains := newDomainTrie()
+	for _, e := range entries {
+		switch e.kind {
+		case "full":
+			full = append(full, e.value)
+			domains.insert(e.value, 0, false)
+		case "domain":
+			suffixes = append(suffixes, e.value)
+			domains.insert(e.value, 0, true)
+		case "keyword":
+			others = append(others, NewDomainKeywordPattern(p.proxy, e.value))
+		case "regexp":
+			pattern, err := NewDomainRegexPattern(p.proxy, e.value)
+			if err != nil {
+				return fmt.Errorf("geosite %s: %v", p.category, err)
+			}
+			others = append(others, pattern)
+		}
+	}
+	p.full, p.suffixes, p.others, p.domains = full, suffixes, others, domains
+	return nil
+}
+
+func NewGeoSitePattern(proxy string, category string) (*GeoSitePattern, error) {
+	if _, _, err := parseGeoSiteCategory(category); err != nil {
+		return nil, err
+	}
+	return &GeoSitePattern{
+		proxy:    proxy,
+		category: strings.ToLower(category),
+		domains:  newDomainTrie(),
+	}, nil
+}
@@ -0,0 +1,187 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xjdrew/kone/geoip"
+)
+
+func writeTestGeoSite(t *testing.T) string {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"google": `# google services
+include:google-ads
+google.com
+full:www.google.cn @cn
+keyword:googleapis # keyword
+regexp:^gstatic[0-9]?\.com$
+`,
+		"google-ads": `doubleclick.net @ads
+domain:googleadservices.com @ads
+`,
+		"loop-a":    "include:loop-b\n",
+		"loop-b":    "include:loop-a\n",
+		"bad-type":  "ip:1.2.3.4\n",
+		"bad-regex": "regexp:(\n",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+	return dir
+}
+
+func TestGeoSite(t *testing.T) {
+	g := NewGeoSite(writeTestGeoSite(t))
+
+	entries, err := g.Entries("google")
+	require.NoError(t, err)
+	assert.Len(t, entries, 6)
+	assert.Equal(t, geoSiteEntry{kind: "domain", value: "doubleclick.net", attrs: []string{"ads"}}, entries[0])
+
+	entries, err = g.Entries("Google@ads")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	entries, err = g.Entries("google@cn")
+	require.NoError(t, err)
+	assert.Equal(t, []geoSiteEntry{{kind: "full", value: "www.google.cn", attrs: []string{"cn"}}}, entries)
+
+	for _, category := range []string{"loop-a", "bad-type", "missing", "../google", "google@", ""} {
+		_, err := g.Entries(category)
+		assert.Error(t, err, category)
+	}
+
+	p, err := NewGeoSitePattern("A", "google")
+	require.NoError(t, err)
+	assert.False(t, p.Match("www.google.com")) // not loaded
+	require.NoError(t, p.load(g))
+	assert.Equal(t, 6, p.Size())
+	for domain, matched := range map[string]bool{
+		"google.com":                  true,
+		"www.google.com":              true,
+		"notgoogle.com":               false,
+		"www.google.cn":               true,
+		"google.cn":                   false,
+		"ad.doubleclick.net":          true,
+		"fonts.googleapis.cn":         true,
+		"gstatic1.com":                true,
+		"www.gstatic.com":             false,
+		"www.googleadservices.com.hk": false,
+	} {
+		assert.Equal(t, matched, p.Match(domain), domain)
+		assert.Equal(t, matched, p.Match(&Flow{Domain: domain}), domain)
+	}
+	assert.False(t, p.Match(net.ParseIP("8.8.8.8")))
+
+	bad, err := NewGeoSitePattern("A", "bad-regex")
+	require.NoError(t, err)
+	assert.Error(t, bad.load(g))
+}
+
+func TestGeoSiteRules(t *testing.T) {
+	dir := writeTestGeoSite(t)
+	cfg := &KoneConfig{
+		source:  filepath.Join(dir, "kone.ini"),
+		General: GeneralConfig{GeoSiteDir: "."},
+	}
+
+	rule := NewRule([]RuleConfig{
+		{Schema: "GEOSITE", Pattern: "google@ads", Proxy: PolicyReject},
+		{Schema: "DOMAIN-SUFFIX", Pattern: "googleapis.com", Proxy: "Proxy2"},
+		{Schema: "GEOSITE", Pattern: "google", Proxy: "Proxy1"},
+		{Schema: "GEOSITE", Pattern: "missing", Proxy: "Proxy2"},
+		{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "Proxy2"},
+	})
+	rule.LoadGeoSites(cfg)
+	assert.Equal(t, PolicyReject, rule.Proxy("ad.doubleclick.net"))
+	assert.Equal(t, "Proxy1", rule.Proxy("www.google.com"))
+	assert.Equal(t, "Proxy2", rule.Proxy("fonts.googleapis.com"))
+	assert.Equal(t, "Proxy1", rule.Proxy("fonts.googleapis.cn"))
+	assert.Equal(t, "Proxy1", rule.Proxy("gstatic.com"))
+	assert.Equal(t, PolicyDirect, rule.Proxy("www.example.com"))
+
+	// GEOSITE is not allowed in logical rules and rule sets
+	_, err := parsePattern(RuleConfig{Schema: "AND", Pattern: "((GEOSITE,google),(DST-PORT,443))", Proxy: "Proxy1"})
+	assert.Error(t, err)
+	patterns, skipped := parseRuleSet([]byte("GEOSITE,google\nDOMAIN,www.google.com\n"), "Proxy1")
+	assert.Len(t, patterns, 1)
+	assert.Equal(t, 1, skipped)
+
+	// config check
+	_, err = ParseConfig([]byte(`
+[Rule]
+GEOSITE, google, DIRECT
+IP-ASN, AS13335, DIRECT
+IP-ASN, ASX, DIRECT
+`))
+	var errs ConfigErrors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 3)
+	assert.Contains(t, errs[0].Msg, "geosite-dir is not set")
+	assert.Contains(t, errs[1].Msg, "asn-database is not set")
+	assert.Contains(t, errs[2].Msg, `invalid asn "ASX"`)
+
+	file := filepath.Join(dir, "kone.ini")
+	require.NoError(t, os.WriteFile(file, []byte(`
+[General]
+geosite-dir = .
+[Rule]
+GEOSITE, google, DIRECT
+GEOSITE, missing, DIRECT
+`), 0644))
+	_, err = ParseConfig(file)
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 1)
+	assert.Equal(t, 6, errs[0].Line)
+}
+
+func TestIPASNRules(t *testing.T) {
+	defer geoip.ResetASN()
+	file := filepath.Join(t.TempDir(), "asn.txt")
+	require.NoError(t, os.WriteFile(file, []byte("1.1.1.0,1.1.1.255,13335\n2606:4700::,2606:4700::ffff,13335\n8.8.8.0,8.8.8.255,15169\n"), 0644))
+
+	rule := NewRule([]RuleConfig{
+		{Schema: "IP-ASN", Pattern: "15169", Proxy: "Proxy2"},
+		{Schema: "IP-CIDR", Pattern: "1.1.1.1/32", Proxy: "Proxy2"},
+		{Schema: "IP-ASN", Pattern: "AS13335", Proxy: "Proxy1"},
+	})
+	assert.Equal(t, PolicyDirect, rule.Proxy(net.ParseIP("1.1.1.2"))) // no asn database
+
+	require.NoError(t, geoip.LoadASN(file))
+	assert.Equal(t, "Proxy2", rule.Proxy(net.ParseIP("1.1.1.1")))
+	assert.Equal(t, "Proxy1", rule.Proxy(net.ParseIP("1.1.1.2")))
+	assert.Equal(t, "Proxy1", rule.Proxy(net.ParseIP("2606:4700::1111")))
+	assert.Equal(t, "Proxy2", rule.Proxy(&Flow{Network: "tcp", DstIP: net.ParseIP("8.8.8.8"), DstPort: 443}))
+	assert.Equal(t, PolicyDirect, rule.Proxy(net.ParseIP("9.9.9.9")))
+	assert.Equal(t, PolicyDirect, rule.Proxy("one.one.one.one"))
+
+	pattern, err := NewIPASNPattern("A", "as13335")
+	require.NoError(t, err)
+	assert.True(t, pattern.Match(net.ParseIP("1.1.1.1")))
+	assert.False(t, pattern.Match(net.ParseIP("8.8.8.8")))
+}
+
+func TestManagerConfigGeoSite(t *testing.T) {
+	m, ts := newTestManager(t)
+	defer ts.Close()
+
+	rule := NewRule([]RuleConfig{{Schema: "GEOSITE", Pattern: "google", Proxy: "Proxy1"}})
+	rule.LoadGeoSites(&KoneConfig{General: GeneralConfig{GeoSiteDir: writeTestGeoSite(t)}})
+	m.one.setRouting(rule, m.one.routing().proxies)
+
+	var b bytes.Buffer
+	require.NoError(t, m.configHandle(&b, httptest.NewRequest("GET", "/config/", nil)))
+	assert.Contains(t, b.String(), "geoip database: embedded")
+	assert.Contains(t, b.String(), "<td>google</td>\n<td>Proxy1</td>\n<td>6</td>")
+}
@@ -8,6 +8,7 @@ require (
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	github.com/stretchr/testify v1.8.4
 	github.com/thecodeteam/goodbye v0.0.0-20170927022442-a83968bda2d3
+	golang.org/x/crypto v0.17.0
 	gopkg.in/ini.v1 v1.67.0
 )
 
@@ -0,0 +1,198 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const (
+	textLogFormat  = `%{time:06-01-02 15:04:05.000} %{level:.4s} @%{shortfile} %{message}`
+	colorLogFormat = `%{color}%{time:06-01-02 15:04:05.000} %{level:.4s} @%{shortfile}%{color:reset} %{message}`
+)
+
+// surge style level names, besides go-logging's
+var logLevelAlias = map[string]logging.Level{
+	"verbose": logging.DEBUG,
+	"notify":  logging.NOTICE,
+}
+
+func ParseLogLevel(level string) (logging.Level, error) {
+	if l, ok := logLevelAlias[strings.ToLower(level)]; ok {
+		return l, nil
+	}
+	l, err := logging.LogLevel(level)
+	if err != nil {
+		return l, fmt.Errorf("invalid log level: %s", level)
+	}
+	return l, nil
+}
+
+// one json object per line
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	file := "???"
+	if _, f, line, ok := runtime.Caller(calldepth + 1); ok {
+		file = fmt.Sprintf("%s:%d", filepath.Base(f), line)
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"time":    r.Time.Format(time.RFC3339Nano),
+		"level":   r.Level.String(),
+		"module":  r.Module,
+		"file":    file,
+		"message": r.Message(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// RotateWriter writes to file, and rotates it to file.1, file.2, ... when its size exceeds maxSize
+type RotateWriter struct {
+	path       string
+	maxSize    int64 // no rotation if 0
+	maxBackups int   // keep at most maxBackups rotated files
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (w *RotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *RotateWriter) backup(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+// rotate renames file to backups and opens a new one. The current file is kept open until
+// the new one is opened, so writes go on if rotation fails.
+func (w *RotateWriter) rotate() error {
+	os.Remove(w.backup(w.maxBackups))
+	for i := w.maxBackups - 1; i > 0; i-- {
+		os.Rename(w.backup(i), w.backup(i+1))
+	}
+	if w.maxBackups > 0 {
+		if err := os.Rename(w.path, w.backup(1)); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(w.path)
+	}
+
+	old := w.file
+	if err := w.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func (w *RotateWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(b)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			// logger may write here, report to stderr and retry after another maxSize bytes
+			fmt.Fprintf(os.Stderr, "rotate %s failed: %v\n", w.path, err)
+			w.size = 0
+		}
+	}
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotateWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
+
+func NewRotateWriter(path string, maxSize int64, maxBackups int) (*RotateWriter, error) {
+	w := &RotateWriter{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// SetupLogging applies log options of general config, debug overrides log-level.
+// A relative log-file is relative to dir of config file.
+func SetupLogging(config *KoneConfig, debug bool) error {
+	cfg := config.General
+	level := logging.INFO
+	if debug {
+		level = logging.DEBUG
+	} else if cfg.LogLevel != "" {
+		var err error
+		if level, err = ParseLogLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+
+	var formatter logging.Formatter
+	switch strings.ToLower(cfg.LogFormat) {
+	case "", LogFormatText:
+		if cfg.LogFile == "" {
+			formatter = logging.MustStringFormatter(colorLogFormat)
+		} else {
+			formatter = logging.MustStringFormatter(textLogFormat)
+		}
+	case LogFormatJSON:
+		formatter = jsonFormatter{}
+	default:
+		return fmt.Errorf("invalid log format: %s", cfg.LogFormat)
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.LogFile != "" {
+		w, err := NewRotateWriter(config.path(cfg.LogFile), int64(cfg.LogMaxSize)<<20, int(cfg.LogMaxBackups))
+		if err != nil {
+			return err
+		}
+		out = w
+	}
+
+	logging.SetBackend(logging.NewBackendFormatter(logging.NewLogBackend(out, "", 0), formatter))
+	logging.SetLevel(level, "")
+	return nil
+}
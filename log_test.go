@@ -0,0 +1,112 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for level, expected := range map[string]logging.Level{
+		"verbose": logging.DEBUG,
+		"debug":   logging.DEBUG,
+		"info":    logging.INFO,
+		"notify":  logging.NOTICE,
+		"Warning": logging.WARNING,
+		"error":   logging.ERROR,
+	} {
+		l, err := ParseLogLevel(level)
+		require.NoError(t, err, level)
+		assert.Equal(t, expected, l, level)
+	}
+
+	_, err := ParseLogLevel("loud")
+	assert.Error(t, err)
+}
+
+func TestRotateWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kone.log")
+	w, err := NewRotateWriter(path, 10, 2)
+	require.NoError(t, err)
+	defer w.Close()
+
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		_, err := w.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	read := func(name string) string {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "line 4\n", read(path))
+	assert.Equal(t, "line 3\n", read(path+".1"))
+	assert.Equal(t, "line 2\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// append to existing file
+	w.Close()
+	w, err = NewRotateWriter(path, 0, 2)
+	require.NoError(t, err)
+	w.Write([]byte("line 5\n"))
+	assert.Equal(t, "line 4\nline 5\n", read(path))
+	w.Close()
+
+	// writes go on if rotation fails
+	path = filepath.Join(t.TempDir(), "kone.log")
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "busy"), 0755))
+	w, err = NewRotateWriter(path, 10, 1)
+	require.NoError(t, err)
+	defer w.Close()
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n"} {
+		_, err := w.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "line 1\nline 2\nline 3\n", read(path))
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer logging.Reset()
+
+	require.Error(t, SetupLogging(&KoneConfig{General: GeneralConfig{LogLevel: "loud"}}, false))
+	require.Error(t, SetupLogging(&KoneConfig{General: GeneralConfig{LogFormat: "xml"}}, false))
+
+	// log file is relative to config file
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kone.log")
+	require.NoError(t, SetupLogging(&KoneConfig{
+		source: filepath.Join(dir, "kone.ini"),
+		General: GeneralConfig{
+			LogLevel:  "notify",
+			LogFile:   "kone.log",
+			LogFormat: LogFormatJSON,
+		},
+	}, false))
+	logger.Infof("[test] hidden")
+	logger.Noticef("[test] shown %d", 1)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 1)
+
+	var record map[string]string
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "NOTICE", record["level"])
+	assert.Equal(t, "[test] shown 1", record["message"])
+	assert.Equal(t, "kone", record["module"])
+	assert.True(t, strings.HasPrefix(record["file"], "log_test.go:"), record["file"])
+}
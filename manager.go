@@ -2,12 +2,20 @@ package kone
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/xjdrew/kone/geoip"
 )
 
 const masterTmpl = `
@@ -79,6 +87,9 @@ table th.title {
 <tr><th>Total Traffic</th><td>{{formatNumberComma .TotalTraffic}}</td></tr>
 <tr><th>Upload Traffic</th><td>{{formatNumberComma .UploadTraffic}}</td></tr>
 <tr><th>Download Traffic</th><td>{{formatNumberComma .DownloadTraffic}}</td></tr>
+<tr><th>Rejected DNS Queries</th><td>{{formatNumberComma .RejectDns}}</td></tr>
+<tr><th>Rejected TCP Connections</th><td>{{formatNumberComma .RejectTcp}}</td></tr>
+<tr><th>Rejected UDP Packets</th><td>{{formatNumberComma .RejectUdp}}</td></tr>
 <tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
 <tr><th>Now</th><td>{{.Now.Format "2006-01-02 15:04:05.000"}}</td></tr>
 </table>
@@ -137,6 +148,7 @@ table th.title {
 <table>
 <tr>
 <th>Name</th>
+<th>Process</th>
 <th>Total</th>
 <th>Upload</th>
 <th>Download</th>
@@ -145,6 +157,7 @@ table th.title {
 {{range .}}
 <tr>
 <td>{{.EndPoint}}</td>
+<td>{{.Process}}</td>
 <td>{{sumInt64 .Upload .Download | formatNumberComma}}</td>
 <td>{{formatNumberComma .Upload}}</td>
 <td>{{formatNumberComma .Download}}</td>
@@ -161,13 +174,31 @@ table th.title {
 <h2>Current State</h2>
 <ul>
 <li>Dns server: {{.DnsServer}}</li>
+<li><a href='/dns/log/'>Query log</a></li>
 <li>Active entries: {{.ActiveEntries}}</li>
 <li>Expired entries:{{.ExpiredEntries}}</li>
-</ul>
+{{with .Cache}}<li>Answer cache: {{.Entries}}/{{.Capacity}} entries, hit ratio {{printf "%.1f" .HitRatio}}% ({{.Hits}} hits, {{.Misses}} misses), {{.Stale}} stale answers served</li>
+{{else}}<li>Answer cache: disabled</li>
+{{end}}</ul>
+{{if .Hosts}}
+<table>
+<tr>
+<th>Host</th>
+<th>Answer</th>
+</tr>
+{{range .Hosts}}
+<tr>
+<td>{{.Domain}}</td>
+<td>{{.Value}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
 <table>
 <tr>
 <th>Hostname</th>
 <th>Address</th>
+<th>IPv6 Address</th>
 <th>Proxy</th>
 <th>Hits</th>
 <th>Expires</th>
@@ -176,6 +207,7 @@ table th.title {
 <tr>
 <td>{{.Hostname}}</td>
 <td>{{.IP}}</td>
+<td>{{if .IP6}}{{.IP6}}{{end}}</td>
 <td>{{.Proxy}}</td>
 <td>{{.Hits}}</td>
 <td>{{.Expires.Format "2006-01-02 15:04:05.000"}}{{if .Expires.Before $.Now}}<span style="color:red">[expired]</span>{{end}}</td>
@@ -185,13 +217,147 @@ table th.title {
 {{template "footer" .}}
 {{end}}
 
+{{define "dns_log"}}
+{{template "header" .}}
+<h2>DNS Queries</h2>
+{{if .Enabled}}
+<form method="get" action="/dns/log/">
+Client: <input type="text" name="client" value="{{.Client}}">
+Domain: <input type="text" name="domain" value="{{.Domain}}">
+<input type="submit" value="filter">
+</form>
+<ul>
+<li>Entries: {{len .Queries}}, latest {{.Size}} queries are kept</li>
+</ul>
+<table>
+<tr>
+<th>Time</th>
+<th>Client</th>
+<th>Name</th>
+<th>Type</th>
+<th>Decision</th>
+<th>Rule</th>
+<th>Upstream</th>
+<th>Latency</th>
+</tr>
+{{range .Queries}}
+<tr>
+<td>{{.Time.Format "2006-01-02 15:04:05.000"}}</td>
+<td><a href="/dns/log/?client={{.Client}}">{{.Client}}</a></td>
+<td><a href="/dns/log/?domain={{.Name}}">{{.Name}}</a></td>
+<td>{{.Type}}</td>
+<td>{{.Decision}}</td>
+<td>{{.Rule}}</td>
+<td>{{.Upstream}}</td>
+<td>{{.Latency}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>Query log is disabled, set dns-log-size to enable it.</p>
+{{end}}
+{{template "footer" .}}
+{{end}}
+
+{{define "group"}}
+{{template "header" .}}
+<h2>Proxy Groups</h2>
+{{range .Groups}}
+<h3>{{.Name}} ({{.Type}}): {{.Selected}}</h3>
+<table>
+<tr>
+<th>Member</th>
+<th>State</th>
+<th>Latency</th>
+<th>Last Check</th>
+<th>Last Error</th>
+</tr>
+{{range .Members}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{if .Alive}}up{{else}}<span style="color:red">down</span>{{end}}</td>
+<td>{{.Latency}}</td>
+<td>{{if not .LastCheck.IsZero}}{{.LastCheck.Format "2006-01-02 15:04:05.000"}}{{end}}</td>
+<td>{{.LastError}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+{{template "footer" .}}
+{{end}}
+
+{{define "connections"}}
+{{template "header" .}}
+<h2>Active Connections</h2>
+<ul>
+<li>Entries: {{len .Connections}}</li>
+<li>Now: {{.Now.Format "2006-01-02 15:04:05.000"}}</li>
+</ul>
+<table>
+<tr>
+<th>ID</th>
+<th>Network</th>
+<th>Source</th>
+<th>Destination</th>
+<th>Process</th>
+<th>Proxy</th>
+<th>Upload</th>
+<th>Download</th>
+<th>Duration</th>
+<th></th>
+</tr>
+{{range .Connections}}
+<tr>
+<td>{{.ID}}</td>
+<td>{{.Network}}</td>
+<td>{{.Src}}</td>
+<td>{{.Dst}}</td>
+<td>{{.Process}}</td>
+<td>
+<form method="post" action="/connections/close">
+<input type="hidden" name="proxy" value="{{.Proxy}}">
+{{.Proxy}} <input type="submit" value="close all">
+</form>
+</td>
+<td>{{formatNumberComma .Upload}}</td>
+<td>{{formatNumberComma .Download}}</td>
+<td>{{sinceSeconds .Start}}</td>
+<td>
+<form method="post" action="/connections/close">
+<input type="hidden" name="id" value="{{.ID}}">
+<input type="submit" value="close">
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+{{template "footer" .}}
+{{end}}
 
 {{define "config"}}
 {{template "header" .}}
 <h2>Config</h2>
 <ul>
 <li>rules: {{.RuleCount}}</li>
+<li>geoip database: {{if .GeoIP}}{{.GeoIP}}{{else}}embedded{{end}}</li>
+<li>asn database: {{if .ASN}}{{.ASN}}{{else}}none{{end}}</li>
 </ul>
+{{if .GeoSites}}
+<table>
+<tr>
+<th>GeoSite</th>
+<th>Proxy</th>
+<th>Domains</th>
+</tr>
+{{range .GeoSites}}
+<tr>
+<td>{{.Category}}</td>
+<td>{{.Proxy}}</td>
+<td>{{.Domains}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
 <table>
 <tr>
 <th>Source</th>
@@ -209,37 +375,65 @@ type ConnData struct {
 	Src      string
 	Dst      string
 	Proxy    string
+	Process  string // name of local process, empty if unknown
 	Upload   int64
 	Download int64
 }
 
 // statistical data of every host/website/proxy
 type TrafficRecordDetail struct {
-	EndPoint string
-	Upload   int64
-	Download int64
-	Touch    time.Time
+	EndPoint string    `json:"endpoint"`
+	Process  string    `json:"process,omitempty"` // local process of last connection
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+	Touch    time.Time `json:"touch"`
 }
 
 type TrafficRecord struct {
-	Name     string
-	Upload   int64
-	Download int64
-	Touch    time.Time
-	Details  map[string]*TrafficRecordDetail
+	Name     string                          `json:"name"`
+	Upload   int64                           `json:"upload"`
+	Download int64                           `json:"download"`
+	Touch    time.Time                       `json:"touch"`
+	Details  map[string]*TrafficRecordDetail `json:"details,omitempty"`
 }
 
 type Manager struct {
 	one       *One
-	cfg       *KoneConfig
 	startTime time.Time // process start time
 	listen    string
+	server    *http.Server
 	tmpl      *template.Template
 
 	dataCh   chan ConnData
+	lock     sync.RWMutex // protect hosts, websites and proxies
 	hosts    map[string]*TrafficRecord
 	websites map[string]*TrafficRecord
 	proxies  map[string]*TrafficRecord
+
+	// hits of REJECT/REJECT-DROP policy
+	rejectDns atomic.Int64
+	rejectTcp atomic.Int64
+	rejectUdp atomic.Int64
+
+	// dns queries by outcome, except rejected ones
+	dnsQueries [dnsOutcomes]atomic.Int64
+
+	dialFailures map[string]int64 // proxy -> failures, protected by lock
+}
+
+// outcomes of dns query
+const (
+	dnsHijacked = iota // answered by a fake ip
+	dnsNonProxy        // answered by upstream nameservers
+	dnsStatic          // answered by static hosts
+	dnsFailed          // failed to resolve
+	dnsOutcomes
+)
+
+func (m *Manager) dialFailed(proxy string) {
+	m.lock.Lock()
+	m.dialFailures[proxy]++
+	m.lock.Unlock()
 }
 
 func handleWrapper(f func(io.Writer, *http.Request) error) func(http.ResponseWriter, *http.Request) {
@@ -255,6 +449,9 @@ func handleWrapper(f func(io.Writer, *http.Request) error) func(http.ResponseWri
 }
 
 func (m *Manager) indexHandle(w io.Writer, r *http.Request) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	var upload, download int64
 	for _, v := range m.proxies {
 		upload += v.Upload
@@ -270,18 +467,29 @@ func (m *Manager) indexHandle(w io.Writer, r *http.Request) error {
 		"TotalTraffic":    upload + download,
 		"UploadTraffic":   upload,
 		"DownloadTraffic": download,
+		"RejectDns":       m.rejectDns.Load(),
+		"RejectTcp":       m.rejectTcp.Load(),
+		"RejectUdp":       m.rejectUdp.Load(),
 		"URLs": []string{
 			"/host/",
 			"/website/",
 			"/proxy/",
+			"/group/",
 			"/dns/",
+			"/dns/log/",
+			"/connections/",
 			"/reload/",
 			"/config/",
+			"/api/v1/",
+			"/metrics",
 		},
 	})
 }
 
 func (m *Manager) hostHandle(w io.Writer, r *http.Request) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	name := strings.TrimPrefix(r.RequestURI, "/host/")
 	record, ok := m.hosts[name]
 	if ok {
@@ -306,6 +514,9 @@ func (m *Manager) hostHandle(w io.Writer, r *http.Request) error {
 }
 
 func (m *Manager) websiteHandle(w io.Writer, r *http.Request) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	name := strings.TrimPrefix(r.RequestURI, "/website/")
 	record, ok := m.websites[name]
 	if ok {
@@ -330,6 +541,9 @@ func (m *Manager) websiteHandle(w io.Writer, r *http.Request) error {
 }
 
 func (m *Manager) proxyHandle(w io.Writer, r *http.Request) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	var upload, download int64
 	for _, v := range m.proxies {
 		upload += v.Upload
@@ -343,8 +557,32 @@ func (m *Manager) proxyHandle(w io.Writer, r *http.Request) error {
 	})
 }
 
+func (m *Manager) groupHandle(w io.Writer, r *http.Request) error {
+	proxies := m.one.routing().proxies
+	var names []string
+	for name := range proxies.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var groups []map[string]interface{}
+	for _, name := range names {
+		group := proxies.groups[name]
+		groups = append(groups, map[string]interface{}{
+			"Name":     group.Name,
+			"Type":     group.Type,
+			"Selected": group.Selected(),
+			"Members":  group.Members(),
+		})
+	}
+	return m.tmpl.ExecuteTemplate(w, "group", map[string]interface{}{
+		"Title":  "Proxy Groups",
+		"Groups": groups,
+	})
+}
+
 func (m *Manager) dnsHandle(w io.Writer, r *http.Request) error {
-	records := m.one.dnsTable.records
+	records := m.one.dnsTable.Records()
 
 	activeEntries, expiredEntires := 0, 0
 	now := time.Now()
@@ -356,9 +594,16 @@ func (m *Manager) dnsHandle(w io.Writer, r *http.Request) error {
 		}
 	}
 
+	var cache *DnsCacheStats
+	if stats, ok := m.one.dns.CacheStats(); ok {
+		cache = &stats
+	}
+
 	return m.tmpl.ExecuteTemplate(w, "dns", map[string]interface{}{
 		"Title":          "dns cache",
-		"DnsServer":      strings.Join(m.one.dns.nameservers, ","),
+		"DnsServer":      strings.Join(m.one.dns.Nameservers(), ","),
+		"Hosts":          m.one.dns.Hosts(),
+		"Cache":          cache,
 		"ActiveEntries":  activeEntries,
 		"ExpiredEntries": expiredEntires,
 		"Now":            now,
@@ -366,37 +611,103 @@ func (m *Manager) dnsHandle(w io.Writer, r *http.Request) error {
 	})
 }
 
-func (m *Manager) reloadHandle(w io.Writer, r *http.Request) error {
-	logger.Infof("[manager] reload config")
-	newcfg, err := ParseConfig(m.cfg.source)
-	if err != nil {
-		return err
+// latest queries shown in dns log page
+const dnsLogPageSize = 500
+
+func (m *Manager) dnsLogHandle(w io.Writer, r *http.Request) error {
+	client, domain := r.FormValue("client"), r.FormValue("domain")
+	data := map[string]interface{}{
+		"Title":  "dns log",
+		"Client": client,
+		"Domain": domain,
 	}
+	if l := m.one.dns.log; l != nil {
+		data["Enabled"] = true
+		data["Size"] = l.Size()
+		data["Queries"] = l.Query(client, domain, dnsLogPageSize)
+	}
+	return m.tmpl.ExecuteTemplate(w, "dns_log", data)
+}
 
-	err = m.one.Reload(newcfg)
-	if err != nil {
-		return err
+func (m *Manager) connectionsHandle(w io.Writer, r *http.Request) error {
+	return m.tmpl.ExecuteTemplate(w, "connections", map[string]interface{}{
+		"Title":       "Active Connections",
+		"Now":         time.Now(),
+		"Connections": m.one.conns.List(),
+	})
+}
+
+// close connection by id, or all connections through proxy
+func (m *Manager) closeConnections(r *http.Request) (int, error) {
+	if id := r.FormValue("id"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid connection id: %s", id)
+		}
+		if m.one.conns.Close(n) {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	if proxy := r.FormValue("proxy"); proxy != "" {
+		return m.one.conns.CloseByProxy(proxy), nil
+	}
+	return 0, errors.New("id or proxy is required")
+}
+
+func (m *Manager) closeConnectionsHandle(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := m.closeConnections(r); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
 	}
+	http.Redirect(rw, r, "/connections/", http.StatusSeeOther)
+}
+
+func (m *Manager) reload() error {
+	logger.Infof("[manager] reload config")
+	return m.one.ReloadConfig()
+}
 
-	m.cfg = newcfg
+func (m *Manager) reloadHandle(w io.Writer, r *http.Request) error {
+	if err := m.reload(); err != nil {
+		return err
+	}
 	w.Write([]byte("reload succeed"))
 	return nil
 }
 
 func (m *Manager) configHandle(w io.Writer, r *http.Request) error {
+	cfg := m.one.Config()
 	b := bytes.NewBuffer([]byte{})
-	m.cfg.inif.WriteTo(b)
+	cfg.inif.WriteTo(b)
+
+	type geoSite struct {
+		Category string
+		Proxy    string
+		Domains  int
+	}
+	var geoSites []geoSite
+	for _, site := range m.one.routing().rule.geoSites() {
+		geoSites = append(geoSites, geoSite{site.category, site.proxy, site.Size()})
+	}
 
 	return m.tmpl.ExecuteTemplate(w, "config", map[string]interface{}{
 		"Title":     "Config",
-		"RuleCount": len(m.cfg.Rule),
+		"RuleCount": len(cfg.Rule),
+		"GeoIP":     geoip.Path(),
+		"ASN":       geoip.ASNPath(),
+		"GeoSites":  geoSites,
 		"Source":    string(b.Bytes()),
 	})
 }
 
 // statistical data api
 func (m *Manager) consumeData() {
-	accumulate := func(s map[string]*TrafficRecord, name string, endpoint string, upload int64, download int64, now time.Time) {
+	accumulate := func(s map[string]*TrafficRecord, name string, endpoint string, process string, upload int64, download int64, now time.Time) {
 		o, ok := s[name]
 		if ok {
 			o.Upload += upload
@@ -421,9 +732,13 @@ func (m *Manager) consumeData() {
 			d.Upload += upload
 			d.Download += download
 			d.Touch = now
+			if process != "" {
+				d.Process = process
+			}
 		} else {
 			o.Details[endpoint] = &TrafficRecordDetail{
 				EndPoint: endpoint,
+				Process:  process,
 				Upload:   upload,
 				Download: download,
 				Touch:    now,
@@ -433,24 +748,41 @@ func (m *Manager) consumeData() {
 
 	for data := range m.dataCh {
 		now := time.Now()
-		accumulate(m.hosts, data.Src, data.Dst, data.Upload, data.Download, now)
-		accumulate(m.websites, data.Dst, data.Src, data.Upload, data.Download, now)
-		accumulate(m.proxies, data.Proxy, "", data.Upload, data.Download, now)
+		m.lock.Lock()
+		accumulate(m.hosts, data.Src, data.Dst, data.Process, data.Upload, data.Download, now)
+		accumulate(m.websites, data.Dst, data.Src, data.Process, data.Upload, data.Download, now)
+		accumulate(m.proxies, data.Proxy, "", "", data.Upload, data.Download, now)
+		m.lock.Unlock()
 	}
 }
 
 func (m *Manager) Serve() error {
-	http.HandleFunc("/", handleWrapper(m.indexHandle))
-	http.HandleFunc("/host/", handleWrapper(m.hostHandle))
-	http.HandleFunc("/website/", handleWrapper(m.websiteHandle))
-	http.HandleFunc("/proxy/", handleWrapper(m.proxyHandle))
-	http.HandleFunc("/dns/", handleWrapper(m.dnsHandle))
-	http.HandleFunc("/reload/", handleWrapper(m.reloadHandle))
-	http.HandleFunc("/config/", handleWrapper(m.configHandle))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleWrapper(m.indexHandle))
+	mux.HandleFunc("/host/", handleWrapper(m.hostHandle))
+	mux.HandleFunc("/website/", handleWrapper(m.websiteHandle))
+	mux.HandleFunc("/proxy/", handleWrapper(m.proxyHandle))
+	mux.HandleFunc("/group/", handleWrapper(m.groupHandle))
+	mux.HandleFunc("/dns/", handleWrapper(m.dnsHandle))
+	mux.HandleFunc("/dns/log/", handleWrapper(m.dnsLogHandle))
+	mux.HandleFunc("/connections/", handleWrapper(m.connectionsHandle))
+	mux.HandleFunc("/connections/close", m.closeConnectionsHandle)
+	mux.HandleFunc("/reload/", handleWrapper(m.reloadHandle))
+	mux.HandleFunc("/config/", handleWrapper(m.configHandle))
+	m.registerAPI(mux)
+	mux.HandleFunc("/metrics", m.metricsHandle)
 	go m.consumeData()
 
+	m.server.Handler = mux
 	logger.Infof("[manager] listen on: %s", m.listen)
-	return http.ListenAndServe(m.listen, nil)
+	if err := m.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) Shutdown(ctx context.Context) error {
+	return m.server.Shutdown(ctx)
 }
 
 func NewManager(one *One, cfg *KoneConfig) *Manager {
@@ -462,6 +794,9 @@ func NewManager(one *One, cfg *KoneConfig) *Manager {
 		"sumInt64": func(a int64, b int64) int64 {
 			return a + b
 		},
+		"sinceSeconds": func(t time.Time) time.Duration {
+			return time.Since(t).Truncate(time.Second)
+		},
 		"formatNumberComma": func(a int64) string {
 			var sign, ret string
 			if a == 0 {
@@ -494,13 +829,15 @@ func NewManager(one *One, cfg *KoneConfig) *Manager {
 
 	return &Manager{
 		one:       one,
-		cfg:       cfg,
 		startTime: time.Now(),
 		listen:    cfg.General.ManagerAddr,
+		server:    &http.Server{Addr: cfg.General.ManagerAddr},
 		dataCh:    make(chan ConnData),
 		hosts:     make(map[string]*TrafficRecord),
 		websites:  make(map[string]*TrafficRecord),
 		proxies:   make(map[string]*TrafficRecord),
-		tmpl:      template.Must(tmpl.Parse(masterTmpl)),
+
+		dialFailures: make(map[string]int64),
+		tmpl:         template.Must(tmpl.Parse(masterTmpl)),
 	}
 }
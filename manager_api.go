@@ -0,0 +1,282 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/v1/"
+
+// error with http status code
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func errNotFound(format string, a ...interface{}) error {
+	return &apiError{http.StatusNotFound, fmt.Sprintf(format, a...)}
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(code)
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// apiWrapper serves f's result as json, only method is allowed
+func apiWrapper(method string, f func(*http.Request) (interface{}, error)) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			rw.Header().Set("Allow", method)
+			writeJSON(rw, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		v, err := f(r)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if e, ok := err.(*apiError); ok {
+				code = e.code
+			}
+			writeJSON(rw, code, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(rw, http.StatusOK, v)
+	}
+}
+
+type apiStats struct {
+	Now           time.Time `json:"now"`
+	Uptime        float64   `json:"uptime"` // seconds
+	TotalHosts    int       `json:"total_hosts"`
+	TotalWebsites int       `json:"total_websites"`
+	TotalProxies  int       `json:"total_proxies"`
+	Upload        int64     `json:"upload"`
+	Download      int64     `json:"download"`
+	RejectDns     int64     `json:"reject_dns"`
+	RejectTcp     int64     `json:"reject_tcp"`
+	RejectUdp     int64     `json:"reject_udp"`
+}
+
+type apiTraffic struct {
+	Upload   int64            `json:"upload"`
+	Download int64            `json:"download"`
+	Records  []*TrafficRecord `json:"records"`
+}
+
+type apiGroup struct {
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Selected string        `json:"selected"`
+	Members  []GroupMember `json:"members"`
+}
+
+type apiDns struct {
+	Nameservers    []string       `json:"nameservers"`
+	Hosts          []HostConfig   `json:"hosts,omitempty"`
+	Cache          *DnsCacheStats `json:"cache,omitempty"` // nil if cache is disabled
+	ActiveEntries  int            `json:"active_entries"`
+	ExpiredEntries int            `json:"expired_entries"`
+	Records        []DomainRecord `json:"records"`
+}
+
+func (m *Manager) apiIndex(r *http.Request) (interface{}, error) {
+	if r.URL.Path != apiPrefix {
+		return nil, errNotFound("no api: %s", r.URL.Path)
+	}
+	return []string{
+		"GET " + apiPrefix + "stats",
+		"GET " + apiPrefix + "hosts/[name]",
+		"GET " + apiPrefix + "websites/[name]",
+		"GET " + apiPrefix + "proxies",
+		"GET " + apiPrefix + "groups",
+		"GET " + apiPrefix + "dns",
+		"GET " + apiPrefix + "dns/log?client=<client>&domain=<domain>&limit=<limit>",
+		"GET " + apiPrefix + "connections",
+		"POST " + apiPrefix + "connections/close?id=<id>|proxy=<proxy>",
+		"GET " + apiPrefix + "config",
+		"POST " + apiPrefix + "dns/clear",
+		"POST " + apiPrefix + "reload",
+	}, nil
+}
+
+func (m *Manager) apiStats(r *http.Request) (interface{}, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	stats := &apiStats{
+		Now:           time.Now(),
+		Uptime:        time.Since(m.startTime).Seconds(),
+		TotalHosts:    len(m.hosts),
+		TotalWebsites: len(m.websites),
+		TotalProxies:  len(m.proxies),
+		RejectDns:     m.rejectDns.Load(),
+		RejectTcp:     m.rejectTcp.Load(),
+		RejectUdp:     m.rejectUdp.Load(),
+	}
+	for _, v := range m.proxies {
+		stats.Upload += v.Upload
+		stats.Download += v.Download
+	}
+	return stats, nil
+}
+
+// list records sorted by name without details, or a single record with details if name is given
+func (m *Manager) apiTraffic(records map[string]*TrafficRecord, prefix string) func(*http.Request) (interface{}, error) {
+	return func(r *http.Request) (interface{}, error) {
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		if name != "" {
+			record, ok := records[name]
+			if !ok {
+				return nil, errNotFound("no record: %s", name)
+			}
+			detail := *record
+			detail.Details = make(map[string]*TrafficRecordDetail, len(record.Details))
+			for k, v := range record.Details {
+				d := *v
+				detail.Details[k] = &d
+			}
+			return &detail, nil
+		}
+
+		traffic := &apiTraffic{Records: make([]*TrafficRecord, 0, len(records))}
+		for _, v := range records {
+			traffic.Upload += v.Upload
+			traffic.Download += v.Download
+			record := *v
+			record.Details = nil
+			traffic.Records = append(traffic.Records, &record)
+		}
+		sort.Slice(traffic.Records, func(i, j int) bool {
+			return traffic.Records[i].Name < traffic.Records[j].Name
+		})
+		return traffic, nil
+	}
+}
+
+func (m *Manager) apiGroups(r *http.Request) (interface{}, error) {
+	proxies := m.one.routing().proxies
+	groups := make([]apiGroup, 0, len(proxies.groups))
+	for _, group := range proxies.groups {
+		groups = append(groups, apiGroup{
+			Name:     group.Name,
+			Type:     group.Type,
+			Selected: group.Selected(),
+			Members:  group.Members(),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+func (m *Manager) apiDns(r *http.Request) (interface{}, error) {
+	records := m.one.dnsTable.Records()
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Hostname < records[j].Hostname
+	})
+
+	result := &apiDns{
+		Nameservers: m.one.dns.Nameservers(),
+		Hosts:       m.one.dns.Hosts(),
+		Records:     records,
+	}
+	if stats, ok := m.one.dns.CacheStats(); ok {
+		result.Cache = &stats
+	}
+	now := time.Now()
+	for _, record := range records {
+		if record.Expires.Before(now) {
+			result.ExpiredEntries += 1
+		} else {
+			result.ActiveEntries += 1
+		}
+	}
+	return result, nil
+}
+
+func (m *Manager) apiDnsClear(r *http.Request) (interface{}, error) {
+	n := m.one.dnsTable.Clear()
+	logger.Infof("[manager] clear dns table, %d records released", n)
+	return map[string]int{"released": n}, nil
+}
+
+// queries of dns log, filtered by client and domain, at most limit queries
+func (m *Manager) apiDnsLog(r *http.Request) (interface{}, error) {
+	l := m.one.dns.log
+	if l == nil {
+		return nil, errNotFound("dns log is disabled")
+	}
+	limit := 0
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, &apiError{http.StatusBadRequest, fmt.Sprintf("invalid limit: %s", s)}
+		}
+		limit = n
+	}
+	queries := l.Query(r.FormValue("client"), r.FormValue("domain"), limit)
+	if queries == nil {
+		queries = []DnsQuery{}
+	}
+	return queries, nil
+}
+
+func (m *Manager) apiConnections(r *http.Request) (interface{}, error) {
+	return m.one.conns.List(), nil
+}
+
+func (m *Manager) apiCloseConnections(r *http.Request) (interface{}, error) {
+	n, err := m.closeConnections(r)
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, err.Error()}
+	}
+	return map[string]int{"closed": n}, nil
+}
+
+func (m *Manager) apiConfig(r *http.Request) (interface{}, error) {
+	return m.one.Config(), nil
+}
+
+func (m *Manager) apiReload(r *http.Request) (interface{}, error) {
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return map[string]string{"result": "reload succeed"}, nil
+}
+
+func (m *Manager) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc(apiPrefix, apiWrapper(http.MethodGet, m.apiIndex))
+	mux.HandleFunc(apiPrefix+"stats", apiWrapper(http.MethodGet, m.apiStats))
+	mux.HandleFunc(apiPrefix+"hosts/", apiWrapper(http.MethodGet, m.apiTraffic(m.hosts, apiPrefix+"hosts/")))
+	mux.HandleFunc(apiPrefix+"websites/", apiWrapper(http.MethodGet, m.apiTraffic(m.websites, apiPrefix+"websites/")))
+	mux.HandleFunc(apiPrefix+"proxies", apiWrapper(http.MethodGet, m.apiTraffic(m.proxies, apiPrefix+"proxies")))
+	mux.HandleFunc(apiPrefix+"groups", apiWrapper(http.MethodGet, m.apiGroups))
+	mux.HandleFunc(apiPrefix+"dns", apiWrapper(http.MethodGet, m.apiDns))
+	mux.HandleFunc(apiPrefix+"dns/clear", apiWrapper(http.MethodPost, m.apiDnsClear))
+	mux.HandleFunc(apiPrefix+"dns/log", apiWrapper(http.MethodGet, m.apiDnsLog))
+	mux.HandleFunc(apiPrefix+"connections", apiWrapper(http.MethodGet, m.apiConnections))
+	mux.HandleFunc(apiPrefix+"connections/close", apiWrapper(http.MethodPost, m.apiCloseConnections))
+	mux.HandleFunc(apiPrefix+"config", apiWrapper(http.MethodGet, m.apiConfig))
+	mux.HandleFunc(apiPrefix+"reload", apiWrapper(http.MethodPost, m.apiReload))
+}
@@ -0,0 +1,169 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestManager(t *testing.T) (*Manager, *httptest.Server) {
+	cfg, err := ParseConfig([]byte(confData))
+	require.NoError(t, err)
+
+	d := newTestDns(cfg.Rule)
+	d.SetNameservers(cfg.Core.DnsServer)
+	one := d.one
+	one.cfg = cfg
+	one.conns = NewConnTable()
+	setTestProxies(t, one, cfg.Proxy, cfg.ProxyGroup)
+
+	m := NewManager(one, cfg)
+	require.NotNil(t, m)
+	one.manager = m
+
+	mux := http.NewServeMux()
+	m.registerAPI(mux)
+	ts := httptest.NewServer(mux)
+	return m, ts
+}
+
+func apiCall(t *testing.T, method, url string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json"))
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestManagerAPITraffic(t *testing.T) {
+	m, ts := newTestManager(t)
+	defer ts.Close()
+
+	done := make(chan struct{})
+	go func() {
+		m.consumeData()
+		close(done)
+	}()
+	m.dataCh <- ConnData{Src: "10.0.0.2", Dst: "www.google.com:443", Proxy: "Proxy1", Process: "curl", Upload: 10, Download: 100}
+	m.dataCh <- ConnData{Src: "10.0.0.3", Dst: "www.google.com:443", Proxy: "Proxy1", Upload: 1, Download: 2}
+	close(m.dataCh)
+	<-done
+	m.rejectTcp.Add(2)
+
+	var stats apiStats
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/stats", &stats))
+	assert.Equal(t, 2, stats.TotalHosts)
+	assert.Equal(t, int64(113), stats.Upload+stats.Download)
+	assert.Equal(t, int64(2), stats.RejectTcp)
+
+	var hosts apiTraffic
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/hosts/", &hosts))
+	require.Len(t, hosts.Records, 2)
+	assert.Equal(t, "10.0.0.2", hosts.Records[0].Name)
+	assert.Nil(t, hosts.Records[0].Details)
+
+	var host TrafficRecord
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/hosts/10.0.0.2", &host))
+	require.Contains(t, host.Details, "www.google.com:443")
+	assert.Equal(t, "curl", host.Details["www.google.com:443"].Process)
+
+	var record TrafficRecord
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/websites/www.google.com:443", &record))
+	assert.Equal(t, int64(11), record.Upload)
+	assert.Equal(t, int64(102), record.Download)
+	assert.Len(t, record.Details, 2)
+
+	var proxies apiTraffic
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/proxies", &proxies))
+	require.Len(t, proxies.Records, 1)
+	assert.Equal(t, int64(113), proxies.Upload+proxies.Download)
+
+	assert.Equal(t, http.StatusNotFound, apiCall(t, "GET", ts.URL+"/api/v1/hosts/10.0.0.9", nil))
+	assert.Equal(t, http.StatusNotFound, apiCall(t, "GET", ts.URL+"/api/v1/nothing", nil))
+}
+
+func TestManagerAPIDns(t *testing.T) {
+	m, ts := newTestManager(t)
+	defer ts.Close()
+
+	m.one.dnsTable.Set("www.twitter.com", "Proxy1")
+	m.one.dnsTable.Set("www.google.com", "Proxy1")
+
+	var result apiDns
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/dns", &result))
+	assert.Equal(t, []string{"1.1.1.1:53", "8.8.8.8:53"}, result.Nameservers)
+	assert.Equal(t, 2, result.ActiveEntries)
+	require.Len(t, result.Records, 2)
+	assert.Equal(t, "www.google.com", result.Records[0].Hostname)
+	assert.NotNil(t, result.Records[0].IP6)
+
+	// clear is POST only
+	assert.Equal(t, http.StatusMethodNotAllowed, apiCall(t, "GET", ts.URL+"/api/v1/dns/clear", nil))
+
+	var cleared map[string]int
+	require.Equal(t, http.StatusOK, apiCall(t, "POST", ts.URL+"/api/v1/dns/clear", &cleared))
+	assert.Equal(t, 2, cleared["released"])
+	assert.Empty(t, m.one.dnsTable.Records())
+
+	// released ips are reusable
+	record := m.one.dnsTable.Set("www.twitter.com", "Proxy1")
+	assert.NotNil(t, m.one.dnsTable.GetByIP(record.IP))
+
+	// real ip is resolved by relays while records are listed
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: pc, Handler: testDnsHandler("1.0.0.1")})
+	m.one.dns.SetNameservers([]string{pc.LocalAddr().String()})
+	record = m.one.dnsTable.Set("www.example.org", PolicyDirect)
+	done := make(chan net.IP)
+	go func() {
+		ip, _ := m.one.dns.RealIP(record)
+		done <- ip
+	}()
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/dns", &result))
+	var b bytes.Buffer
+	require.NoError(t, m.dnsHandle(&b, httptest.NewRequest("GET", "/dns/", nil)))
+	assert.Equal(t, "1.0.0.1", (<-done).String())
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/dns", &result))
+	require.Len(t, result.Records, 2)
+	assert.Equal(t, "1.0.0.1", result.Records[0].RealIP.String())
+}
+
+func TestManagerAPIConfig(t *testing.T) {
+	_, ts := newTestManager(t)
+	defer ts.Close()
+
+	var cfg map[string]interface{}
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/config", &cfg))
+	assert.Equal(t, "10.192.0.1/16", cfg["core"].(map[string]interface{})["network"])
+	assert.Len(t, cfg["rule"], 15)
+
+	var groups []apiGroup
+	require.Equal(t, http.StatusOK, apiCall(t, "GET", ts.URL+"/api/v1/groups", &groups))
+	require.Len(t, groups, 1)
+	assert.Equal(t, "Group1", groups[0].Name)
+	assert.Len(t, groups[0].Members, 2)
+
+	var result map[string]string
+	assert.Equal(t, http.StatusMethodNotAllowed, apiCall(t, "GET", ts.URL+"/api/v1/reload", nil))
+	require.Equal(t, http.StatusOK, apiCall(t, "POST", ts.URL+"/api/v1/reload", &result))
+	assert.Equal(t, "reload succeed", result["result"])
+}
@@ -0,0 +1,116 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// prometheus text exposition format: https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// value with an optional label pair
+func (mw *metricsWriter) value(name string, label, labelValue string, v interface{}) {
+	if label == "" {
+		fmt.Fprintf(mw.w, "%s %v\n", name, v)
+	} else {
+		fmt.Fprintf(mw.w, "%s{%s=\"%s\"} %v\n", name, label, labelEscaper.Replace(labelValue), v)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *Manager) writeMetrics(w io.Writer) {
+	mw := &metricsWriter{w}
+
+	mw.header("kone_uptime_seconds", "gauge", "Seconds since kone started.")
+	mw.value("kone_uptime_seconds", "", "", time.Since(m.startTime).Seconds())
+
+	m.lock.RLock()
+	mw.header("kone_proxy_upload_bytes_total", "counter", "Bytes uploaded through proxy, counted when connection closes.")
+	for _, name := range sortedKeys(m.proxies) {
+		mw.value("kone_proxy_upload_bytes_total", "proxy", name, m.proxies[name].Upload)
+	}
+	mw.header("kone_proxy_download_bytes_total", "counter", "Bytes downloaded through proxy, counted when connection closes.")
+	for _, name := range sortedKeys(m.proxies) {
+		mw.value("kone_proxy_download_bytes_total", "proxy", name, m.proxies[name].Download)
+	}
+	mw.header("kone_proxy_dial_failures_total", "counter", "Failed dials through proxy.")
+	for _, name := range sortedKeys(m.dialFailures) {
+		mw.value("kone_proxy_dial_failures_total", "proxy", name, m.dialFailures[name])
+	}
+	m.lock.RUnlock()
+
+	mw.header("kone_nat_mapped_entries", "gauge", "Mapped NAT entries, including idle ones not cleared yet.")
+	if r := m.one.tcpRelay; r != nil {
+		mw.value("kone_nat_mapped_entries", "protocol", "tcp", r.nat.Mapped())
+	}
+	if r := m.one.udpRelay; r != nil {
+		mw.value("kone_nat_mapped_entries", "protocol", "udp", r.nat.Mapped())
+	}
+
+	mw.header("kone_dns_queries_total", "counter", "DNS queries by outcome.")
+	mw.value("kone_dns_queries_total", "outcome", "hijacked", m.dnsQueries[dnsHijacked].Load())
+	mw.value("kone_dns_queries_total", "outcome", "non_proxy", m.dnsQueries[dnsNonProxy].Load())
+	mw.value("kone_dns_queries_total", "outcome", "static", m.dnsQueries[dnsStatic].Load())
+	mw.value("kone_dns_queries_total", "outcome", "rejected", m.rejectDns.Load())
+	mw.value("kone_dns_queries_total", "outcome", "failed", m.dnsQueries[dnsFailed].Load())
+
+	if stats, ok := m.one.dns.CacheStats(); ok {
+		mw.header("kone_dns_cache_entries", "gauge", "Answers in DNS cache.")
+		mw.value("kone_dns_cache_entries", "", "", stats.Entries)
+		mw.header("kone_dns_cache_lookups_total", "counter", "DNS cache lookups by result, each lookup is counted once.")
+		mw.value("kone_dns_cache_lookups_total", "result", "hit", stats.Hits)
+		mw.value("kone_dns_cache_lookups_total", "result", "miss", stats.Misses)
+		mw.value("kone_dns_cache_lookups_total", "result", "stale", stats.Stale)
+	}
+
+	mw.header("kone_rejected_total", "counter", "Connections or packets rejected by REJECT/REJECT-DROP policy.")
+	mw.value("kone_rejected_total", "protocol", "tcp", m.rejectTcp.Load())
+	mw.value("kone_rejected_total", "protocol", "udp", m.rejectUdp.Load())
+
+	used, capacity := m.one.dnsTable.PoolUsage(false)
+	used6, capacity6 := m.one.dnsTable.PoolUsage(true)
+	mw.header("kone_dns_ip_pool_used", "gauge", "Allocated fake IPs of hijacked domains.")
+	mw.value("kone_dns_ip_pool_used", "family", "ipv4", used)
+	if capacity6 > 0 {
+		mw.value("kone_dns_ip_pool_used", "family", "ipv6", used6)
+	}
+	mw.header("kone_dns_ip_pool_capacity", "gauge", "Capacity of fake IP pool.")
+	mw.value("kone_dns_ip_pool_capacity", "family", "ipv4", capacity)
+	if capacity6 > 0 {
+		mw.value("kone_dns_ip_pool_capacity", "family", "ipv6", capacity6)
+	}
+}
+
+func (m *Manager) metricsHandle(rw http.ResponseWriter, r *http.Request) {
+	b := bytes.NewBuffer(nil)
+	m.writeMetrics(b)
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.Write(b.Bytes())
+}
@@ -0,0 +1,75 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	m, ts := newTestManager(t)
+	ts.Close()
+
+	one := m.one
+	one.tcpRelay = &TCPRelay{nat: NewNat(10000, 10100)}
+	one.tcpRelay.nat.allocSession(net.ParseIP("10.0.0.2"), net.ParseIP("1.1.1.1"), 5000, 443)
+	one.tcpRelay.nat.allocSession(net.ParseIP("10.0.0.3"), net.ParseIP("1.1.1.1"), 5000, 443)
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.twitter.com.", dns.TypeA)
+	_, err := one.dns.doIPQuery(r, new(DnsQuery))
+	require.NoError(t, err)
+	r.SetQuestion("www.twitter.com.", dns.TypeAAAA)
+	_, err = one.dns.doIPQuery(r, new(DnsQuery))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		m.consumeData()
+		close(done)
+	}()
+	m.dataCh <- ConnData{Src: "10.0.0.2", Dst: "www.twitter.com", Proxy: "Proxy1", Upload: 10, Download: 100}
+	close(m.dataCh)
+	<-done
+	m.dialFailed("Proxy2")
+	m.dialFailed(`Pro"xy`)
+
+	rec := httptest.NewRecorder()
+	m.metricsHandle(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rec.Header().Get("Content-Type"), "version=0.0.4")
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE kone_proxy_upload_bytes_total counter",
+		`kone_proxy_upload_bytes_total{proxy="Proxy1"} 10`,
+		`kone_proxy_download_bytes_total{proxy="Proxy1"} 100`,
+		`kone_proxy_dial_failures_total{proxy="Proxy2"} 1`,
+		`kone_proxy_dial_failures_total{proxy="Pro\"xy"} 1`,
+		`kone_nat_mapped_entries{protocol="tcp"} 2`,
+		`kone_dns_queries_total{outcome="hijacked"} 2`,
+		`kone_dns_queries_total{outcome="failed"} 0`,
+		`kone_dns_ip_pool_used{family="ipv4"} 1`,
+		`kone_dns_ip_pool_used{family="ipv6"} 1`,
+		`kone_dns_ip_pool_capacity{family="ipv4"} 65535`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+
+	// released ips are not counted once they are not held
+	one.dnsTable.Clear()
+	one.dnsTable.releaseHeld(time.Now().Add(DnsDefaultTtl * time.Second))
+	b := bytes.NewBuffer(nil)
+	m.writeMetrics(b)
+	assert.Contains(t, b.String(), `kone_dns_ip_pool_used{family="ipv4"} 0`+"\n")
+}
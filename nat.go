@@ -7,6 +7,7 @@ package kone
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,17 +21,18 @@ type NatTable struct {
 	to   uint16
 
 	next   uint16 // next avaliable port
-	h2Port map[uint64]uint16
+	h2Port map[natAddr]uint16
 	mapped []bool
 }
 
-func hashAddr(ip net.IP, port uint16) uint64 {
-	v := uint64(ip[0]) << 40
-	v += uint64(ip[1]) << 32
-	v += uint64(ip[2]) << 24
-	v += uint64(ip[3]) << 16
-	v += uint64(port)
-	return v
+// IPv4 or IPv6 endpoint
+type natAddr struct {
+	ip   [net.IPv6len]byte
+	port uint16
+}
+
+func hashAddr(ip net.IP, port uint16) natAddr {
+	return natAddr{ip: [net.IPv6len]byte(ip.To16()), port: port}
 }
 
 func (tbl *NatTable) Unmap(ip net.IP, port uint16) {
@@ -87,6 +89,8 @@ type Nat struct {
 
 	checkThreshold int
 	lastCheck      int64
+
+	mapped atomic.Int64 // number of mapped sessions, readable from other goroutines
 }
 
 func (nat *Nat) getSession(port uint16) *NatSession {
@@ -117,6 +121,7 @@ func (nat *Nat) allocSession(srcIP, dstIP net.IP, srcPort, dstPort uint16) (bool
 			lastTouch: now,
 		}
 		nat.sessions[port-tbl.from] = session
+		nat.mapped.Add(1)
 	}
 	return isNew, port
 }
@@ -135,6 +140,7 @@ func (nat *Nat) clearExpiredSessions(now int64) {
 		if session != nil && now-session.lastTouch >= NatSessionLifeSeconds {
 			nat.sessions[index] = nil
 			nat.tbl.Unmap(session.srcIP, session.srcPort)
+			nat.mapped.Add(-1)
 		}
 	}
 }
@@ -143,6 +149,12 @@ func (nat *Nat) count() int {
 	return nat.tbl.Count()
 }
 
+// Mapped returns the number of mapped sessions, safe for concurrent use.
+// Idle sessions stay mapped until they are cleared by a later allocation.
+func (nat *Nat) Mapped() int64 {
+	return nat.mapped.Load()
+}
+
 // port range [from, to)
 func NewNat(from, to uint16) *Nat {
 	count := to - from
@@ -150,7 +162,7 @@ func NewNat(from, to uint16) *Nat {
 		from:   from,
 		to:     to,
 		next:   from,
-		h2Port: make(map[uint64]uint16, count),
+		h2Port: make(map[natAddr]uint16, count),
 		mapped: make([]bool, count),
 	}
 
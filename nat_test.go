@@ -77,3 +77,30 @@ func BenchmarkNat(b *testing.B) {
 		b.Error("release session failed")
 	}
 }
+
+func TestNatAllocIPv6(t *testing.T) {
+	nat := NewNat(10, 20)
+
+	srcIP := net.ParseIP("fd00::2")
+	dstIP := net.ParseIP("2001:db8::1")
+	srcIP4 := net.ParseIP("10.192.0.2")
+
+	isNew, port := nat.allocSession(srcIP, dstIP, 1000, 443)
+	if !isNew {
+		t.Error("alloc session failed")
+		return
+	}
+
+	// same port of another address family is a different session
+	isNew, port4 := nat.allocSession(srcIP4, dstIP, 1000, 443)
+	if !isNew || port4 == port {
+		t.Error("alloc ipv4 session failed")
+		return
+	}
+
+	session := nat.getSession(port)
+	if session == nil || !session.srcIP.Equal(srcIP) || !session.dstIP.Equal(dstIP) {
+		t.Error("check session failed")
+		return
+	}
+}
@@ -6,10 +6,16 @@
 package kone
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/op/go-logging"
+	"github.com/xjdrew/kone/geoip"
 	"github.com/xjdrew/kone/tcpip"
 )
 
@@ -22,28 +28,58 @@ type One struct {
 	// tun virtual network
 	subnet *net.IPNet
 
-	rule     *Rule
+	// tun ipv6 & virtual network, nil if IPv6 is disabled
+	ip6     net.IP
+	subnet6 *net.IPNet
+
+	current  atomic.Pointer[routing] // rule and proxies in use
 	dnsTable *DnsTable
-	proxies  *Proxies
+	conns    *ConnTable // active connections
 
 	dns      *Dns
 	tcpRelay *TCPRelay
 	udpRelay *UDPRelay
 	tun      *TunDriver
 	manager  *Manager
+
+	shutdownTimeout time.Duration
+
+	reloadLock sync.Mutex
+	cfg        *KoneConfig // config in use
 }
 
-func (one *One) Serve() {
+// rule and proxies are replaced together by reload, and read without lock. Load it once per
+// dns query or connection, so they are consistent.
+type routing struct {
+	rule    *Rule
+	proxies *Proxies
+}
+
+// routing returns rule and proxies in use
+func (one *One) routing() *routing {
+	return one.current.Load()
+}
+
+func (one *One) setRouting(rule *Rule, proxies *Proxies) {
+	one.current.Store(&routing{rule: rule, proxies: proxies})
+}
+
+// Serve runs until ctx is done or all services exit
+func (one *One) Serve(ctx context.Context) {
 	var wg sync.WaitGroup
 
 	runAndWait := func(f func() error) {
 		defer wg.Done()
-		err := f()
-		logger.Errorf("%v", err)
+		if err := f(); err != nil {
+			logger.Errorf("%v", err)
+		}
 	}
 
-	wg.Add(5)
+	rt := one.routing()
+	wg.Add(7)
 	go runAndWait(one.dnsTable.Serve)
+	go runAndWait(rt.rule.Serve)
+	go runAndWait(rt.proxies.Serve)
 	go runAndWait(one.dns.Serve)
 	go runAndWait(one.tcpRelay.Serve)
 	go runAndWait(one.udpRelay.Serve)
@@ -52,30 +88,303 @@ func (one *One) Serve() {
 		wg.Add(1)
 		go runAndWait(one.manager.Serve)
 	}
-	wg.Wait()
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if interval := one.Config().General.WatchConfig; interval > 0 {
+		go one.WatchConfig(watchCtx, time.Duration(interval)*time.Second)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		one.shutdown()
+		<-done
+	case <-done:
+	}
 }
 
-func (one *One) Reload(cfg *KoneConfig) error {
-	one.rule = NewRule(cfg.Rule)
+// stop services in order: stop accepting new traffic, drain tcp relays,
+// then remove routes and close tun, which carries packets of relays
+func (one *One) shutdown() {
+	logger.Infof("[one] shutting down, wait at most %v for connections to finish", one.shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), one.shutdownTimeout)
+	defer cancel()
+
+	if err := one.dns.Shutdown(ctx); err != nil {
+		logger.Warningf("[one] shutdown dns failed: %v", err)
+	}
+	if one.manager != nil {
+		if err := one.manager.Shutdown(ctx); err != nil {
+			logger.Warningf("[one] shutdown manager failed: %v", err)
+		}
+	}
+	one.udpRelay.Close()
+	one.tcpRelay.Shutdown(ctx)
+
+	one.tun.RemoveRoutes()
+	one.tun.Close()
+
+	rt := one.routing()
+	one.dnsTable.Close()
+	rt.rule.Close()
+	rt.proxies.Close()
+	logger.Infof("[one] shutdown")
+}
+
+// routes of IP-CIDR rules, which are output to tun
+func (one *One) ruleRoutes(rule *Rule) []*net.IPNet {
+	var routes []*net.IPNet
+	add := func(ipNet *net.IPNet) {
+		if ipNet.IP.To4() == nil && one.ip6 == nil {
+			logger.Warningf("[tun] ipv6 is disabled, ignore route %s", ipNet)
+			return
+		}
+		routes = append(routes, ipNet)
+	}
+	var collect func(patterns []Pattern)
+	collect = func(patterns []Pattern) {
+		for _, pattern := range patterns {
+			switch p := pattern.(type) {
+			case IPCIDRPattern:
+				add(p.ipNet)
+			case LogicalPattern:
+				for _, ipNet := range p.cidrs() {
+					add(ipNet)
+				}
+			case *RuleSet:
+				collect(p.Patterns())
+			}
+		}
+	}
+	collect(rule.patterns)
+	return routes
+}
+
+// proxy of a connection: proxy of its hijacked domain, or matched by flow if the domain is undecided
+// or the ip is routed by IP-CIDR rules. Like dns query, a domain is matched before its real ip.
+func (one *One) flowProxy(rule *Rule, flow *Flow, record *DomainRecord) string {
+	if record == nil {
+		return rule.Proxy(flow)
+	}
+	if !record.Undecided {
+		return record.Proxy
+	}
+
+	proxy := rule.Proxy(flow)
+	if proxy != PolicyDirect {
+		return proxy
+	}
+	ip, err := one.dns.RealIP(record)
+	if err != nil {
+		return proxy
+	}
+	byIP := *flow
+	byIP.Domain = ""
+	byIP.DstIP = ip
+	return rule.Proxy(&byIP)
+}
+
+// match record by rule the same way as dns query: its domain first, then its upstream answer
+func recordProxy(rule *Rule, record *DomainRecord) (proxy string, exact bool) {
+	proxy, exact = rule.Match(&Flow{Domain: record.Hostname})
+	if proxy == PolicyDirect && exact && record.answers != nil {
+		proxy, exact, _ = rule.MatchAnswer(record.answers)
+	}
+	return proxy, exact
+}
+
+// fake ip of a domain is proxied by its record, so drop records whose proxy changed
+func (one *One) invalidateDomains(rule *Rule) int {
 	one.dnsTable.ClearNonProxyDomain()
+	return one.dnsTable.Invalidate(func(record *DomainRecord) bool {
+		proxy, exact := recordProxy(rule, record)
+		return proxy != record.Proxy || exact == record.Undecided
+	})
+}
+
+// apply changes of rule sets of rule in use
+func (one *One) ruleSetUpdated(rule *Rule) {
+	one.reloadLock.Lock()
+	defer one.reloadLock.Unlock()
+
+	if rule != one.routing().rule { // replaced by reload
+		return
+	}
+	if one.tun != nil {
+		if err := one.tun.SetRoutes(one.ruleRoutes(rule)); err != nil {
+			logger.Errorf("[one] update routes of rule set failed: %v", err)
+		}
+	}
+	n := one.invalidateDomains(rule)
+	logger.Infof("[one] rule set updated, %d dns records invalidated", n)
+}
+
+func (one *One) Config() *KoneConfig {
+	one.reloadLock.Lock()
+	defer one.reloadLock.Unlock()
+	return one.cfg
+}
+
+// loadGeoIP loads geoip and asn databases of cfg, the database in use is kept if it fails,
+// which is the embedded table or none at startup
+func loadGeoIP(cfg *KoneConfig) {
+	if cfg.General.GeoIPDatabase == "" {
+		geoip.Reset()
+	} else {
+		path := cfg.path(cfg.General.GeoIPDatabase)
+		if err := geoip.Load(path); err != nil {
+			if current := geoip.Path(); current != "" {
+				logger.Errorf("[geoip] load %s failed, keep %s: %v", path, current, err)
+			} else {
+				logger.Errorf("[geoip] load %s failed, use embedded table: %v", path, err)
+			}
+		} else {
+			logger.Infof("[geoip] load %s", path)
+		}
+	}
+
+	if cfg.General.ASNDatabase == "" {
+		geoip.ResetASN()
+	} else {
+		path := cfg.path(cfg.General.ASNDatabase)
+		if err := geoip.LoadASN(path); err != nil {
+			logger.Errorf("[geoip] load asn %s failed: %v", path, err)
+		} else {
+			logger.Infof("[geoip] load asn %s", path)
+		}
+	}
+}
+
+// Reload applies rules, proxies, proxy groups, dns servers, hosts and geoip database of cfg; other options need a restart.
+// Nothing changes if cfg is invalid.
+func (one *One) Reload(cfg *KoneConfig) error {
+	one.reloadLock.Lock()
+	defer one.reloadLock.Unlock()
+
+	rule := NewRule(cfg.Rule)
+	proxies, err := NewProxies(rule, cfg.Proxy, cfg.ProxyGroup)
+	if err != nil {
+		return err
+	}
+	rule.LoadGeoSites(cfg)
+	rule.LoadRuleSets(cfg, func() { one.ruleSetUpdated(rule) })
+	if one.tun != nil {
+		if err := one.tun.SetRoutes(one.ruleRoutes(rule)); err != nil {
+			proxies.Close()
+			return err
+		}
+	}
+
+	loadGeoIP(cfg)
+	old := one.routing()
+	one.setRouting(rule, proxies)
+	one.dns.SetNameservers(cfg.Core.DnsServer)
+	one.dns.SetHosts(cfg.Host)
+	one.cfg = cfg
+
+	for _, serve := range []func() error{rule.Serve, proxies.Serve} {
+		go func(serve func() error) {
+			if err := serve(); err != nil {
+				logger.Errorf("%v", err)
+			}
+		}(serve)
+	}
+	old.rule.Close()
+	old.proxies.Close()
+
+	n := one.invalidateDomains(rule)
+	logger.Infof("[one] config reloaded, %d dns records invalidated", n)
 	return nil
 }
 
+// ReloadConfig reads config from its source again and reloads it
+func (one *One) ReloadConfig() error {
+	cfg, err := ParseConfig(one.Config().source)
+	if err != nil {
+		return err
+	}
+	return one.Reload(cfg)
+}
+
+// WatchConfig reloads config when its file is modified, it checks file every interval until ctx is done
+func (one *One) WatchConfig(ctx context.Context, interval time.Duration) error {
+	file, ok := one.Config().source.(string)
+	if !ok {
+		return fmt.Errorf("config is not from file")
+	}
+	modTime := func() time.Time {
+		info, err := os.Stat(file)
+		if err != nil {
+			logger.Warningf("[one] watch config: %v", err)
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	logger.Infof("[one] watch config %s every %v", file, interval)
+	last := modTime()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			mtime := modTime()
+			if mtime.IsZero() || mtime.Equal(last) {
+				continue
+			}
+			last = mtime
+			logger.Infof("[one] config %s changed, reload", file)
+			if err := one.ReloadConfig(); err != nil {
+				logger.Errorf("[one] reload config failed: %v", err)
+			}
+		}
+	}
+}
+
 func FromConfig(cfg *KoneConfig) (*One, error) {
 	ip, subnet, _ := net.ParseCIDR(cfg.Core.Network)
 
 	logger.Infof("[tun] ip:%s, subnet: %s", ip, subnet)
 
 	one := &One{
-		ip:     ip.To4(),
-		subnet: subnet,
+		ip:              ip.To4(),
+		subnet:          subnet,
+		shutdownTimeout: time.Duration(cfg.General.ShutdownTimeout) * time.Second,
+		cfg:             cfg,
+	}
+
+	if cfg.Core.Network6 != "" {
+		ip6, subnet6, err := net.ParseCIDR(cfg.Core.Network6)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("[tun] ip6:%s, subnet6: %s", ip6, subnet6)
+		one.ip6 = ip6
+		one.subnet6 = subnet6
 	}
 
+	loadGeoIP(cfg)
+
 	// new rule
-	one.rule = NewRule(cfg.Rule)
+	rule := NewRule(cfg.Rule)
+	one.setRouting(rule, nil)
+	rule.LoadGeoSites(cfg)
+	rule.LoadRuleSets(cfg, func() { one.ruleSetUpdated(rule) })
 
 	// new dns cache
-	one.dnsTable = NewDnsTable(ip, subnet)
+	one.dnsTable = NewDnsTable(ip, subnet, one.ip6, one.subnet6)
+
+	// active connections
+	one.conns = NewConnTable()
 
 	var err error
 
@@ -83,30 +392,40 @@ func FromConfig(cfg *KoneConfig) (*One, error) {
 	if one.dns, err = NewDns(one, cfg.Core); err != nil {
 		return nil, err
 	}
+	one.dns.SetHosts(cfg.Host)
+	if cfg.Core.DnsLogSize > 0 {
+		file := cfg.Core.DnsLogFile
+		if file != "" {
+			file = cfg.path(file)
+		}
+		if one.dns.log, err = NewDnsLog(int(cfg.Core.DnsLogSize), file, int64(cfg.General.LogMaxSize)<<20, int(cfg.General.LogMaxBackups)); err != nil {
+			return nil, err
+		}
+	}
 
-	if one.proxies, err = NewProxies(one, cfg.Proxy); err != nil {
+	proxies, err := NewProxies(rule, cfg.Proxy, cfg.ProxyGroup)
+	if err != nil {
 		return nil, err
 	}
+	one.setRouting(rule, proxies)
 
 	one.tcpRelay = NewTCPRelay(one, cfg.Core)
 	one.udpRelay = NewUDPRelay(one, cfg.Core)
 
 	filters := map[tcpip.IPProtocol]PacketFilter{
-		tcpip.ICMP: PacketFilterFunc(icmpFilterFunc),
-		tcpip.TCP:  one.tcpRelay,
-		tcpip.UDP:  one.udpRelay,
+		tcpip.ICMP:   PacketFilterFunc(icmpFilterFunc),
+		tcpip.ICMPv6: PacketFilterFunc(icmpv6FilterFunc),
+		tcpip.TCP:    one.tcpRelay,
+		tcpip.UDP:    one.udpRelay,
 	}
 
-	if one.tun, err = NewTunDriver(ip, subnet, filters); err != nil {
+	if one.tun, err = NewTunDriver(ip, subnet, one.ip6, one.subnet6, filters); err != nil {
 		return nil, err
 	}
 
 	// set tun as all IP-CIDR rule output
-	for _, pattern := range one.rule.patterns {
-		switch p := pattern.(type) {
-		case IPCIDRPattern:
-			one.tun.AddRoute(p.ipNet)
-		}
+	for _, ipNet := range one.ruleRoutes(rule) {
+		one.tun.AddRoute(ipNet)
 	}
 
 	// new manager
@@ -0,0 +1,230 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xjdrew/kone/geoip"
+)
+
+func TestDiffRoutes(t *testing.T) {
+	parse := func(cidrs ...string) []*net.IPNet {
+		var ipNets []*net.IPNet
+		for _, cidr := range cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			require.NoError(t, err)
+			ipNets = append(ipNets, ipNet)
+		}
+		return ipNets
+	}
+
+	added, removed := diffRoutes(
+		parse("91.108.4.0/22", "10.0.0.0/8"),
+		parse("10.0.0.0/8", "149.154.160.0/20", "149.154.160.0/20"),
+	)
+	assert.Equal(t, parse("149.154.160.0/20"), added)
+	assert.Equal(t, parse("91.108.4.0/22"), removed)
+
+	added, removed = diffRoutes(nil, nil)
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+}
+
+func TestDnsTableInvalidate(t *testing.T) {
+	d := newTestDns(nil)
+	table := d.one.dnsTable
+	google := table.Set("www.google.com", "Proxy1")
+	table.Set("www.twitter.com", "Proxy2")
+
+	n := table.Invalidate(func(record *DomainRecord) bool {
+		return record.Proxy == "Proxy2"
+	})
+	assert.Equal(t, 1, n)
+	assert.Nil(t, table.Get("www.twitter.com"))
+	assert.Equal(t, google, table.Get("www.google.com"))
+	assert.Equal(t, google, table.GetByIP(google.IP))
+}
+
+func TestReloadRollback(t *testing.T) {
+	rcs := []RuleConfig{
+		{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "Proxy1"},
+	}
+	d := newTestDns(rcs)
+	one := d.one
+	one.cfg = &KoneConfig{
+		Proxy: map[string]string{"Proxy1": "http://127.0.0.1:8080"},
+		Rule:  rcs,
+	}
+	setTestProxies(t, one, one.cfg.Proxy, nil)
+	record := one.dnsTable.Set("www.google.com", "Proxy1")
+
+	rt, cfg := one.routing(), one.cfg
+	err := one.Reload(&KoneConfig{
+		Proxy:      map[string]string{"Proxy1": "http://127.0.0.1:8080"},
+		ProxyGroup: map[string]string{"Proxy1": "fallback, Proxy1"},
+		Rule: []RuleConfig{
+			{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "Proxy2"},
+		},
+	})
+	assert.Error(t, err)
+	assert.Same(t, rt, one.routing())
+	assert.Same(t, cfg, one.Config())
+	assert.Equal(t, record, one.dnsTable.Get("www.google.com"))
+}
+
+func TestReload(t *testing.T) {
+	d := newTestDns([]RuleConfig{
+		{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "Proxy1"},
+		{Schema: "DOMAIN-SUFFIX", Pattern: "twitter.com", Proxy: "Proxy1"},
+	})
+	one := d.one
+	setTestProxies(t, one, map[string]string{"Proxy1": "http://127.0.0.1:8080"}, nil)
+	google := one.dnsTable.Set("www.google.com", "Proxy1")
+	one.dnsTable.Set("www.twitter.com", "Proxy1")
+	one.dnsTable.SetNonProxyDomain("www.example.com", 60)
+
+	require.NoError(t, one.Reload(&KoneConfig{
+		Core: CoreConfig{DnsServer: []string{"8.8.8.8", "1.1.1.1:5353"}},
+		Proxy: map[string]string{
+			"Proxy1": "http://127.0.0.1:8080",
+			"Proxy2": "socks5://127.0.0.1:1080",
+		},
+		ProxyGroup: map[string]string{"Group1": "fallback, Proxy1, Proxy2"},
+		Rule: []RuleConfig{
+			{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "Proxy1"},
+			{Schema: "DOMAIN-SUFFIX", Pattern: "twitter.com", Proxy: "Group1"},
+		},
+	}))
+	defer one.routing().proxies.Close()
+
+	rt := one.routing()
+	assert.Equal(t, []string{"8.8.8.8:53", "1.1.1.1:5353"}, one.dns.Nameservers())
+	assert.Equal(t, "Group1", rt.rule.Proxy("www.twitter.com"))
+	assert.Equal(t, PolicyDirect, rt.rule.Proxy("127.0.0.1"))
+	assert.NotNil(t, rt.proxies.groups["Group1"])
+
+	assert.Equal(t, google, one.dnsTable.Get("www.google.com"))
+	assert.Nil(t, one.dnsTable.Get("www.twitter.com"))
+	assert.False(t, one.dnsTable.IsNonProxyDomain("www.example.com"))
+}
+
+func TestReloadConcurrent(t *testing.T) {
+	cfg := &KoneConfig{
+		Proxy: map[string]string{"Proxy1": "http://127.0.0.1:8080"},
+		Rule:  []RuleConfig{{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "Proxy1"}},
+	}
+	d := newTestDns(cfg.Rule)
+	one := d.one
+	setTestProxies(t, one, cfg.Proxy, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, one.Reload(cfg))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		r := new(dns.Msg)
+		r.SetQuestion("www.google.com.", dns.TypeA)
+		_, err := d.doIPQuery(r, new(DnsQuery))
+		require.NoError(t, err)
+		assert.Equal(t, "Proxy1", one.flowProxy(one.routing().rule, &Flow{Domain: "mail.google.com"}, nil))
+	}
+	<-done
+	one.routing().proxies.Close()
+}
+
+func TestReloadAnswerRecords(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startTestDnsServer(t, &dns.Server{PacketConn: pc, Handler: testDnsHandler("91.108.4.1")})
+
+	cfg := &KoneConfig{
+		Core:  CoreConfig{DnsServer: []string{pc.LocalAddr().String()}},
+		Proxy: map[string]string{"Proxy1": "http://127.0.0.1:8080", "Proxy2": "http://127.0.0.1:8081"},
+		Rule:  []RuleConfig{{Schema: "IP-CIDR", Pattern: "91.108.4.0/22", Proxy: "Proxy1"}},
+	}
+	d := newTestDns(cfg.Rule)
+	one := d.one
+	setTestProxies(t, one, cfg.Proxy, nil)
+	d.SetNameservers(cfg.Core.DnsServer)
+
+	r := new(dns.Msg)
+	r.SetQuestion("t.me.", dns.TypeA)
+	_, err = d.doIPQuery(r, new(DnsQuery))
+	require.NoError(t, err)
+	record := one.dnsTable.Get("t.me")
+	require.NotNil(t, record)
+	assert.Equal(t, "Proxy1", record.Proxy)
+	assert.Equal(t, "91.108.4.1", record.RealIP.String())
+
+	// decided by ip, and the rule is not changed
+	require.NoError(t, one.Reload(cfg))
+	defer func() { one.routing().proxies.Close() }()
+	assert.Same(t, record, one.dnsTable.Get("t.me"))
+	assert.Same(t, record, one.dnsTable.GetByIP(record.IP))
+
+	// proxy of the ip is changed
+	cfg.Rule = []RuleConfig{{Schema: "IP-CIDR", Pattern: "91.108.4.0/22", Proxy: "Proxy2"}}
+	require.NoError(t, one.Reload(cfg))
+	assert.Nil(t, one.dnsTable.Get("t.me"))
+	assert.Nil(t, one.dnsTable.GetByIP(record.IP))
+
+	// released ip is held until answers cached by clients expire
+	used, _ := one.dnsTable.PoolUsage(false)
+	assert.Equal(t, 1, used)
+	renewed := one.dnsTable.Set("t.me", "Proxy2")
+	assert.False(t, renewed.IP.Equal(record.IP))
+	one.dnsTable.releaseHeld(record.Expires)
+	used, _ = one.dnsTable.PoolUsage(false)
+	assert.Equal(t, 1, used)
+}
+
+func TestReloadGeoIP(t *testing.T) {
+	defer geoip.Reset()
+	d := newTestDns(nil)
+	one := d.one
+	setTestProxies(t, one, nil, nil)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "country.txt"), []byte("2001:db8::,2001:db8::ffff,JP\n8.8.8.0,8.8.8.255,JP\n"), 0644))
+	cfg := &KoneConfig{
+		source:  filepath.Join(dir, "kone.ini"),
+		General: GeneralConfig{GeoIPDatabase: "country.txt"}, // relative to config file
+		Rule:    []RuleConfig{{Schema: "GEOIP", Pattern: "JP", Proxy: PolicyReject}},
+	}
+	require.NoError(t, one.Reload(cfg))
+	defer func() { one.routing().proxies.Close() }()
+	assert.Equal(t, filepath.Join(dir, "country.txt"), geoip.Path())
+	assert.Equal(t, PolicyReject, one.routing().rule.Proxy(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, PolicyReject, one.routing().rule.Proxy(net.ParseIP("8.8.8.8")))
+
+	// database in use is kept if it fails to load
+	cfg.General.GeoIPDatabase = "missing.mmdb"
+	require.NoError(t, one.Reload(cfg))
+	assert.Equal(t, filepath.Join(dir, "country.txt"), geoip.Path())
+
+	// fall back to the embedded table
+	cfg.General.GeoIPDatabase = ""
+	require.NoError(t, one.Reload(cfg))
+	assert.Equal(t, "", geoip.Path())
+	assert.Equal(t, PolicyDirect, one.routing().rule.Proxy(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, PolicyDirect, one.routing().rule.Proxy(net.ParseIP("8.8.8.8")))
+}
+
+func TestWatchConfigSource(t *testing.T) {
+	one := &One{cfg: &KoneConfig{source: []byte("[General]")}}
+	assert.Error(t, one.WatchConfig(context.Background(), 0))
+}
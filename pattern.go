@@ -6,11 +6,15 @@
 package kone
 
 import (
+	"fmt"
 	"net"
+	"os/user"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/xjdrew/kone/geoip"
-	"github.com/xjdrew/kone/tcpip"
 )
 
 type Pattern interface {
@@ -29,7 +33,7 @@ func (p DomainPattern) Proxy() string {
 }
 
 func (p DomainPattern) Match(val interface{}) bool {
-	v, ok := val.(string)
+	v, ok := domainOf(val)
 	if !ok {
 		return false
 	}
@@ -55,20 +59,25 @@ func (p DomainSuffixPattern) Proxy() string {
 	return p.proxy
 }
 
+// match the domain and its sub domains: twitter.com matches twitter.com and api.twitter.com, but not nottwitter.com
 func (p DomainSuffixPattern) Match(val interface{}) bool {
-	v, ok := val.(string)
+	v, ok := domainOf(val)
 	if !ok {
 		return false
 	}
 
 	v = strings.ToLower(v)
-	return strings.HasSuffix(v, p.suffix)
+	if !strings.HasSuffix(v, p.suffix) {
+		return false
+	}
+	return len(v) == len(p.suffix) || v[len(v)-len(p.suffix)-1] == '.'
 }
 
+// leading dots of suffix are ignored: .twitter.com is same as twitter.com
 func NewDomainSuffixPattern(proxy, suffix string) Pattern {
 	return DomainSuffixPattern{
 		proxy:  proxy,
-		suffix: strings.ToLower(suffix),
+		suffix: strings.TrimLeft(strings.ToLower(suffix), "."),
 	}
 }
 
@@ -83,7 +92,7 @@ func (p DomainKeywordPattern) Proxy() string {
 }
 
 func (p DomainKeywordPattern) Match(val interface{}) bool {
-	v, ok := val.(string)
+	v, ok := domainOf(val)
 	if !ok {
 		return false
 	}
@@ -98,6 +107,67 @@ func NewDomainKeywordPattern(proxy string, key string) Pattern {
 	}
 }
 
+// DOMAIN-WILDCARD
+type DomainWildcardPattern struct {
+	proxy   string
+	pattern string
+}
+
+func (p DomainWildcardPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p DomainWildcardPattern) Match(val interface{}) bool {
+	v, ok := domainOf(val)
+	if !ok {
+		return false
+	}
+	matched, _ := path.Match(p.pattern, strings.ToLower(v))
+	return matched
+}
+
+// pattern is a glob: * matches any characters, dots included; ? matches a single character
+func NewDomainWildcardPattern(proxy string, pattern string) (Pattern, error) {
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid wildcard %q", pattern)
+	}
+	return DomainWildcardPattern{
+		proxy:   proxy,
+		pattern: pattern,
+	}, nil
+}
+
+// DOMAIN-REGEX
+type DomainRegexPattern struct {
+	proxy string
+	re    *regexp.Regexp
+}
+
+func (p DomainRegexPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p DomainRegexPattern) Match(val interface{}) bool {
+	v, ok := domainOf(val)
+	if !ok {
+		return false
+	}
+	return p.re.MatchString(v)
+}
+
+// expr is matched case insensitively, it's not anchored
+func NewDomainRegexPattern(proxy string, expr string) (Pattern, error) {
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %v", expr, err)
+	}
+	return DomainRegexPattern{
+		proxy: proxy,
+		re:    re,
+	}, nil
+}
+
 // GEOIP
 type GEOIPPattern struct {
 	proxy   string
@@ -115,6 +185,10 @@ func (p GEOIPPattern) Match(val interface{}) bool {
 		country = geoip.QueryCountry(ip)
 	case net.IP:
 		country = geoip.QueryCountryByIP(ip)
+	case *Flow:
+		if ip.DstIP != nil {
+			country = geoip.QueryCountryByIP(ip.DstIP)
+		}
 	}
 
 	return p.country == country
@@ -127,6 +201,33 @@ func NewGEOIPPattern(proxy string, country string) Pattern {
 	}
 }
 
+// IP-ASN
+type IPASNPattern struct {
+	proxy string
+	asn   uint32
+}
+
+func (p IPASNPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p IPASNPattern) Match(val interface{}) bool {
+	ip, ok := ipOf(val)
+	return ok && geoip.QueryASN(ip) == p.asn
+}
+
+// asn is a number with optional prefix AS, such as 13335 or AS13335
+func NewIPASNPattern(proxy string, asn string) (Pattern, error) {
+	n, err := geoip.ParseASN(asn)
+	if err != nil {
+		return nil, err
+	}
+	return IPASNPattern{
+		proxy: proxy,
+		asn:   n,
+	}, nil
+}
+
 // IP-CIDR
 type IPCIDRPattern struct {
 	proxy string
@@ -138,14 +239,8 @@ func (p IPCIDRPattern) Proxy() string {
 }
 
 func (p IPCIDRPattern) Match(val interface{}) bool {
-	switch ip := val.(type) {
-	case net.IP:
-		return p.ipNet.Contains(ip)
-	case uint32:
-		return p.ipNet.Contains(tcpip.ConvertUint32ToIPv4(ip))
-	}
-
-	return false
+	ip, ok := ipOf(val)
+	return ok && p.ipNet.Contains(ip)
 }
 
 func NewIPCIDRPattern(proxy string, ipNet *net.IPNet) Pattern {
@@ -155,6 +250,59 @@ func NewIPCIDRPattern(proxy string, ipNet *net.IPNet) Pattern {
 	}
 }
 
+// PROCESS-NAME
+type ProcessNamePattern struct {
+	proxy string
+	name  string
+}
+
+func (p ProcessNamePattern) Proxy() string {
+	return p.proxy
+}
+
+func (p ProcessNamePattern) Match(val interface{}) bool {
+	proc, ok := val.(*Process)
+	return ok && proc.Name == p.name
+}
+
+func NewProcessNamePattern(proxy string, name string) Pattern {
+	return ProcessNamePattern{
+		proxy: proxy,
+		name:  name,
+	}
+}
+
+// UID
+type UIDPattern struct {
+	proxy string
+	uid   uint32
+}
+
+func (p UIDPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p UIDPattern) Match(val interface{}) bool {
+	proc, ok := val.(*Process)
+	return ok && proc.UID == p.uid
+}
+
+// uid is a number or a user name
+func NewUIDPattern(proxy string, uid string) (Pattern, error) {
+	n, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		u, lookupErr := user.Lookup(uid)
+		if lookupErr != nil {
+			return nil, fmt.Errorf("invalid uid %q", uid)
+		}
+		n, _ = strconv.ParseUint(u.Uid, 10, 32)
+	}
+	return UIDPattern{
+		proxy: proxy,
+		uid:   uint32(n),
+	}, nil
+}
+
 // FINAL
 type FinalPattern struct {
 	proxy string
@@ -172,34 +320,70 @@ func NewFinalPattern(proxy string) FinalPattern {
 	return FinalPattern{proxy: proxy}
 }
 
-func CreatePattern(rc RuleConfig) Pattern {
+// parsePattern returns nil pattern without error if rule needs no pattern
+func parsePattern(rc RuleConfig) (Pattern, error) {
 	proxy := rc.Proxy
 	pattern := rc.Pattern
 	schema := strings.ToUpper(rc.Schema)
 
 	switch schema {
 	case "DOMAIN":
-		return NewDomainPattern(proxy, pattern)
+		return NewDomainPattern(proxy, pattern), nil
 	case "DOMAIN-SUFFIX":
-		return NewDomainSuffixPattern(proxy, pattern)
+		return NewDomainSuffixPattern(proxy, pattern), nil
 	case "DOMAIN-KEYWORD":
-		return NewDomainKeywordPattern(proxy, pattern)
-	case "IP-CIDR":
-		fallthrough
-	case "IP-CIDR6":
-		if proxy == "DIRECT" { // all IPNet default proxy is DIRECT
+		return NewDomainKeywordPattern(proxy, pattern), nil
+	case "DOMAIN-WILDCARD":
+		return NewDomainWildcardPattern(proxy, pattern)
+	case "DOMAIN-REGEX":
+		return NewDomainRegexPattern(proxy, pattern)
+	case "IP-CIDR", "IP-CIDR6":
+		_, ipNet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", pattern)
+		}
+		if proxy == PolicyDirect { // all IPNet default proxy is DIRECT
 			logger.Debugf("skip DIRECT rule: %s,%s,%s", rc.Schema, rc.Pattern, rc.Proxy)
-			return nil
+			return nil, nil
 		}
+		return NewIPCIDRPattern(proxy, ipNet), nil
+	case "GEOIP":
+		return NewGEOIPPattern(proxy, pattern), nil
+	case "IP-ASN":
+		return NewIPASNPattern(proxy, pattern)
+	case "GEOSITE":
+		return NewGeoSitePattern(proxy, pattern)
+	case "SRC-IP-CIDR":
 		_, ipNet, err := net.ParseCIDR(pattern)
-		if err == nil {
-			return NewIPCIDRPattern(proxy, ipNet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", pattern)
 		}
-	case "GEOIP":
-		return NewGEOIPPattern(proxy, pattern)
+		return NewSrcIPCIDRPattern(proxy, ipNet), nil
+	case "DST-PORT":
+		return NewDstPortPattern(proxy, pattern)
+	case "NETWORK":
+		return NewNetworkPattern(proxy, pattern)
+	case "AND", "OR", "NOT":
+		return NewLogicalPattern(proxy, schema, pattern)
+	case "PROCESS-NAME":
+		return NewProcessNamePattern(proxy, pattern), nil
+	case "UID":
+		return NewUIDPattern(proxy, pattern)
 	case "FINAL":
-		return NewFinalPattern(proxy)
+		return NewFinalPattern(proxy), nil
+	case "RULE-SET":
+		if strings.Contains(pattern, "://") && !strings.HasPrefix(pattern, "http://") && !strings.HasPrefix(pattern, "https://") {
+			return nil, fmt.Errorf("unsupported rule set url %q", pattern)
+		}
+		return NewRuleSet(proxy, pattern), nil
+	}
+	return nil, fmt.Errorf("unknown schema %q", rc.Schema)
+}
+
+func CreatePattern(rc RuleConfig) Pattern {
+	pattern, err := parsePattern(rc)
+	if err != nil {
+		logger.Errorf("invalid rule: %s,%s,%s: %v", rc.Schema, rc.Pattern, rc.Proxy, err)
 	}
-	logger.Errorf("invalid rule: %s,%s,%s", rc.Schema, rc.Pattern, rc.Proxy)
-	return nil
+	return pattern
 }
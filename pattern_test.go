@@ -12,39 +12,79 @@ import (
 	"github.com/xjdrew/kone/tcpip"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestDomainPattern(t *testing.T) {
-	pattern := NewDomainPattern("A", "Example.com")
-	assert.Equal(t, "A", pattern.Proxy())
-	assert.True(t, pattern.Match("example.com"))
-	assert.True(t, pattern.Match("Example.Com"))      // case insensitive
-	assert.False(t, pattern.Match("api.example.com")) // suffix
-	assert.False(t, pattern.Match("1example.com"))
-	assert.False(t, pattern.Match("example.hk"))
-	assert.False(t, pattern.Match("example.com.hk"))
-}
+func TestDomainPatterns(t *testing.T) {
+	for _, c := range []struct {
+		schema  string
+		pattern string
+		domain  string
+		matched bool
+	}{
+		{"DOMAIN", "Example.com", "example.com", true},
+		{"DOMAIN", "Example.com", "Example.Com", true}, // case insensitive
+		{"DOMAIN", "Example.com", "api.example.com", false},
+		{"DOMAIN", "Example.com", "1example.com", false},
+		{"DOMAIN", "Example.com", "example.hk", false},
+		{"DOMAIN", "Example.com", "example.com.hk", false},
 
-func TestDomainSuffixPattern(t *testing.T) {
-	pattern := NewDomainSuffixPattern("A", "Example.com")
-	assert.Equal(t, "A", pattern.Proxy())
-	assert.True(t, pattern.Match("example.com"))
-	assert.True(t, pattern.Match("Example.Com"))     // case insensitive
-	assert.True(t, pattern.Match("api.example.com")) // suffix
-	assert.True(t, pattern.Match("1example.com"))
-	assert.False(t, pattern.Match("example.hk"))
-	assert.False(t, pattern.Match("example.com.hk"))
+		{"DOMAIN-SUFFIX", "Example.com", "example.com", true},
+		{"DOMAIN-SUFFIX", "Example.com", "Example.Com", true},
+		{"DOMAIN-SUFFIX", "Example.com", "api.example.com", true},
+		{"DOMAIN-SUFFIX", "Example.com", "a.b.example.com", true},
+		{"DOMAIN-SUFFIX", "Example.com", "1example.com", false}, // label boundary
+		{"DOMAIN-SUFFIX", "Example.com", "api.1example.com", false},
+		{"DOMAIN-SUFFIX", "Example.com", "example.hk", false},
+		{"DOMAIN-SUFFIX", "Example.com", "example.com.hk", false},
+		{"DOMAIN-SUFFIX", "Example.com", "com", false},
+		{"DOMAIN-SUFFIX", ".twitter.com", "twitter.com", true}, // leading dot is ignored
+		{"DOMAIN-SUFFIX", ".twitter.com", "api.twitter.com", true},
+		{"DOMAIN-SUFFIX", "twitter.com", "nottwitter.com", false},
+		{"DOMAIN-SUFFIX", "com", "example.com", true},
+
+		{"DOMAIN-KEYWORD", "Example.com", "example.com", true},
+		{"DOMAIN-KEYWORD", "Example.com", "Example.Com", true},
+		{"DOMAIN-KEYWORD", "Example.com", "api.example.com", true},
+		{"DOMAIN-KEYWORD", "Example.com", "1example.com", true},
+		{"DOMAIN-KEYWORD", "Example.com", "example.hk", false},
+		{"DOMAIN-KEYWORD", "Example.com", "example.com.hk", true},
+
+		{"DOMAIN-WILDCARD", "*.Example.com", "api.example.com", true},
+		{"DOMAIN-WILDCARD", "*.Example.com", "a.b.example.com", true}, // * matches dots
+		{"DOMAIN-WILDCARD", "*.Example.com", "example.com", false},
+		{"DOMAIN-WILDCARD", "*.Example.com", "1example.com", false},
+		{"DOMAIN-WILDCARD", "img?.example.com", "img1.example.com", true},
+		{"DOMAIN-WILDCARD", "img?.example.com", "img12.example.com", false},
+		{"DOMAIN-WILDCARD", "ad*.example.*", "ads.example.co.uk", true},
+		{"DOMAIN-WILDCARD", "ad*.example.*", "api.example.com", false},
+
+		{"DOMAIN-REGEX", `^ad[0-9]{1,3}\.example\.com$`, "ad12.example.com", true},
+		{"DOMAIN-REGEX", `^ad[0-9]{1,3}\.example\.com$`, "AD12.Example.com", true}, // case insensitive
+		{"DOMAIN-REGEX", `^ad[0-9]{1,3}\.example\.com$`, "ad1234.example.com", false},
+		{"DOMAIN-REGEX", `^ad[0-9]{1,3}\.example\.com$`, "x.ad12.example.com", false},
+		{"DOMAIN-REGEX", `tracker`, "www.tracker.net", true}, // not anchored
+	} {
+		pattern, err := parsePattern(RuleConfig{Schema: c.schema, Pattern: c.pattern, Proxy: "A"})
+		require.NoError(t, err)
+		assert.Equal(t, "A", pattern.Proxy())
+		assert.Equal(t, c.matched, pattern.Match(c.domain), "%s,%s match %s", c.schema, c.pattern, c.domain)
+		assert.False(t, pattern.Match(net.ParseIP("1.1.1.1")), "%s,%s match ip", c.schema, c.pattern)
+	}
 }
 
-func TestDomainKeywordPattern(t *testing.T) {
-	pattern := NewDomainKeywordPattern("A", "Example.com")
-	assert.Equal(t, "A", pattern.Proxy())
-	assert.True(t, pattern.Match("example.com"))
-	assert.True(t, pattern.Match("Example.Com"))     // case insensitive
-	assert.True(t, pattern.Match("api.example.com")) // suffix
-	assert.True(t, pattern.Match("1example.com"))
-	assert.False(t, pattern.Match("example.hk"))
-	assert.True(t, pattern.Match("example.com.hk"))
+func TestInvalidPatterns(t *testing.T) {
+	for _, rc := range []RuleConfig{
+		{Schema: "DOMAIN-WILDCARD", Pattern: "[a-", Proxy: "A"},
+		{Schema: "DOMAIN-REGEX", Pattern: "(ad", Proxy: "A"},
+		{Schema: "IP-CIDR", Pattern: "10.0.0.0/33", Proxy: "A"},
+		{Schema: "DOMAIN-SUFIX", Pattern: "example.com", Proxy: "A"},
+		{Schema: "RULE-SET", Pattern: "ftp://example.com/a.list", Proxy: "A"},
+		{Schema: "UID", Pattern: "no-such-user-kone", Proxy: "A"},
+	} {
+		_, err := parsePattern(rc)
+		assert.Error(t, err, "%s,%s", rc.Schema, rc.Pattern)
+	}
 }
 
 func TestIPCountryPattern(t *testing.T) {
@@ -67,3 +107,40 @@ func TestIPCIDRPattern(t *testing.T) {
 	assert.True(t, pattern.Match(tcpip.ConvertIPv4ToUint32(net.ParseIP("192.168.255.255"))))
 	assert.True(t, pattern.Match(tcpip.ConvertIPv4ToUint32(net.ParseIP("192.168.108.255"))))
 }
+
+func TestProcessPatterns(t *testing.T) {
+	curl := &Process{Pid: 100, Name: "curl", UID: 1000}
+
+	assert.True(t, NewProcessNamePattern("A", "curl").Match(curl))
+	assert.False(t, NewProcessNamePattern("A", "wget").Match(curl))
+	assert.False(t, NewProcessNamePattern("A", "curl").Match("curl")) // domain is not a process
+
+	pattern, err := NewUIDPattern("A", "1000")
+	require.NoError(t, err)
+	assert.True(t, pattern.Match(curl))
+	assert.False(t, pattern.Match(&Process{UID: 0}))
+
+	pattern, err = NewUIDPattern("A", "root")
+	require.NoError(t, err)
+	assert.True(t, pattern.Match(&Process{UID: 0}))
+
+	// process rules take precedence, and FINAL never matches a process
+	rule := NewRule([]RuleConfig{
+		{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "A"},
+		{Schema: "PROCESS-NAME", Pattern: "curl", Proxy: PolicyDirect},
+		{Schema: "UID", Pattern: "0", Proxy: PolicyReject},
+		{Schema: "FINAL", Proxy: "B"},
+	})
+	assert.True(t, rule.HasProcessRules())
+	proxy, ok := rule.ProcessProxy(curl)
+	assert.True(t, ok)
+	assert.Equal(t, PolicyDirect, proxy)
+	proxy, ok = rule.ProcessProxy(&Process{Name: "sshd", UID: 0})
+	assert.True(t, ok)
+	assert.Equal(t, PolicyReject, proxy)
+	_, ok = rule.ProcessProxy(&Process{Name: "wget", UID: 1000})
+	assert.False(t, ok)
+	assert.Equal(t, "A", rule.Proxy("www.google.com"))
+
+	assert.False(t, NewRule([]RuleConfig{{Schema: "FINAL", Proxy: "B"}}).HasProcessRules())
+}
@@ -0,0 +1,74 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"errors"
+	"net"
+)
+
+var errProcessUnsupported = errors.New("process lookup is not supported on this platform")
+
+// Process is the local process which owns a socket
+type Process struct {
+	Pid  int
+	Name string // executable name
+	UID  uint32
+}
+
+// test whether ip is an address of local interfaces
+func isLocalAddr(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// findProcess finds the local process which sends traffic of session, nil if not found.
+// Traffic forwarded from other hosts has no local process.
+func findProcess(network string, session *NatSession) *Process {
+	if !isLocalAddr(session.srcIP) {
+		return nil
+	}
+	proc, err := FindProcess(network, session.srcIP, session.srcPort, session.dstIP, session.dstPort)
+	if err != nil {
+		logger.Debugf("[process] find %s %s:%d failed: %v", network, session.srcIP, session.srcPort, err)
+		return nil
+	}
+	return proc
+}
+
+// lookupProcess finds the local process of session for process rules of rule. Finding a process
+// scans /proc, so it's skipped if there is no process rule, and nil is returned.
+func (one *One) lookupProcess(rule *Rule, network string, session *NatSession) *Process {
+	if !rule.HasProcessRules() {
+		return nil
+	}
+	return findProcess(network, session)
+}
+
+// labelProcess sets process of active connection c, which is shown by manager. If the process isn't
+// looked up by process rules, it's found in background, so connections are not delayed.
+func (one *One) labelProcess(c *activeConn, rule *Rule, process string, network string, session *NatSession) {
+	if process != "" {
+		c.setProcess(process)
+		return
+	}
+	if one.manager == nil || rule.HasProcessRules() { // not needed, or not found
+		return
+	}
+	go func() {
+		if proc := findProcess(network, session); proc != nil {
+			c.setProcess(proc.Name)
+		}
+	}()
+}
@@ -0,0 +1,153 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var procRoot = "/proc"
+
+// parse address of /proc/net/{tcp,udp}[6]: hex of ip in host byte order by 32-bit words, and hex of port
+func parseProcNetAddr(s string) (net.IP, uint16, error) {
+	host, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	b, err := hex.DecodeString(host)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	n, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.NativeEndian.Uint32(b[i:]))
+	}
+	return ip, uint16(n), nil
+}
+
+const procNetStateListen = "0A" // TCP_LISTEN
+
+// find socket of ip:port connected to remoteIP:remotePort in a /proc/net table, a socket bound to
+// unspecified address matches any ip. Listening sockets are skipped. An unconnected socket bound to
+// ip:port, such as udp socket sending by sendto, is found if no connected one matches.
+func findProcNetSocket(r io.Reader, ip net.IP, port uint16, remoteIP net.IP, remotePort uint16) (uid uint32, inode uint64, found bool) {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // skip header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] == procNetStateListen {
+			continue
+		}
+		localIP, localPort, err := parseProcNetAddr(fields[1])
+		if err != nil || localPort != port {
+			continue
+		}
+		if !localIP.Equal(ip) && !localIP.IsUnspecified() {
+			continue
+		}
+		remIP, remPort, err := parseProcNetAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		connected := remPort != 0 || !remIP.IsUnspecified()
+		if connected && (remPort != remotePort || !remIP.Equal(remoteIP)) {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[7], 10, 32)
+		if err != nil {
+			continue
+		}
+		node, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || node == 0 { // inode is 0 if socket is in TIME_WAIT
+			continue
+		}
+		if connected {
+			return uint32(n), node, true
+		}
+		if !found {
+			uid, inode, found = uint32(n), node, true
+		}
+	}
+	return uid, inode, found
+}
+
+// find pid of process holds the socket inode
+func findSocketOwner(inode uint64) (int, error) {
+	target := fmt.Sprintf("socket:[%d]", inode)
+	procs, err := os.ReadDir(procRoot)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(procRoot, p.Name(), "fd")
+		fds, err := os.ReadDir(dir)
+		if err != nil { // process exited, or permission denied
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(dir, fd.Name())); err == nil && link == target {
+				return pid, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no owner of socket %d", inode)
+}
+
+// name of executable, or command name if executable is not readable
+func processName(pid int) string {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		return filepath.Base(strings.TrimSuffix(exe, " (deleted)"))
+	}
+	comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+	return strings.TrimSpace(string(comm))
+}
+
+// FindProcess finds the local process which owns the socket of ip:port connected to remoteIP:remotePort
+func FindProcess(network string, ip net.IP, port uint16, remoteIP net.IP, remotePort uint16) (*Process, error) {
+	tables := []string{network, network + "6"} // ipv4 socket may be in table of ipv6 as mapped address
+	if ip.To4() == nil {
+		tables = tables[1:]
+	}
+
+	for _, table := range tables {
+		f, err := os.Open(filepath.Join(procRoot, "net", table))
+		if err != nil {
+			continue
+		}
+		uid, inode, found := findProcNetSocket(f, ip, port, remoteIP, remotePort)
+		f.Close()
+		if !found {
+			continue
+		}
+
+		pid, err := findSocketOwner(inode)
+		if err != nil {
+			return nil, err
+		}
+		return &Process{Pid: pid, Name: processName(pid), UID: uid}, nil
+	}
+	return nil, fmt.Errorf("no socket bound to %s", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+}
@@ -0,0 +1,93 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindProcNetSocket(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("sample is of little endian host")
+	}
+
+	data := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000   118        0 23456 1 0000000000000000 100 0 0 10 0
+   1: 0100C00A:C350 0200C00A:01BB 01 00000000:00000000 00:00000000 00000000  1000        0 34567 1 0000000000000000 20 4 30 10 -1
+   2: 0100C00A:C351 0200C00A:01BB 06 00000000:00000000 03:00001660 00000000     0        0 0 3 0000000000000000
+   3: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 45678 2 0000000000000000 0
+`
+	for _, c := range []struct {
+		ip         string
+		port       uint16
+		remoteIP   string
+		remotePort uint16
+		uid        uint32
+		inode      uint64
+		found      bool
+	}{
+		{"127.0.0.1", 3306, "127.0.0.1", 40000, 0, 0, false}, // LISTEN
+		{"10.192.0.1", 50000, "10.192.0.2", 443, 1000, 34567, true},
+		{"10.192.0.1", 50000, "10.192.0.3", 443, 0, 0, false}, // connected to another remote
+		{"10.192.0.1", 50001, "10.192.0.2", 443, 0, 0, false}, // TIME_WAIT
+		{"10.192.0.1", 53, "10.192.0.9", 53, 0, 45678, true},  // unconnected, bound to 0.0.0.0
+		{"10.192.0.1", 3306, "10.192.0.2", 3306, 0, 0, false},
+	} {
+		uid, inode, found := findProcNetSocket(strings.NewReader(data), net.ParseIP(c.ip), c.port, net.ParseIP(c.remoteIP), c.remotePort)
+		assert.Equal(t, c.found, found, "%s:%d", c.ip, c.port)
+		assert.Equal(t, c.uid, uid, "%s:%d", c.ip, c.port)
+		assert.Equal(t, c.inode, inode, "%s:%d", c.ip, c.port)
+	}
+
+	ip, port, err := parseProcNetAddr("00000000000000000000000001000000:0016")
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv6loopback, ip)
+	assert.Equal(t, uint16(22), port)
+
+	_, _, err = parseProcNetAddr("0100007F")
+	assert.Error(t, err)
+}
+
+func TestFindProcess(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("no procfs")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	proc, err := FindProcess("tcp", local.IP, uint16(local.Port), remote.IP, uint16(remote.Port))
+	require.NoError(t, err)
+	exe, _ := os.Executable()
+	assert.Equal(t, os.Getpid(), proc.Pid)
+	assert.Equal(t, filepath.Base(exe), proc.Name)
+	assert.Equal(t, uint32(os.Getuid()), proc.UID)
+
+	_, err = FindProcess("udp", local.IP, uint16(local.Port), remote.IP, uint16(remote.Port))
+	assert.Error(t, err)
+	_, err = FindProcess("tcp", local.IP, uint16(local.Port), net.ParseIP("10.192.0.2"), 443)
+	assert.Error(t, err)
+
+	// traffic from other hosts has no local process
+	session := &NatSession{srcIP: local.IP, srcPort: uint16(local.Port), dstIP: remote.IP, dstPort: uint16(remote.Port)}
+	assert.NotNil(t, findProcess("tcp", session))
+	session.srcIP = net.ParseIP("192.0.2.10")
+	assert.Nil(t, findProcess("tcp", session))
+}
@@ -0,0 +1,16 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+//go:build !linux
+// +build !linux
+
+package kone
+
+import "net"
+
+// FindProcess is only supported on linux
+func FindProcess(network string, ip net.IP, port uint16, remoteIP net.IP, remotePort uint16) (*Process, error) {
+	return nil, errProcessUnsupported
+}
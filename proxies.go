@@ -15,6 +15,7 @@ import (
 
 type Proxies struct {
 	proxies map[string]*proxy.Proxy
+	groups  map[string]*ProxyGroup
 }
 
 func (p *Proxies) Dial(pname string, addr string) (net.Conn, error) {
@@ -23,30 +24,150 @@ func (p *Proxies) Dial(pname string, addr string) (net.Conn, error) {
 	if dialer != nil {
 		return dialer.Dial("tcp", addr)
 	}
+	if group := p.groups[pname]; group != nil {
+		return group.Dial(addr)
+	}
+	return nil, fmt.Errorf("no proxy: %s", pname)
+}
+
+func (p *Proxies) DialPacket(pname string, addr string) (net.Conn, error) {
+	logger.Debugf("[proxy] dail packet host %s by proxy %s", addr, pname)
+	dialer := p.proxies[pname]
+	if dialer != nil {
+		return dialer.DialPacket("udp", addr)
+	}
+	if group := p.groups[pname]; group != nil {
+		return group.DialPacket(addr)
+	}
 	return nil, fmt.Errorf("no proxy: %s", pname)
 }
 
-func NewProxies(one *One, config map[string]string) (*Proxies, error) {
+// health check proxy groups
+func (p *Proxies) Serve() error {
+	errCh := make(chan error, len(p.groups))
+	for _, group := range p.groups {
+		go func(group *ProxyGroup) {
+			errCh <- group.Serve()
+		}(group)
+	}
+
+	for range p.groups {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop health check
+func (p *Proxies) Close() error {
+	for _, group := range p.groups {
+		group.Close()
+	}
+	return nil
+}
+
+// a hop of proxy chain, annotates dial error with its name
+type hopDialer struct {
+	name   string
+	dialer proxy.Dialer
+}
+
+func (h *hopDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := h.dialer.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("via %s: %w", h.name, err)
+	}
+	return conn, nil
+}
+
+// parse proxy config: "url" or "url via name"
+func parseProxyConfig(value string) (rawurl string, via string) {
+	fields := strings.Fields(value)
+	if len(fields) == 3 && strings.EqualFold(fields[1], "via") {
+		return fields[0], fields[2]
+	}
+	return strings.TrimSpace(value), ""
+}
+
+func NewProxies(rule *Rule, config map[string]string, groupConfig map[string]string) (*Proxies, error) {
 	p := &Proxies{}
 
 	proxies := make(map[string]*proxy.Proxy)
-	for pname, url := range config {
-		proxy, err := proxy.FromUrl(url)
+
+	// build proxy and the chain it goes through
+	var chain []string
+	var build func(pname string) (*proxy.Proxy, error)
+	build = func(pname string) (*proxy.Proxy, error) {
+		if dialer, ok := proxies[pname]; ok {
+			return dialer, nil
+		}
+
+		for i, name := range chain {
+			if name == pname {
+				return nil, fmt.Errorf("proxy chain has cycle: %s -> %s", strings.Join(chain[i:], " -> "), pname)
+			}
+		}
+
+		value, ok := config[pname]
+		if !ok {
+			return nil, fmt.Errorf("no proxy: %s", pname)
+		}
+
+		chain = append(chain, pname)
+		defer func() { chain = chain[:len(chain)-1] }()
+
+		url, via := parseProxyConfig(value)
+
+		var forward proxy.Dialer = proxy.Direct
+		if via != "" && via != PolicyDirect {
+			hop, err := build(via)
+			if err != nil {
+				return nil, fmt.Errorf("proxy %s: %w", pname, err)
+			}
+			forward = &hopDialer{name: via, dialer: hop}
+		}
+
+		dialer, err := proxy.FromUrlVia(url, forward)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("proxy %s: %w", pname, err)
 		}
 
-		logger.Debugf("[proxy] add proxy %s = %s", pname, url)
-		proxies[pname] = proxy
+		if via != "" {
+			logger.Debugf("[proxy] add proxy %s = %s via %s", pname, url, via)
+		} else {
+			logger.Debugf("[proxy] add proxy %s = %s", pname, url)
+		}
+		proxies[pname] = dialer
 
 		// don't hijack proxy domain
-		host := proxy.Url.Host
-		index := strings.IndexByte(proxy.Url.Host, ':')
+		host := dialer.Url.Host
+		index := strings.IndexByte(dialer.Url.Host, ':')
 		if index > 0 {
-			host = proxy.Url.Host[:index]
+			host = dialer.Url.Host[:index]
+		}
+		rule.DirectDomain(host)
+		return dialer, nil
+	}
+
+	for pname := range config {
+		if _, err := build(pname); err != nil {
+			return nil, err
 		}
-		one.rule.DirectDomain(host)
 	}
 	p.proxies = proxies
+
+	p.groups = make(map[string]*ProxyGroup)
+	for name, value := range groupConfig {
+		if _, ok := proxies[name]; ok {
+			return nil, fmt.Errorf("group %s: conflict with proxy name", name)
+		}
+		group, err := NewProxyGroup(name, value, proxies)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("[proxy] add group %s = %s", name, value)
+		p.groups[name] = group
+	}
 	return p, nil
 }
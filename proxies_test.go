@@ -0,0 +1,128 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a minimal http CONNECT proxy, records every target it connects to
+func serveConnect(t *testing.T, targets chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				targets <- req.Host
+				remote, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer remote.Close()
+				conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+				go io.Copy(remote, conn)
+				io.Copy(conn, remote)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestProxyChain(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	targets := make(chan string, 4)
+	first := serveConnect(t, targets)
+	defer first.Close()
+	second := serveConnect(t, targets)
+	defer second.Close()
+
+	rule := NewRule(nil)
+	proxies, err := NewProxies(rule, map[string]string{
+		"Proxy1": "http://" + first.Addr().String(),
+		"Proxy2": "http://" + second.Addr().String() + " via Proxy1",
+	}, nil)
+	require.NoError(t, err)
+
+	conn, err := proxies.Dial("Proxy2", echo.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// first hop connects to second hop, second hop connects to target
+	assert.Equal(t, second.Addr().String(), <-targets)
+	assert.Equal(t, echo.Addr().String(), <-targets)
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte("kone"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "kone", string(b))
+}
+
+func TestProxyChainError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := ln.Addr().String()
+	ln.Close()
+
+	rule := NewRule(nil)
+
+	// cycle
+	_, err = NewProxies(rule, map[string]string{
+		"Proxy1": "http://127.0.0.1:8080 via Proxy3",
+		"Proxy2": "socks5://127.0.0.1:1080 via Proxy1",
+		"Proxy3": "http://127.0.0.1:8081 via Proxy2",
+	}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cycle")
+
+	// undefined hop
+	_, err = NewProxies(rule, map[string]string{
+		"Proxy1": "http://127.0.0.1:8080 via Proxy9",
+	}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no proxy: Proxy9")
+
+	// dial error tells which hop fails
+	proxies, err := NewProxies(rule, map[string]string{
+		"Proxy1": "http://" + closed,
+		"Proxy2": "socks5://127.0.0.1:1080 via Proxy1",
+	}, nil)
+	require.NoError(t, err)
+	_, err = proxies.Dial("Proxy2", "example.com:443")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "via Proxy1")
+}
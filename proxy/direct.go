@@ -12,3 +12,7 @@ var Direct = direct{}
 func (direct) Dial(network, addr string) (net.Conn, error) {
 	return net.Dial(network, addr)
 }
+
+func (direct) DialPacket(network, addr string) (net.Conn, error) {
+	return net.Dial(network, addr)
+}
@@ -17,6 +17,14 @@ type Dialer interface {
 	Dial(network, addr string) (c net.Conn, err error)
 }
 
+// A PacketDialer is a means to establish a packet-oriented connection,
+// such as udp through SOCKS5 UDP ASSOCIATE.
+type PacketDialer interface {
+	// DialPacket connects to the given address via the proxy. The returned
+	// connection reads and writes whole datagrams.
+	DialPacket(network, addr string) (c net.Conn, err error)
+}
+
 // proxySchemes is a map from URL schemes to a function that creates a Dialer
 // from a URL with such a scheme.
 var proxySchemes = make(map[string]func(*url.URL, Dialer) (Dialer, error))
@@ -44,13 +52,28 @@ func (p *Proxy) Dial(network, addr string) (net.Conn, error) {
 	return p.dialer.Dial(network, addr)
 }
 
+// DialPacket connects to addr with a packet-oriented connection,
+// if the proxy supports it.
+func (p *Proxy) DialPacket(network, addr string) (net.Conn, error) {
+	if d, ok := p.dialer.(PacketDialer); ok {
+		return d.DialPacket(network, addr)
+	}
+	return nil, errors.New("proxy: no support for packet connections of scheme " + p.Url.Scheme)
+}
+
 func FromUrl(rawurl string) (*Proxy, error) {
+	return FromUrlVia(rawurl, Direct)
+}
+
+// FromUrlVia is like FromUrl, but connects to the proxy server through forward,
+// which builds a proxy chain.
+func FromUrlVia(rawurl string, forward Dialer) (*Proxy, error) {
 	u, err := url.Parse(rawurl)
 	if err != nil {
 		return nil, err
 	}
 
-	dailer, err := getDialerByURL(u, Direct)
+	dailer, err := getDialerByURL(u, forward)
 	if err != nil {
 		return nil, err
 	}
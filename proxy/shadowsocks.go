@@ -0,0 +1,351 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// shadowsocks AEAD protocol: https://shadowsocks.org/doc/aead.html
+
+const (
+	ssMaxPayload = 0x3fff // max payload size of a tcp chunk
+	ssTagSize    = 16     // all supported ciphers use a 16 bytes tag
+)
+
+var ssSubkeyInfo = []byte("ss-subkey")
+
+type ssCipher struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var ssCiphers = map[string]ssCipher{
+	"aes-128-gcm":            {16, newAESGCM},
+	"aes-192-gcm":            {24, newAESGCM},
+	"aes-256-gcm":            {32, newAESGCM},
+	"chacha20-ietf-poly1305": {32, chacha20poly1305.New},
+}
+
+// ssKDF derives master key from password, the same as OpenSSL EVP_BytesToKey with MD5
+func ssKDF(password string, keySize int) []byte {
+	var b, prev []byte
+	h := md5.New()
+	for len(b) < keySize {
+		h.Write(prev)
+		h.Write([]byte(password))
+		b = h.Sum(b)
+		prev = b[len(b)-h.Size():]
+		h.Reset()
+	}
+	return b[:keySize]
+}
+
+// ssAEAD creates the session cipher by salt
+func (c ssCipher) ssAEAD(key, salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.keySize)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, key, salt, ssSubkeyInfo), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// increase nonce as a little-endian unsigned integer
+func ssIncrease(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// ssConn is a shadowsocks AEAD stream over conn, usable in both client and server side
+type ssConn struct {
+	net.Conn
+	cipher ssCipher
+	key    []byte
+
+	enc      cipher.AEAD
+	encNonce []byte
+	dec      cipher.AEAD
+	decNonce []byte
+	leftover []byte // decrypted but unread payload
+}
+
+func (c *ssConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		salt := make([]byte, c.cipher.keySize)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		enc, err := c.cipher.ssAEAD(c.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.Conn.Write(salt); err != nil {
+			return 0, err
+		}
+		c.enc = enc
+		c.encNonce = make([]byte, enc.NonceSize())
+	}
+
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > ssMaxPayload {
+			n = ssMaxPayload
+		}
+
+		// [encrypted length][length tag][encrypted payload][payload tag]
+		buf := make([]byte, 0, 2+ssTagSize+n+ssTagSize)
+		buf = c.enc.Seal(buf, c.encNonce, []byte{byte(n >> 8), byte(n)}, nil)
+		ssIncrease(c.encNonce)
+		buf = c.enc.Seal(buf, c.encNonce, b[:n], nil)
+		ssIncrease(c.encNonce)
+
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *ssConn) Read(b []byte) (int, error) {
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+
+	if c.dec == nil {
+		salt := make([]byte, c.cipher.keySize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		dec, err := c.cipher.ssAEAD(c.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		c.dec = dec
+		c.decNonce = make([]byte, dec.NonceSize())
+	}
+
+	buf := make([]byte, 2+ssTagSize)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	if _, err := c.dec.Open(buf[:0], c.decNonce, buf, nil); err != nil {
+		return 0, errors.New("proxy: shadowsocks decrypt length failed: " + err.Error())
+	}
+	ssIncrease(c.decNonce)
+
+	size := (int(buf[0])<<8 | int(buf[1])) & ssMaxPayload
+	buf = make([]byte, size+ssTagSize)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	payload, err := c.dec.Open(buf[:0], c.decNonce, buf, nil)
+	if err != nil {
+		return 0, errors.New("proxy: shadowsocks decrypt payload failed: " + err.Error())
+	}
+	ssIncrease(c.decNonce)
+
+	n := copy(b, payload)
+	c.leftover = payload[n:]
+	return n, nil
+}
+
+// ssPacketConn is a shadowsocks AEAD udp connection to a fixed target
+type ssPacketConn struct {
+	net.Conn
+	cipher ssCipher
+	key    []byte
+	target []byte // target address in SOCKS5 format
+}
+
+func (c *ssPacketConn) Write(b []byte) (int, error) {
+	// [salt][encrypted payload][tag], payload is [target address][data]
+	salt := make([]byte, c.cipher.keySize)
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.cipher.ssAEAD(c.key, salt)
+	if err != nil {
+		return 0, err
+	}
+
+	plain := make([]byte, 0, len(c.target)+len(b))
+	plain = append(plain, c.target...)
+	plain = append(plain, b...)
+
+	buf := make([]byte, 0, len(salt)+len(plain)+aead.Overhead())
+	buf = append(buf, salt...)
+	buf = aead.Seal(buf, make([]byte, aead.NonceSize()), plain, nil)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *ssPacketConn) Read(b []byte) (int, error) {
+	buf := make([]byte, c.cipher.keySize+len(b)+262+ssTagSize)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		// drop malformed datagram
+		if n < c.cipher.keySize+ssTagSize {
+			continue
+		}
+		aead, err := c.cipher.ssAEAD(c.key, buf[:c.cipher.keySize])
+		if err != nil {
+			return 0, err
+		}
+		plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), buf[c.cipher.keySize:n], nil)
+		if err != nil {
+			continue
+		}
+		_, alen, err := parseSocks5Addr(plain)
+		if err != nil {
+			continue
+		}
+		return copy(b, plain[alen:]), nil
+	}
+}
+
+type shadowsocks struct {
+	addr    string
+	cipher  ssCipher
+	key     []byte
+	forward Dialer
+}
+
+// Dial connects to the address addr on the network net via the shadowsocks server.
+func (s *shadowsocks) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+	default:
+		return nil, errors.New("proxy: no support for shadowsocks proxy connections of type " + network)
+	}
+
+	target, err := appendSocks5Addr(nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.forward.Dial("tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ssConn{Conn: conn, cipher: s.cipher, key: s.key}
+	if _, err := c.Write(target); err != nil {
+		conn.Close()
+		return nil, errors.New("proxy: failed to write target to shadowsocks proxy at " + s.addr + ": " + err.Error())
+	}
+	return c, nil
+}
+
+// DialPacket relays udp to addr via the shadowsocks server.
+func (s *shadowsocks) DialPacket(network, addr string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp6", "udp4":
+	default:
+		return nil, errors.New("proxy: no support for shadowsocks proxy packet connections of type " + network)
+	}
+
+	// udp relay can't go through the forward proxy
+	if s.forward != Direct {
+		return nil, errors.New("proxy: no support for shadowsocks packet connections through proxy chain")
+	}
+
+	target, err := appendSocks5Addr(nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial(network, s.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &ssPacketConn{Conn: conn, cipher: s.cipher, key: s.key, target: target}, nil
+}
+
+// parse userinfo of SIP002 url: base64url(method:password) or method:password
+func ssUserInfo(user *url.Userinfo) (method, password string, err error) {
+	if user == nil {
+		return "", "", errors.New("proxy: shadowsocks url has no method and password")
+	}
+
+	if p, ok := user.Password(); ok {
+		return user.Username(), p, nil
+	}
+
+	v := strings.TrimRight(user.Username(), "=")
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		if b, err = base64.RawStdEncoding.DecodeString(v); err != nil {
+			return "", "", errors.New("proxy: invalid shadowsocks userinfo: " + err.Error())
+		}
+	}
+
+	method, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return "", "", errors.New("proxy: invalid shadowsocks userinfo")
+	}
+	return method, password, nil
+}
+
+func init() {
+	registerDialerType("ss", func(url *url.URL, forward Dialer) (Dialer, error) {
+		if url.Query().Get("plugin") != "" {
+			return nil, errors.New("proxy: shadowsocks plugin is not supported")
+		}
+
+		method, password, err := ssUserInfo(url.User)
+		if err != nil {
+			return nil, err
+		}
+
+		c, ok := ssCiphers[strings.ToLower(method)]
+		if !ok {
+			return nil, errors.New("proxy: unsupported shadowsocks cipher: " + method)
+		}
+
+		return &shadowsocks{
+			addr:    url.Host,
+			cipher:  c,
+			key:     ssKDF(password, c.keySize),
+			forward: forward,
+		}, nil
+	})
+}
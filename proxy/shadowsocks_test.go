@@ -0,0 +1,214 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package proxy
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a minimal shadowsocks server relays tcp and udp
+type ssServer struct {
+	t      *testing.T
+	cipher ssCipher
+	key    []byte
+	ln     net.Listener
+	pc     net.PacketConn
+}
+
+func newSSServer(t *testing.T, method, password string) *ssServer {
+	c := ssCiphers[method]
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	require.NoError(t, err)
+
+	s := &ssServer{t: t, cipher: c, key: ssKDF(password, c.keySize), ln: ln, pc: pc}
+	go s.serveTCP()
+	go s.serveUDP()
+	return s
+}
+
+func (s *ssServer) Close() {
+	s.ln.Close()
+	s.pc.Close()
+}
+
+func (s *ssServer) serveTCP() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			c := &ssConn{Conn: conn, cipher: s.cipher, key: s.key}
+			defer c.Close()
+
+			buf := make([]byte, 512)
+			n, err := c.Read(buf)
+			if err != nil {
+				s.t.Errorf("read target failed: %v", err)
+				return
+			}
+			target, _, err := parseSocks5Addr(buf[:n])
+			if err != nil {
+				s.t.Errorf("parse target failed: %v", err)
+				return
+			}
+			remote, err := net.Dial("tcp", target)
+			if err != nil {
+				return
+			}
+			defer remote.Close()
+			go io.Copy(remote, c)
+			io.Copy(c, remote)
+		}()
+	}
+}
+
+func (s *ssServer) serveUDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, cliaddr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		aead, err := s.cipher.ssAEAD(s.key, buf[:s.cipher.keySize])
+		require.NoError(s.t, err)
+		plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), buf[s.cipher.keySize:n], nil)
+		if err != nil {
+			s.t.Errorf("decrypt packet failed: %v", err)
+			return
+		}
+		target, alen, err := parseSocks5Addr(plain)
+		require.NoError(s.t, err)
+
+		remote, err := net.Dial("udp", target)
+		require.NoError(s.t, err)
+		remote.Write(plain[alen:])
+		remote.SetReadDeadline(time.Now().Add(time.Second))
+		rn, err := remote.Read(buf)
+		remote.Close()
+		if err != nil {
+			continue
+		}
+
+		// reuse client side packet conn to encrypt reply
+		reply := &ssPacketConn{Conn: &replyConn{PacketConn: s.pc, addr: cliaddr}, cipher: s.cipher, key: s.key, target: plain[:alen]}
+		reply.Write(buf[:rn])
+	}
+}
+
+type replyConn struct {
+	net.PacketConn
+	addr net.Addr
+}
+
+func (c *replyConn) Write(b []byte) (int, error) { return c.WriteTo(b, c.addr) }
+func (c *replyConn) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (c *replyConn) RemoteAddr() net.Addr        { return c.addr }
+func (c *replyConn) SetDeadline(time.Time) error { return nil }
+func (c *replyConn) LocalAddr() net.Addr         { return c.PacketConn.LocalAddr() }
+
+func echoTCP(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func echoUDP(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	return pc
+}
+
+func TestShadowsocks(t *testing.T) {
+	echo := echoTCP(t)
+	defer echo.Close()
+	echoPacket := echoUDP(t)
+	defer echoPacket.Close()
+
+	for method := range ssCiphers {
+		server := newSSServer(t, method, "kone-password")
+
+		userinfo := base64.RawURLEncoding.EncodeToString([]byte(method + ":kone-password"))
+		for _, rawurl := range []string{
+			"ss://" + userinfo + "@" + server.ln.Addr().String(),
+			"ss://" + method + ":kone-password@" + server.ln.Addr().String(),
+		} {
+			p, err := FromUrl(rawurl)
+			require.NoError(t, err, rawurl)
+
+			// tcp, with a payload over max chunk size
+			conn, err := p.Dial("tcp", echo.Addr().String())
+			require.NoError(t, err, method)
+			msg := strings.Repeat("kone", ssMaxPayload)
+			go conn.Write([]byte(msg))
+			b := make([]byte, len(msg))
+			conn.SetDeadline(time.Now().Add(3 * time.Second))
+			_, err = io.ReadFull(conn, b)
+			require.NoError(t, err, method)
+			assert.Equal(t, msg, string(b), method)
+			conn.Close()
+
+			// udp
+			pconn, err := p.DialPacket("udp", echoPacket.LocalAddr().String())
+			require.NoError(t, err, method)
+			pconn.SetDeadline(time.Now().Add(3 * time.Second))
+			_, err = pconn.Write([]byte("hello"))
+			require.NoError(t, err, method)
+			n, err := pconn.Read(b)
+			require.NoError(t, err, method)
+			assert.Equal(t, "hello", string(b[:n]), method)
+			pconn.Close()
+		}
+		server.Close()
+	}
+}
+
+func TestShadowsocksUrl(t *testing.T) {
+	_, err := FromUrl("ss://rc4-md5:password@127.0.0.1:8388")
+	assert.Error(t, err)
+
+	_, err = FromUrl("ss://127.0.0.1:8388")
+	assert.Error(t, err)
+
+	_, err = FromUrl("ss://YWVzLTI1Ni1nY206cGFzcw==@127.0.0.1:8388?plugin=obfs-local")
+	assert.Error(t, err)
+
+	// base64 with padding: aes-256-gcm:pass
+	_, err = FromUrl("ss://YWVzLTI1Ni1nY206cGFzcw==@127.0.0.1:8388")
+	assert.NoError(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 type socks5 struct {
@@ -16,12 +17,18 @@ type socks5 struct {
 
 const socks5Version = 5
 
+// timeout to connect and negotiate udp association, a silent proxy fails instead of hanging
+var socks5HandshakeTimeout = 10 * time.Second
+
 const (
 	socks5AuthNone     = 0
 	socks5AuthPassword = 2
 )
 
-const socks5Connect = 1
+const (
+	socks5Connect      = 1
+	socks5UDPAssociate = 3
+)
 
 const (
 	socks5IP4    = 1
@@ -60,25 +67,144 @@ func (s *socks5) Dial(network, addr string) (net.Conn, error) {
 	return conn, nil
 }
 
+// DialPacket associates a udp relay on the SOCKS5 proxy, and returns a
+// packet-oriented connection which sends to and receives from addr only.
+func (s *socks5) DialPacket(network, addr string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp6", "udp4":
+	default:
+		return nil, errors.New("proxy: no support for SOCKS5 proxy packet connections of type " + network)
+	}
+
+	// udp relay can't go through the forward proxy
+	if s.forward != Direct {
+		return nil, errors.New("proxy: no support for SOCKS5 packet connections through proxy chain")
+	}
+
+	header, err := appendSocks5Addr([]byte{0, 0, 0 /* reserved, fragment */}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl, err := net.DialTimeout(s.network, s.addr, socks5HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	relay, err := s.request(ctrl, socks5UDPAssociate, "")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// an unspecified relay address means the proxy server itself
+	host, port, _ := net.SplitHostPort(relay)
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = hostname(s.addr)
+	}
+
+	conn, err := net.Dial(network, net.JoinHostPort(host, port))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	return &socks5PacketConn{
+		Conn:   conn,
+		ctrl:   ctrl,
+		header: header,
+	}, nil
+}
+
 // connect takes an existing connection to a socks5 proxy server,
 // and commands the server to extend that connection to target,
 // which must be a canonical address with a host and port.
 func (s *socks5) connect(conn net.Conn, target string) error {
+	_, err := s.request(conn, socks5Connect, target)
+	return err
+}
+
+// appendSocks5Addr appends target in SOCKS5 address format (ATYP, ADDR, PORT) to buf.
+func appendSocks5Addr(buf []byte, target string) ([]byte, error) {
 	host, portStr, err := net.SplitHostPort(target)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return errors.New("proxy: failed to parse port number: " + portStr)
+		return nil, errors.New("proxy: failed to parse port number: " + portStr)
 	}
 	if port < 1 || port > 0xffff {
-		return errors.New("proxy: port number out of range: " + portStr)
+		return nil, errors.New("proxy: port number out of range: " + portStr)
 	}
 
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, socks5IP4)
+			ip = ip4
+		} else {
+			buf = append(buf, socks5IP6)
+		}
+		buf = append(buf, ip...)
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("proxy: destination hostname too long: " + host)
+		}
+		buf = append(buf, socks5Domain)
+		buf = append(buf, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+// parseSocks5Addr parses a SOCKS5 address at the beginning of b,
+// returns the address and how many bytes it takes.
+func parseSocks5Addr(b []byte) (string, int, error) {
+	if len(b) < 1 {
+		return "", 0, errors.New("proxy: short SOCKS5 address")
+	}
+
+	var host string
+	var n int
+	switch b[0] {
+	case socks5IP4:
+		n = 1 + net.IPv4len
+		if len(b) < n+2 {
+			return "", 0, errors.New("proxy: short SOCKS5 address")
+		}
+		host = net.IP(b[1:n]).String()
+	case socks5IP6:
+		n = 1 + net.IPv6len
+		if len(b) < n+2 {
+			return "", 0, errors.New("proxy: short SOCKS5 address")
+		}
+		host = net.IP(b[1:n]).String()
+	case socks5Domain:
+		if len(b) < 2 {
+			return "", 0, errors.New("proxy: short SOCKS5 address")
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			return "", 0, errors.New("proxy: short SOCKS5 address")
+		}
+		host = string(b[2:n])
+	default:
+		return "", 0, errors.New("proxy: unknown SOCKS5 address type " + strconv.Itoa(int(b[0])))
+	}
+	port := int(b[n])<<8 | int(b[n+1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), n + 2, nil
+}
+
+// request takes an existing connection to a socks5 proxy server,
+// negotiates authentication, and sends command cmd with target.
+// Target of UDP ASSOCIATE is ignored, for the client doesn't know which address it will send from.
+// It returns the bound address in server's reply.
+func (s *socks5) request(conn net.Conn, cmd byte, target string) (string, error) {
 	// the size here is just an estimate
-	buf := make([]byte, 0, 6+len(host))
+	buf := make([]byte, 0, 6+len(target))
 
 	buf = append(buf, socks5Version)
 	if len(s.user) > 0 && len(s.user) < 256 && len(s.password) < 256 {
@@ -88,17 +214,17 @@ func (s *socks5) connect(conn net.Conn, target string) error {
 	}
 
 	if _, err := conn.Write(buf); err != nil {
-		return errors.New("proxy: failed to write greeting to SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return "", errors.New("proxy: failed to write greeting to SOCKS5 proxy at " + s.addr + ": " + err.Error())
 	}
 
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return errors.New("proxy: failed to read greeting from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return "", errors.New("proxy: failed to read greeting from SOCKS5 proxy at " + s.addr + ": " + err.Error())
 	}
 	if buf[0] != 5 {
-		return errors.New("proxy: SOCKS5 proxy at " + s.addr + " has unexpected version " + strconv.Itoa(int(buf[0])))
+		return "", errors.New("proxy: SOCKS5 proxy at " + s.addr + " has unexpected version " + strconv.Itoa(int(buf[0])))
 	}
 	if buf[1] == 0xff {
-		return errors.New("proxy: SOCKS5 proxy at " + s.addr + " requires authentication")
+		return "", errors.New("proxy: SOCKS5 proxy at " + s.addr + " requires authentication")
 	}
 
 	if buf[1] == socks5AuthPassword {
@@ -110,45 +236,35 @@ func (s *socks5) connect(conn net.Conn, target string) error {
 		buf = append(buf, s.password...)
 
 		if _, err := conn.Write(buf); err != nil {
-			return errors.New("proxy: failed to write authentication request to SOCKS5 proxy at " + s.addr + ": " + err.Error())
+			return "", errors.New("proxy: failed to write authentication request to SOCKS5 proxy at " + s.addr + ": " + err.Error())
 		}
 
 		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			return errors.New("proxy: failed to read authentication reply from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+			return "", errors.New("proxy: failed to read authentication reply from SOCKS5 proxy at " + s.addr + ": " + err.Error())
 		}
 
 		if buf[1] != 0 {
-			return errors.New("proxy: SOCKS5 proxy at " + s.addr + " rejected username/password")
+			return "", errors.New("proxy: SOCKS5 proxy at " + s.addr + " rejected username/password")
 		}
 	}
 
 	buf = buf[:0]
-	buf = append(buf, socks5Version, socks5Connect, 0 /* reserved */)
-
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			buf = append(buf, socks5IP4)
-			ip = ip4
-		} else {
-			buf = append(buf, socks5IP6)
-		}
-		buf = append(buf, ip...)
+	buf = append(buf, socks5Version, cmd, 0 /* reserved */)
+	if cmd == socks5UDPAssociate {
+		buf = append(buf, socks5IP4, 0, 0, 0, 0, 0, 0) // 0.0.0.0:0
 	} else {
-		if len(host) > 255 {
-			return errors.New("proxy: destination hostname too long: " + host)
+		var err error
+		if buf, err = appendSocks5Addr(buf, target); err != nil {
+			return "", err
 		}
-		buf = append(buf, socks5Domain)
-		buf = append(buf, byte(len(host)))
-		buf = append(buf, host...)
 	}
-	buf = append(buf, byte(port>>8), byte(port))
 
 	if _, err := conn.Write(buf); err != nil {
-		return errors.New("proxy: failed to write connect request to SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return "", errors.New("proxy: failed to write connect request to SOCKS5 proxy at " + s.addr + ": " + err.Error())
 	}
 
 	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
-		return errors.New("proxy: failed to read connect reply from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return "", errors.New("proxy: failed to read connect reply from SOCKS5 proxy at " + s.addr + ": " + err.Error())
 	}
 
 	failure := "unknown error"
@@ -157,40 +273,83 @@ func (s *socks5) connect(conn net.Conn, target string) error {
 	}
 
 	if len(failure) > 0 {
-		return errors.New("proxy: SOCKS5 proxy at " + s.addr + " failed to connect: " + failure)
+		return "", errors.New("proxy: SOCKS5 proxy at " + s.addr + " failed to connect: " + failure)
 	}
 
-	bytesToDiscard := 0
+	// read bound address: ATYP, ADDR, PORT
+	bound := make([]byte, 0, 1+1+255+2)
+	bound = append(bound, buf[3])
+
+	bytesToRead := 0
 	switch buf[3] {
 	case socks5IP4:
-		bytesToDiscard = net.IPv4len
+		bytesToRead = net.IPv4len
 	case socks5IP6:
-		bytesToDiscard = net.IPv6len
+		bytesToRead = net.IPv6len
 	case socks5Domain:
 		_, err := io.ReadFull(conn, buf[:1])
 		if err != nil {
-			return errors.New("proxy: failed to read domain length from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+			return "", errors.New("proxy: failed to read domain length from SOCKS5 proxy at " + s.addr + ": " + err.Error())
 		}
-		bytesToDiscard = int(buf[0])
+		bound = append(bound, buf[0])
+		bytesToRead = int(buf[0])
 	default:
-		return errors.New("proxy: got unknown address type " + strconv.Itoa(int(buf[3])) + " from SOCKS5 proxy at " + s.addr)
+		return "", errors.New("proxy: got unknown address type " + strconv.Itoa(int(buf[3])) + " from SOCKS5 proxy at " + s.addr)
 	}
 
-	if cap(buf) < bytesToDiscard {
-		buf = make([]byte, bytesToDiscard)
-	} else {
-		buf = buf[:bytesToDiscard]
+	// address and port number
+	n := len(bound)
+	bound = bound[:n+bytesToRead+2]
+	if _, err := io.ReadFull(conn, bound[n:]); err != nil {
+		return "", errors.New("proxy: failed to read address from SOCKS5 proxy at " + s.addr + ": " + err.Error())
 	}
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		return errors.New("proxy: failed to read address from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+
+	addr, _, err := parseSocks5Addr(bound)
+	return addr, err
+}
+
+// socks5PacketConn is a udp connection to a SOCKS5 udp relay,
+// which wraps and unwraps the SOCKS5 udp request header.
+type socks5PacketConn struct {
+	net.Conn          // udp connection to relay
+	ctrl     net.Conn // association terminates when it's closed
+	header   []byte   // udp request header of target
+}
+
+func (c *socks5PacketConn) Write(b []byte) (int, error) {
+	buf := make([]byte, 0, len(c.header)+len(b))
+	buf = append(buf, c.header...)
+	buf = append(buf, b...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
 	}
+	return len(b), nil
+}
 
-	// Also need to discard the port number
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return errors.New("proxy: failed to read port from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+func (c *socks5PacketConn) Read(b []byte) (int, error) {
+	// header: RSV(2), FRAG(1), ATYP(1), ADDR(max 256), PORT(2)
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		// drop fragmented or malformed datagram
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		_, hlen, err := parseSocks5Addr(buf[3:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[3+hlen:n]), nil
 	}
+}
 
-	return nil
+func (c *socks5PacketConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
 }
 
 func init() {
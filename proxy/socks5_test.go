@@ -0,0 +1,180 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a minimal socks5 server supports UDP ASSOCIATE without authentication
+func serveSocks5UDP(t *testing.T, ln net.Listener) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 512)
+	// greeting
+	io.ReadFull(conn, buf[:2])
+	io.ReadFull(conn, buf[:buf[1]])
+	conn.Write([]byte{socks5Version, socks5AuthNone})
+
+	// request
+	io.ReadFull(conn, buf[:3])
+	if buf[1] != socks5UDPAssociate {
+		conn.Write([]byte{socks5Version, 7, 0, socks5IP4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	n, _ := conn.Read(buf)
+	if _, _, err := parseSocks5Addr(buf[:n]); err != nil {
+		t.Errorf("parse associate address failed: %v", err)
+		return
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("listen relay failed: %v", err)
+		return
+	}
+	defer relay.Close()
+
+	reply, _ := appendSocks5Addr([]byte{socks5Version, 0, 0}, relay.LocalAddr().String())
+	conn.Write(reply)
+
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, cliaddr, err := relay.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			target, hlen, err := parseSocks5Addr(b[3:n])
+			if err != nil {
+				t.Errorf("parse udp header failed: %v", err)
+				return
+			}
+			remote, _ := net.ResolveUDPAddr("udp", target)
+			relay.WriteToUDP(b[3+hlen:n], remote)
+
+			// reply from remote
+			n, _, err = relay.ReadFromUDP(b[3+hlen:])
+			if err != nil {
+				return
+			}
+			relay.WriteToUDP(b[:3+hlen+n], cliaddr)
+		}
+	}()
+
+	// association lives as long as the control connection
+	io.Copy(io.Discard, conn)
+}
+
+func TestSocks5DialPacket(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(b[:n], addr)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go serveSocks5UDP(t, ln)
+
+	p, err := FromUrl("socks5://" + ln.Addr().String())
+	require.NoError(t, err)
+
+	conn, err := p.DialPacket("udp", echo.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	for _, msg := range []string{"hello", "kone"} {
+		n, err := conn.Write([]byte(msg))
+		require.NoError(t, err)
+		assert.Equal(t, len(msg), n)
+
+		b := make([]byte, 64)
+		n, err = conn.Read(b)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(b[:n]))
+	}
+}
+
+func TestSocks5DialPacketTimeout(t *testing.T) {
+	// a silent proxy accepts, but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	timeout := socks5HandshakeTimeout
+	socks5HandshakeTimeout = 100 * time.Millisecond
+	defer func() { socks5HandshakeTimeout = timeout }()
+
+	p, err := FromUrl("socks5://" + ln.Addr().String())
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = p.DialPacket("udp", "127.0.0.1:53")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
+
+func TestHttpDialPacket(t *testing.T) {
+	p, err := FromUrl("http://127.0.0.1:8080")
+	require.NoError(t, err)
+
+	_, err = p.DialPacket("udp", "127.0.0.1:53")
+	assert.Error(t, err)
+}
+
+func TestSocks5Addr(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4:53", "[2001:db8::1]:443", "example.com:80"} {
+		b, err := appendSocks5Addr(nil, addr)
+		require.NoError(t, err)
+		v, n, err := parseSocks5Addr(b)
+		require.NoError(t, err)
+		assert.Equal(t, addr, v)
+		assert.Equal(t, len(b), n)
+	}
+
+	// port 0 is not a valid target
+	_, err := appendSocks5Addr(nil, "1.2.3.4:0")
+	assert.Error(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go serveSocks5UDP(t, ln)
+	p, err := FromUrl("socks5://" + ln.Addr().String())
+	require.NoError(t, err)
+	_, err = p.Dial("tcp", "1.2.3.4:0")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "port number out of range")
+}
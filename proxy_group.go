@@ -0,0 +1,306 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xjdrew/kone/proxy"
+)
+
+// proxy group types
+const (
+	GroupFallback    = "fallback"     // first alive member
+	GroupURLTest     = "url-test"     // alive member with lowest latency
+	GroupLoadBalance = "load-balance" // alive members in turn
+)
+
+const (
+	GroupDefaultURL       = "http://www.gstatic.com/generate_204"
+	GroupDefaultInterval  = 300 // seconds
+	GroupDefaultTimeout   = 5   // seconds
+	GroupDefaultTolerance = 50  // milliseconds
+)
+
+type GroupMember struct {
+	Name      string        `json:"name"`
+	Alive     bool          `json:"alive"`
+	Latency   time.Duration `json:"latency"` // latency of last successful check
+	LastCheck time.Time     `json:"last_check"`
+	LastError string        `json:"last_error,omitempty"`
+
+	proxy *proxy.Proxy
+}
+
+type ProxyGroup struct {
+	Name string
+	Type string
+
+	url       string
+	interval  time.Duration
+	timeout   time.Duration
+	tolerance time.Duration
+
+	lock     sync.Mutex // protect members state, selected and next
+	members  []*GroupMember
+	selected int // url-test: current selected member
+	next     int // load-balance: next member
+
+	done chan struct{} // closed to stop Serve
+}
+
+// candidates in preferred order, the first one is the selected member
+func (g *ProxyGroup) candidates() []*GroupMember {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	n := len(g.members)
+	order := make([]*GroupMember, 0, n)
+	switch g.Type {
+	case GroupURLTest:
+		order = append(order, g.members[g.selected])
+		for i, m := range g.members {
+			if i != g.selected {
+				order = append(order, m)
+			}
+		}
+	case GroupLoadBalance:
+		for i := 0; i < n; i++ {
+			order = append(order, g.members[(g.next+i)%n])
+		}
+		g.next = (g.next + 1) % n
+	default: // fallback
+		order = append(order, g.members...)
+	}
+
+	// alive members go first, keep order
+	alive := make([]*GroupMember, 0, n)
+	var dead []*GroupMember
+	for _, m := range order {
+		if m.Alive {
+			alive = append(alive, m)
+		} else {
+			dead = append(dead, m)
+		}
+	}
+	return append(alive, dead...)
+}
+
+// Selected returns the member name to use now
+func (g *ProxyGroup) Selected() string {
+	return g.candidates()[0].Name
+}
+
+func (g *ProxyGroup) setState(m *GroupMember, latency time.Duration, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	alive := err == nil
+	if m.Alive != alive {
+		if alive {
+			logger.Infof("[group] %s: member %s is up", g.Name, m.Name)
+		} else {
+			logger.Warningf("[group] %s: member %s is down: %v", g.Name, m.Name, err)
+		}
+	}
+
+	m.Alive = alive
+	m.LastCheck = time.Now()
+	if alive {
+		m.Latency = latency
+		m.LastError = ""
+	} else {
+		m.LastError = err.Error()
+	}
+
+	if g.Type == GroupURLTest {
+		g.reselect()
+	}
+}
+
+// url-test: switch to the fastest alive member if it is faster beyond tolerance
+func (g *ProxyGroup) reselect() {
+	current := g.members[g.selected]
+	best := -1
+	for i, m := range g.members {
+		if m.Alive && (best < 0 || m.Latency < g.members[best].Latency) {
+			best = i
+		}
+	}
+
+	if best < 0 || best == g.selected {
+		return
+	}
+	if !current.Alive || g.members[best].Latency+g.tolerance < current.Latency {
+		logger.Infof("[group] %s: select %s", g.Name, g.members[best].Name)
+		g.selected = best
+	}
+}
+
+// try members in preferred order until success
+func (g *ProxyGroup) dial(f func(m *GroupMember) (net.Conn, error)) (net.Conn, error) {
+	var errs []string
+	for _, m := range g.candidates() {
+		conn, err := f(m)
+		if err == nil {
+			return conn, nil
+		}
+		logger.Debugf("[group] %s: dial by %s failed: %v", g.Name, m.Name, err)
+		g.setState(m, 0, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", m.Name, err))
+	}
+	return nil, fmt.Errorf("group %s: all members failed: %s", g.Name, strings.Join(errs, "; "))
+}
+
+func (g *ProxyGroup) Dial(addr string) (net.Conn, error) {
+	return g.dial(func(m *GroupMember) (net.Conn, error) {
+		return m.proxy.Dial("tcp", addr)
+	})
+}
+
+func (g *ProxyGroup) DialPacket(addr string) (net.Conn, error) {
+	return g.dial(func(m *GroupMember) (net.Conn, error) {
+		return m.proxy.DialPacket("udp", addr)
+	})
+}
+
+// check a member by fetching test url through it
+func (g *ProxyGroup) check(m *GroupMember) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:              m.proxy.Dial,
+			DisableKeepAlives: true,
+		},
+		Timeout: g.timeout,
+	}
+
+	start := time.Now()
+	resp, err := client.Get(g.url)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			err = fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+	}
+	latency := time.Since(start)
+	logger.Debugf("[group] %s: check %s, latency: %v, err: %v", g.Name, m.Name, latency, err)
+	g.setState(m, latency, err)
+}
+
+func (g *ProxyGroup) checkAll() {
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func(m *GroupMember) {
+			defer wg.Done()
+			g.check(m)
+		}(m)
+	}
+	wg.Wait()
+}
+
+func (g *ProxyGroup) Serve() error {
+	g.checkAll()
+	tick := time.NewTicker(g.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			g.checkAll()
+		case <-g.done:
+			return nil
+		}
+	}
+}
+
+func (g *ProxyGroup) Close() error {
+	close(g.done)
+	return nil
+}
+
+// Members returns a snapshot of members state
+func (g *ProxyGroup) Members() []GroupMember {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	members := make([]GroupMember, len(g.members))
+	for i, m := range g.members {
+		members[i] = *m
+	}
+	return members
+}
+
+// parse group config: "type, member1, member2, ..., key=value, ..."
+func NewProxyGroup(name string, value string, proxies map[string]*proxy.Proxy) (*ProxyGroup, error) {
+	g := &ProxyGroup{
+		Name:      name,
+		url:       GroupDefaultURL,
+		interval:  GroupDefaultInterval * time.Second,
+		timeout:   GroupDefaultTimeout * time.Second,
+		tolerance: GroupDefaultTolerance * time.Millisecond,
+		done:      make(chan struct{}),
+	}
+
+	fields := strings.Split(value, ",")
+	g.Type = strings.ToLower(strings.TrimSpace(fields[0]))
+	switch g.Type {
+	case GroupFallback, GroupURLTest, GroupLoadBalance:
+	default:
+		return nil, fmt.Errorf("group %s: unknown type %q", name, g.Type)
+	}
+
+	for _, field := range fields[1:] {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if k, v, ok := strings.Cut(field, "="); ok {
+			k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+			var n int
+			var err error
+			switch k {
+			case "url":
+				g.url = v
+			case "interval":
+				n, err = strconv.Atoi(v)
+				g.interval = time.Duration(n) * time.Second
+			case "timeout":
+				n, err = strconv.Atoi(v)
+				g.timeout = time.Duration(n) * time.Second
+			case "tolerance":
+				n, err = strconv.Atoi(v)
+				g.tolerance = time.Duration(n) * time.Millisecond
+			default:
+				return nil, fmt.Errorf("group %s: unknown option %q", name, k)
+			}
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("group %s: invalid option %s", name, field)
+			}
+			continue
+		}
+
+		p, ok := proxies[field]
+		if !ok {
+			return nil, fmt.Errorf("group %s: no proxy: %s", name, field)
+		}
+		// members are optimistic alive before the first check
+		g.members = append(g.members, &GroupMember{Name: field, Alive: true, proxy: p})
+	}
+
+	if len(g.members) == 0 {
+		return nil, fmt.Errorf("group %s: no member", name)
+	}
+	if g.interval <= 0 {
+		return nil, fmt.Errorf("group %s: invalid interval", name)
+	}
+	return g, nil
+}
@@ -0,0 +1,204 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xjdrew/kone/proxy"
+)
+
+func newTestProxies(t *testing.T, urls map[string]string) map[string]*proxy.Proxy {
+	proxies := make(map[string]*proxy.Proxy)
+	for name, u := range urls {
+		p, err := proxy.FromUrl(u)
+		require.NoError(t, err)
+		proxies[name] = p
+	}
+	return proxies
+}
+
+func TestProxyGroupConfig(t *testing.T) {
+	proxies := newTestProxies(t, map[string]string{
+		"Proxy1": "http://127.0.0.1:8080",
+		"Proxy2": "socks5://127.0.0.1:1080",
+	})
+
+	g, err := NewProxyGroup("Group1", "url-test, Proxy1, Proxy2, url=http://example.com/, interval=60, timeout=3, tolerance=100", proxies)
+	require.NoError(t, err)
+	assert.Equal(t, GroupURLTest, g.Type)
+	assert.Equal(t, "http://example.com/", g.url)
+	assert.Equal(t, 60*time.Second, g.interval)
+	assert.Equal(t, 3*time.Second, g.timeout)
+	assert.Equal(t, 100*time.Millisecond, g.tolerance)
+	assert.Len(t, g.Members(), 2)
+	assert.Equal(t, "Proxy1", g.Selected())
+
+	for _, value := range []string{
+		"round-robin, Proxy1",
+		"fallback",
+		"fallback, Proxy3",
+		"fallback, Proxy1, interval=0",
+		"fallback, Proxy1, timeout=x",
+		"fallback, Proxy1, foo=bar",
+	} {
+		_, err := NewProxyGroup("Group1", value, proxies)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestProxyGroupFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := ln.Addr().String()
+	ln.Close()
+
+	targets := make(chan string, 4)
+	live := serveConnect(t, targets)
+	defer live.Close()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+
+	proxies := newTestProxies(t, map[string]string{
+		"Dead": "http://" + closed,
+		"Live": "http://" + live.Addr().String(),
+	})
+	g, err := NewProxyGroup("Group1", "fallback, Dead, Live", proxies)
+	require.NoError(t, err)
+	assert.Equal(t, "Dead", g.Selected())
+
+	conn, err := g.Dial(echo.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, echo.Addr().String(), <-targets)
+
+	// failed member is marked down and skipped
+	members := g.Members()
+	assert.False(t, members[0].Alive)
+	assert.NotEmpty(t, members[0].LastError)
+	assert.True(t, members[1].Alive)
+	assert.Equal(t, "Live", g.Selected())
+
+	// back to the first member once it recovers
+	g.setState(g.members[0], time.Millisecond, nil)
+	assert.Equal(t, "Dead", g.Selected())
+}
+
+func TestProxyGroupURLTest(t *testing.T) {
+	proxies := newTestProxies(t, map[string]string{
+		"Proxy1": "http://127.0.0.1:8080",
+		"Proxy2": "http://127.0.0.1:8081",
+		"Proxy3": "http://127.0.0.1:8082",
+	})
+	g, err := NewProxyGroup("Group1", "url-test, Proxy1, Proxy2, Proxy3, tolerance=50", proxies)
+	require.NoError(t, err)
+
+	g.setState(g.members[0], 200*time.Millisecond, nil)
+	g.setState(g.members[1], 100*time.Millisecond, nil)
+	g.setState(g.members[2], 300*time.Millisecond, nil)
+	assert.Equal(t, "Proxy2", g.Selected())
+
+	// faster but within tolerance, keep current member
+	g.setState(g.members[0], 80*time.Millisecond, nil)
+	assert.Equal(t, "Proxy2", g.Selected())
+
+	// faster beyond tolerance
+	g.setState(g.members[2], 20*time.Millisecond, nil)
+	assert.Equal(t, "Proxy3", g.Selected())
+
+	// selected member is down
+	g.setState(g.members[2], 0, errors.New("timeout"))
+	assert.Equal(t, "Proxy1", g.Selected())
+
+	// all down, keep trying in order
+	g.setState(g.members[0], 0, errors.New("timeout"))
+	g.setState(g.members[1], 0, errors.New("timeout"))
+	assert.Len(t, g.candidates(), 3)
+}
+
+func TestProxyGroupLoadBalance(t *testing.T) {
+	proxies := newTestProxies(t, map[string]string{
+		"Proxy1": "http://127.0.0.1:8080",
+		"Proxy2": "http://127.0.0.1:8081",
+		"Proxy3": "http://127.0.0.1:8082",
+	})
+	g, err := NewProxyGroup("Group1", "load-balance, Proxy1, Proxy2, Proxy3", proxies)
+	require.NoError(t, err)
+
+	var selected []string
+	for i := 0; i < 4; i++ {
+		selected = append(selected, g.Selected())
+	}
+	assert.Equal(t, []string{"Proxy1", "Proxy2", "Proxy3", "Proxy1"}, selected)
+
+	// dead member is skipped
+	g.setState(g.members[1], 0, errors.New("timeout"))
+	selected = selected[:0]
+	for i := 0; i < 3; i++ {
+		selected = append(selected, g.Selected())
+	}
+	assert.NotContains(t, selected, "Proxy2")
+}
+
+func TestProxyGroupCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := ln.Addr().String()
+	ln.Close()
+
+	targets := make(chan string, 4)
+	live := serveConnect(t, targets)
+	defer live.Close()
+
+	proxies := newTestProxies(t, map[string]string{
+		"Dead": "http://" + closed,
+		"Live": "http://" + live.Addr().String(),
+	})
+	g, err := NewProxyGroup("Group1", "url-test, Dead, Live, timeout=3, url="+ts.URL, proxies)
+	require.NoError(t, err)
+
+	g.checkAll()
+	members := g.Members()
+	assert.False(t, members[0].Alive)
+	assert.False(t, members[0].LastCheck.IsZero())
+	assert.True(t, members[1].Alive)
+	assert.True(t, members[1].Latency > 0)
+	assert.Equal(t, "Live", g.Selected())
+}
+
+func TestProxiesGroup(t *testing.T) {
+	rule := NewRule(nil)
+
+	_, err := NewProxies(rule, map[string]string{
+		"Proxy1": "http://127.0.0.1:8080",
+	}, map[string]string{
+		"Proxy1": "fallback, Proxy1",
+	})
+	assert.Error(t, err)
+
+	proxies, err := NewProxies(rule, map[string]string{
+		"Proxy1": "http://127.0.0.1:8080",
+	}, map[string]string{
+		"Group1": "fallback, Proxy1",
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, proxies.groups["Group1"])
+}
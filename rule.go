@@ -5,9 +5,23 @@
 
 package kone
 
+// builtin policies
+const (
+	PolicyDirect     = "DIRECT"
+	PolicyReject     = "REJECT"      // refuse: dns answer NXDOMAIN, tcp reset
+	PolicyRejectDrop = "REJECT-DROP" // blackhole: dns answer 0.0.0.0, packets dropped
+)
+
+// test whether proxy is a reject policy
+func IsRejectPolicy(proxy string) bool {
+	return proxy == PolicyReject || proxy == PolicyRejectDrop
+}
+
 type Rule struct {
 	directDomains map[string]bool // always direct connect for proxy domain
 	patterns      []Pattern
+	configs       []RuleConfig // config of patterns
+	matcher       *ruleMatcher // compiled patterns
 }
 
 func (rule *Rule) DirectDomain(domain string) {
@@ -15,24 +29,142 @@ func (rule *Rule) DirectDomain(domain string) {
 	rule.directDomains[domain] = true
 }
 
-// match a proxy for target `val`
+// match a proxy for target `val`: a domain, an ip or a flow
 func (rule *Rule) Proxy(val interface{}) string {
-	if domain, ok := val.(string); ok {
-		if rule.directDomains[domain] {
-			logger.Debugf("[rule match] %v, proxy %q", val, "DIRECT")
-			return "DIRECT" // direct
+	proxy, _ := rule.Match(flowOf(val))
+	return proxy
+}
+
+// Match matches a proxy for flow, exact is false if the matched rule depends on unknown fields of flow,
+// such as port of a dns query
+func (rule *Rule) Match(flow *Flow) (proxy string, exact bool) {
+	proxy, exact, _ = rule.MatchRule(flow)
+	return proxy, exact
+}
+
+// MatchRule is Match, and returns the matched rule too, which is empty if no rule matches
+func (rule *Rule) MatchRule(flow *Flow) (proxy string, exact bool, matched string) {
+	if flow.Domain != "" && rule.directDomains[flow.Domain] {
+		logger.Debugf("[rule match] %v, proxy %q", flow, PolicyDirect)
+		return PolicyDirect, true, "" // direct
+	}
+
+	if i := rule.matcher.match(flow); i >= 0 {
+		pattern := rule.patterns[i]
+		exact = matchFlow(pattern, flow) == matchYes
+		logger.Debugf("[rule match] %v, proxy %s, exact %v", flow, pattern.Proxy(), exact)
+		return pattern.Proxy(), exact, rule.configs[i].String()
+	}
+	logger.Debugf("[rule final] %v, proxy %q", flow, "")
+	return PolicyDirect, true, "" // direct connect
+}
+
+// MatchAnswer matches flows of a dns answer in order, the first one which is not DIRECT, or not exact, wins
+func (rule *Rule) MatchAnswer(flows []*Flow) (proxy string, exact bool, matched string) {
+	proxy, exact = PolicyDirect, true
+	for _, flow := range flows {
+		proxy, exact, matched = rule.MatchRule(flow)
+		if proxy != PolicyDirect || !exact {
+			break
 		}
 	}
+	return proxy, exact, matched
+}
+
+// HasProcessRules tests whether there is any PROCESS-NAME or UID rule
+func (rule *Rule) HasProcessRules() bool {
+	return rule.matcher.hasProcess()
+}
 
+// match a proxy for local process `proc`, ok is false if no process rule matches it.
+// Process rules take precedence over rules of destination.
+func (rule *Rule) ProcessProxy(proc *Process) (proxy string, ok bool) {
+	if i := rule.matcher.match(proc); i >= 0 {
+		proxy = rule.patterns[i].Proxy()
+		logger.Debugf("[rule match] process %s(uid %d), proxy %s", proc.Name, proc.UID, proxy)
+		return proxy, true
+	}
+	return "", false
+}
+
+func (rule *Rule) ruleSets() []*RuleSet {
+	var sets []*RuleSet
 	for _, pattern := range rule.patterns {
-		if pattern.Match(val) {
-			proxy := pattern.Proxy()
-			logger.Debugf("[rule match] %v, proxy %s", val, proxy)
-			return proxy
+		if set, ok := pattern.(*RuleSet); ok {
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+// LoadRuleSets loads rule sets, onUpdate is called when a rule set is changed by refresh.
+// A rule set failed to load matches nothing, until it's loaded by refresh.
+func (rule *Rule) LoadRuleSets(cfg *KoneConfig, onUpdate func()) {
+	for _, set := range rule.ruleSets() {
+		set.onUpdate = onUpdate
+		if err := set.setup(cfg); err != nil {
+			logger.Errorf("[rule-set] load %s failed: %v", set.source, err)
 		}
 	}
-	logger.Debugf("[rule final] %v, proxy %q", val, "")
-	return "DIRECT" // direct connect
+}
+
+func (rule *Rule) geoSites() []*GeoSitePattern {
+	var sites []*GeoSitePattern
+	for _, pattern := range rule.patterns {
+		if site, ok := pattern.(*GeoSitePattern); ok {
+			sites = append(sites, site)
+		}
+	}
+	return sites
+}
+
+// LoadGeoSites loads domains of GEOSITE rules from geosite-dir, and compiles them into matcher.
+// A category failed to load matches nothing.
+func (rule *Rule) LoadGeoSites(cfg *KoneConfig) {
+	sites := rule.geoSites()
+	if len(sites) == 0 {
+		return
+	}
+	if cfg.General.GeoSiteDir == "" {
+		logger.Errorf("[geosite] geosite-dir is not set, %d GEOSITE rules match nothing", len(sites))
+		return
+	}
+
+	g := NewGeoSite(cfg.path(cfg.General.GeoSiteDir))
+	for _, site := range sites {
+		if err := site.load(g); err != nil {
+			logger.Errorf("[geosite] load %s failed: %v", site.category, err)
+			continue
+		}
+		logger.Infof("[geosite] load %d domains of %s", site.Size(), site.category)
+	}
+	rule.matcher = newRuleMatcher(rule.patterns)
+}
+
+// refresh rule sets
+func (rule *Rule) Serve() error {
+	sets := rule.ruleSets()
+	errCh := make(chan error, len(sets))
+	for _, set := range sets {
+		go func(set *RuleSet) {
+			errCh <- set.Serve()
+		}(set)
+	}
+
+	for range sets {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop refresh
+func (rule *Rule) Close() error {
+	for _, set := range rule.ruleSets() {
+		set.Close()
+	}
+	return nil
 }
 
 func NewRule(rcs []RuleConfig) *Rule {
@@ -43,7 +175,9 @@ func NewRule(rcs []RuleConfig) *Rule {
 	for _, rc := range rcs {
 		if pattern := CreatePattern(rc); pattern != nil {
 			rule.patterns = append(rule.patterns, pattern)
+			rule.configs = append(rule.configs, rc)
 		}
 	}
+	rule.matcher = newRuleMatcher(rule.patterns)
 	return rule
 }
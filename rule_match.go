@@ -0,0 +1,272 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"net"
+	"strings"
+
+	"github.com/xjdrew/kone/geoip"
+)
+
+// domain trie keyed by labels from right to left: www.google.com is stored as com -> google -> www
+type domainNode struct {
+	children map[string]*domainNode
+	exact    int // index of first DOMAIN rule ends at this node, -1 if none
+	suffix   int // index of first DOMAIN-SUFFIX rule ends at this node, -1 if none
+}
+
+func newDomainNode() *domainNode {
+	return &domainNode{exact: -1, suffix: -1}
+}
+
+type domainTrie struct {
+	root *domainNode
+}
+
+// last label of domain and the rest, more is false if domain has only one label
+func lastLabel(domain string) (label string, rest string, more bool) {
+	i := strings.LastIndexByte(domain, '.')
+	if i < 0 {
+		return domain, "", false
+	}
+	return domain[i+1:], domain[:i], true
+}
+
+func (t *domainTrie) insert(domain string, index int, suffix bool) {
+	node := t.root
+	for {
+		label, rest, more := lastLabel(domain)
+		child := node.children[label]
+		if child == nil {
+			child = newDomainNode()
+			if node.children == nil {
+				node.children = make(map[string]*domainNode)
+			}
+			node.children[label] = child
+		}
+		node = child
+		if !more {
+			break
+		}
+		domain = rest
+	}
+
+	if suffix {
+		if node.suffix < 0 {
+			node.suffix = index
+		}
+	} else if node.exact < 0 {
+		node.exact = index
+	}
+}
+
+// lookup returns index of the first rule matches domain, -1 if none.
+// domain should be in lower case.
+func (t *domainTrie) lookup(domain string) int {
+	best := -1
+	better := func(index int) {
+		if index >= 0 && (best < 0 || index < best) {
+			best = index
+		}
+	}
+
+	node := t.root
+	for {
+		label, rest, more := lastLabel(domain)
+		node = node.children[label]
+		if node == nil {
+			return best
+		}
+		better(node.suffix)
+		if !more {
+			better(node.exact)
+			return best
+		}
+		domain = rest
+	}
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: newDomainNode()}
+}
+
+// binary radix tree of ip prefixes
+type cidrNode struct {
+	children [2]*cidrNode
+	index    int // index of first IP-CIDR rule ends at this node, -1 if none
+}
+
+type cidrTree struct {
+	root4 *cidrNode
+	root6 *cidrNode
+}
+
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// normalize ip to 4 bytes if it's IPv4, returns root of its family
+func (t *cidrTree) rootOf(ip net.IP) (net.IP, *cidrNode) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, t.root4
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return ip6, t.root6
+	}
+	return nil, nil
+}
+
+func (t *cidrTree) insert(ipNet *net.IPNet, index int) {
+	ip, node := t.rootOf(ipNet.IP)
+	if node == nil {
+		return
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != len(ip)*8 {
+		return
+	}
+	for i := 0; i < ones; i++ {
+		b := bitAt(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &cidrNode{index: -1}
+		}
+		node = node.children[b]
+	}
+	if node.index < 0 {
+		node.index = index
+	}
+}
+
+// lookup returns index of the first rule contains ip, -1 if none
+func (t *cidrTree) lookup(ip net.IP) int {
+	ip, node := t.rootOf(ip)
+	best := -1
+	for i := 0; node != nil; i++ {
+		if node.index >= 0 && (best < 0 || node.index < best) {
+			best = node.index
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[bitAt(ip, i)]
+	}
+	return best
+}
+
+func newCIDRTree() *cidrTree {
+	return &cidrTree{
+		root4: &cidrNode{index: -1},
+		root6: &cidrNode{index: -1},
+	}
+}
+
+// ruleMatcher finds the first pattern matches a value. DOMAIN, DOMAIN-SUFFIX, IP-CIDR and domains of
+// GEOSITE patterns are compiled into trees, IP-ASN patterns into a map; other patterns are matched one by one.
+type ruleMatcher struct {
+	patterns  []Pattern
+	domains   *domainTrie
+	cidrs     *cidrTree
+	asns      map[uint32]int // index of first IP-ASN pattern by asn
+	others    []int          // index of patterns not compiled, in order
+	processes []int          // index of process patterns and rule sets, in order
+}
+
+// hasProcess tests whether there is any process pattern, rule sets included
+func (m *ruleMatcher) hasProcess() bool {
+	for _, i := range m.processes {
+		switch p := m.patterns[i].(type) {
+		case *RuleSet:
+			if sub := p.matcher.Load(); sub != nil && sub.hasProcess() {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// match returns index of the first pattern matches val, -1 if none. A domain or an ip is matched
+// as a flow. A process only matches process patterns, which are skipped by flows.
+func (m *ruleMatcher) match(val interface{}) int {
+	if proc, ok := val.(*Process); ok {
+		for _, i := range m.processes {
+			if m.patterns[i].Match(proc) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	flow := flowOf(val)
+
+	best := -1
+	if flow.Domain != "" {
+		best = m.domains.lookup(strings.ToLower(flow.Domain))
+	}
+	if flow.DstIP != nil {
+		if i := m.cidrs.lookup(flow.DstIP); i >= 0 && (best < 0 || i < best) {
+			best = i
+		}
+		if len(m.asns) > 0 {
+			if i, ok := m.asns[geoip.QueryASN(flow.DstIP)]; ok && (best < 0 || i < best) {
+				best = i
+			}
+		}
+	}
+
+	for _, i := range m.others {
+		if best >= 0 && i > best {
+			break
+		}
+		if m.patterns[i].Match(flow) {
+			return i
+		}
+	}
+	return best
+}
+
+func newRuleMatcher(patterns []Pattern) *ruleMatcher {
+	m := &ruleMatcher{
+		patterns: patterns,
+		domains:  newDomainTrie(),
+		cidrs:    newCIDRTree(),
+		asns:     make(map[uint32]int),
+	}
+	for i, pattern := range patterns {
+		switch p := pattern.(type) {
+		case DomainPattern:
+			m.domains.insert(p.domain, i, false)
+		case DomainSuffixPattern:
+			m.domains.insert(p.suffix, i, true)
+		case IPCIDRPattern:
+			m.cidrs.insert(p.ipNet, i)
+		case IPASNPattern:
+			if _, ok := m.asns[p.asn]; !ok {
+				m.asns[p.asn] = i
+			}
+		case *GeoSitePattern:
+			for _, domain := range p.full {
+				m.domains.insert(domain, i, false)
+			}
+			for _, suffix := range p.suffixes {
+				m.domains.insert(suffix, i, true)
+			}
+			if len(p.others) > 0 {
+				m.others = append(m.others, i)
+			}
+		case ProcessNamePattern, UIDPattern:
+			m.processes = append(m.processes, i)
+		case *RuleSet:
+			m.processes = append(m.processes, i)
+			m.others = append(m.others, i)
+		default:
+			m.others = append(m.others, i)
+		}
+	}
+	return m
+}
@@ -0,0 +1,165 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xjdrew/kone/tcpip"
+)
+
+// the linear scan, which ruleMatcher replaces
+func linearMatch(patterns []Pattern, val interface{}) int {
+	for i, pattern := range patterns {
+		if pattern.Match(val) {
+			return i
+		}
+	}
+	return -1
+}
+
+func testPatterns(rcs []RuleConfig) []Pattern {
+	var patterns []Pattern
+	for _, rc := range rcs {
+		if pattern := CreatePattern(rc); pattern != nil {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func TestRuleMatcher(t *testing.T) {
+	patterns := testPatterns([]RuleConfig{
+		{Schema: "DOMAIN", Pattern: "www.google.com", Proxy: "A"},
+		{Schema: "DOMAIN-SUFFIX", Pattern: "google.com", Proxy: "B"},
+		{Schema: "DOMAIN-KEYWORD", Pattern: "mail", Proxy: "C"},
+		{Schema: "DOMAIN-SUFFIX", Pattern: "mail.google.com", Proxy: "D"}, // shadowed by B
+		{Schema: "DOMAIN-SUFFIX", Pattern: ".twitter.com", Proxy: "E"},
+		{Schema: "DOMAIN-SUFFIX", Pattern: "Example.COM", Proxy: "F"},
+		{Schema: "DOMAIN", Pattern: "com", Proxy: "G"},
+		{Schema: "IP-CIDR", Pattern: "10.0.0.0/8", Proxy: "H"},
+		{Schema: "IP-CIDR", Pattern: "10.1.0.0/16", Proxy: "I"}, // shadowed by H
+		{Schema: "IP-CIDR", Pattern: "192.168.1.0/24", Proxy: "J"},
+		{Schema: "IP-CIDR", Pattern: "192.168.0.0/16", Proxy: "K"},
+		{Schema: "IP-CIDR6", Pattern: "2001:db8::/32", Proxy: "L"},
+		{Schema: "IP-CIDR", Pattern: "0.0.0.0/0", Proxy: "M"},
+		{Schema: "FINAL", Proxy: "N"},
+	})
+	m := newRuleMatcher(patterns)
+
+	for _, c := range []struct {
+		val   interface{}
+		proxy string
+	}{
+		{"www.google.com", "A"},
+		{"WWW.Google.com", "A"},
+		{"google.com", "B"},
+		{"mail.google.com", "B"},
+		{"ungoogle.com", "N"},
+		{"mail.yahoo.com", "C"},
+		{"api.twitter.com", "E"},
+		{"twitter.com", "E"},
+		{"www.example.com", "F"},
+		{"com", "G"},
+		{"www.baidu.com", "N"},
+		{"", "N"},
+		{net.ParseIP("10.1.2.3"), "H"},
+		{tcpip.ConvertIPv4ToUint32(net.ParseIP("10.1.2.3")), "H"},
+		{net.ParseIP("192.168.1.1"), "J"},
+		{net.ParseIP("192.168.2.1"), "K"},
+		{net.ParseIP("2001:db8::1"), "L"},
+		{net.ParseIP("2001:db9::1"), "N"},
+		{net.ParseIP("8.8.8.8"), "M"},
+	} {
+		i := m.match(c.val)
+		assert.Equal(t, linearMatch(patterns, c.val), i, c.val)
+		if assert.True(t, i >= 0, c.val) {
+			assert.Equal(t, c.proxy, patterns[i].Proxy(), c.val)
+		}
+	}
+
+	assert.Equal(t, -1, newRuleMatcher(nil).match("www.google.com"))
+	assert.Equal(t, -1, newRuleMatcher(nil).match(net.ParseIP("8.8.8.8")))
+}
+
+// random rules and queries, matcher should agree with linear scan
+func TestRuleMatcherRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	labels := []string{"a", "b", "ab", "ba", "com", "google", "ogle", "x"}
+	domain := func() string {
+		n := 1 + r.Intn(4)
+		s := labels[r.Intn(len(labels))]
+		for i := 1; i < n; i++ {
+			s = labels[r.Intn(len(labels))] + "." + s
+		}
+		return s
+	}
+	schemas := []string{"DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD", "IP-CIDR"}
+
+	for round := 0; round < 20; round++ {
+		var rcs []RuleConfig
+		for i := 0; i < 30; i++ {
+			schema := schemas[r.Intn(len(schemas))]
+			pattern := domain()
+			if schema == "IP-CIDR" {
+				pattern = fmt.Sprintf("10.%d.%d.0/%d", r.Intn(4), r.Intn(4), 8+r.Intn(17))
+			}
+			rcs = append(rcs, RuleConfig{Schema: schema, Pattern: pattern, Proxy: fmt.Sprint(i)})
+		}
+		patterns := testPatterns(rcs)
+		m := newRuleMatcher(patterns)
+		for i := 0; i < 200; i++ {
+			d := domain()
+			assert.Equal(t, linearMatch(patterns, d), m.match(d), d)
+			ip := net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(4)), byte(r.Intn(256)))
+			assert.Equal(t, linearMatch(patterns, ip), m.match(ip), ip)
+		}
+	}
+}
+
+// thousands of rules, like a rule list
+func benchPatterns() ([]Pattern, []interface{}) {
+	r := rand.New(rand.NewSource(1))
+	var rcs []RuleConfig
+	var vals []interface{}
+	for i := 0; i < 5000; i++ {
+		suffix := fmt.Sprintf("site%d.com", i)
+		cidr := fmt.Sprintf("%d.%d.%d.0/24", 1+r.Intn(223), r.Intn(256), r.Intn(256))
+		rcs = append(rcs,
+			RuleConfig{Schema: "DOMAIN-SUFFIX", Pattern: suffix, Proxy: "A"},
+			RuleConfig{Schema: "IP-CIDR", Pattern: cidr, Proxy: "A"},
+		)
+		if i%100 == 0 {
+			ip, _, _ := net.ParseCIDR(cidr)
+			vals = append(vals, "www."+suffix, ip)
+		}
+	}
+	rcs = append(rcs, RuleConfig{Schema: "FINAL", Proxy: "B"})
+	vals = append(vals, "www.unknown.org", net.ParseIP("8.8.8.8"))
+	return testPatterns(rcs), vals
+}
+
+func BenchmarkRuleLinear(b *testing.B) {
+	patterns, vals := benchPatterns()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearMatch(patterns, vals[i%len(vals)])
+	}
+}
+
+func BenchmarkRuleMatcher(b *testing.B) {
+	patterns, vals := benchPatterns()
+	m := newRuleMatcher(patterns)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.match(vals[i%len(vals)])
+	}
+}
@@ -0,0 +1,272 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RuleSetDefaultInterval = 86400 // seconds
+	RuleSetFetchTimeout    = 30    // seconds
+)
+
+// RULE-SET: rules loaded from a local file or a http url, all rules share proxy of the rule set
+type RuleSet struct {
+	source string // file path or url
+	proxy  string
+
+	path     string // local file, or cache file of url
+	interval time.Duration
+	onUpdate func() // called after patterns are replaced by refresh
+
+	matcher atomic.Pointer[ruleMatcher] // compiled patterns loaded
+	digest  [sha1.Size]byte             // of loaded data
+	done    chan struct{}
+}
+
+func (p *RuleSet) Proxy() string {
+	return p.proxy
+}
+
+func (p *RuleSet) Match(val interface{}) bool {
+	if m := p.matcher.Load(); m != nil {
+		return m.match(val) >= 0
+	}
+	return false
+}
+
+func (p *RuleSet) matchFlow(flow *Flow) matchResult {
+	if m := p.matcher.Load(); m != nil {
+		if i := m.match(flow); i >= 0 {
+			return matchFlow(m.patterns[i], flow)
+		}
+	}
+	return matchNo
+}
+
+// Patterns returns patterns loaded currently
+func (p *RuleSet) Patterns() []Pattern {
+	if m := p.matcher.Load(); m != nil {
+		return m.patterns
+	}
+	return nil
+}
+
+func (p *RuleSet) isURL() bool {
+	return strings.HasPrefix(p.source, "http://") || strings.HasPrefix(p.source, "https://")
+}
+
+func (p *RuleSet) fetch() ([]byte, error) {
+	client := &http.Client{Timeout: RuleSetFetchTimeout * time.Second}
+	rsp, err := client.Get(p.source)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", p.source, rsp.Status)
+	}
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// write cache file atomically
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		logger.Warningf("[rule-set] cache %s failed: %v", p.source, err)
+		return data, nil
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		logger.Warningf("[rule-set] cache %s failed: %v", p.source, err)
+		return data, nil
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		logger.Warningf("[rule-set] cache %s failed: %v", p.source, err)
+	}
+	return data, nil
+}
+
+// read rule set, url is fetched if force or its cache is out of date, cache is used if fetch failed
+func (p *RuleSet) read(force bool) ([]byte, error) {
+	if !p.isURL() {
+		return os.ReadFile(p.path)
+	}
+
+	info, err := os.Stat(p.path)
+	fresh := err == nil && time.Since(info.ModTime()) < p.interval
+	if fresh && !force {
+		return os.ReadFile(p.path)
+	}
+
+	data, err := p.fetch()
+	if err == nil {
+		return data, nil
+	}
+	logger.Warningf("[rule-set] fetch %s failed: %v", p.source, err)
+	if data, cacheErr := os.ReadFile(p.path); cacheErr == nil {
+		logger.Infof("[rule-set] use cache of %s", p.source)
+		return data, nil
+	}
+	return nil, err
+}
+
+// load rule set, returns whether patterns changed
+func (p *RuleSet) load(force bool) (bool, error) {
+	data, err := p.read(force)
+	if err != nil {
+		return false, err
+	}
+
+	digest := sha1.Sum(data)
+	if digest == p.digest && p.matcher.Load() != nil {
+		return false, nil
+	}
+	patterns, skipped := parseRuleSet(data, p.proxy)
+	p.matcher.Store(newRuleMatcher(patterns))
+	p.digest = digest
+	logger.Infof("[rule-set] load %d rules from %s, %d skipped", len(patterns), p.source, skipped)
+	return true, nil
+}
+
+// Serve refreshes rule set every interval
+func (p *RuleSet) Serve() error {
+	tick := time.NewTicker(p.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			changed, err := p.load(true)
+			if err != nil {
+				logger.Errorf("[rule-set] refresh %s failed: %v", p.source, err)
+			} else if changed && p.onUpdate != nil {
+				p.onUpdate()
+			}
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+func (p *RuleSet) Close() error {
+	close(p.done)
+	return nil
+}
+
+// setup locates source and loads it, a relative path is relative to dir of config file
+func (p *RuleSet) setup(cfg *KoneConfig) error {
+	p.interval = time.Duration(cfg.General.RuleSetInterval) * time.Second
+	if p.interval <= 0 {
+		p.interval = RuleSetDefaultInterval * time.Second
+	}
+
+	if p.isURL() {
+		sum := sha1.Sum([]byte(p.source))
+		p.path = filepath.Join(ruleSetDir(cfg.General.RuleSetDir), hex.EncodeToString(sum[:8])+".list")
+	} else {
+		p.path = cfg.path(p.source)
+	}
+	_, err := p.load(false)
+	return err
+}
+
+func NewRuleSet(proxy, source string) *RuleSet {
+	return &RuleSet{
+		source:   source,
+		proxy:    proxy,
+		interval: RuleSetDefaultInterval * time.Second,
+		done:     make(chan struct{}),
+	}
+}
+
+// cache dir of rule sets
+func ruleSetDir(dir string) string {
+	if dir != "" {
+		return dir
+	}
+	if cache, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(cache, "kone", "rule-set")
+	}
+	return filepath.Join(os.TempDir(), "kone-rule-set")
+}
+
+// parse a rule list, which is compatible with surge and clash:
+//
+//	DOMAIN-SUFFIX,google.com    # a rule without proxy
+//	- IP-CIDR,1.0.0.0/8         # item of clash classical payload
+//	- '+.google.com'            # clash domain: google.com and its sub domains
+//	.google.com                 # surge domain set: google.com and its sub domains
+//	www.google.com              # domain
+//	91.108.4.0/22               # cidr
+func parseRuleSet(data []byte, proxy string) (patterns []Pattern, skipped int) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for _, sep := range []string{" #", " //"} {
+			if i := strings.Index(line, sep); i >= 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+		}
+		if line == "" || line[0] == '#' || line[0] == ';' || strings.HasPrefix(line, "//") || line == "payload:" {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "- "))
+		line = strings.Trim(line, `'"`)
+
+		var rc RuleConfig
+		if strings.Contains(line, ",") {
+			fields := strings.Split(line, ",")
+			rc = RuleConfig{Schema: strings.TrimSpace(fields[0]), Pattern: strings.TrimSpace(fields[1])}
+			if hasCompoundPattern(rc.Schema) {
+				rc.Pattern = strings.TrimSpace(line[len(fields[0])+1:])
+			}
+		} else if domain := strings.TrimPrefix(strings.TrimPrefix(line, "+"), "."); domain != line {
+			rc = RuleConfig{Schema: "DOMAIN-SUFFIX", Pattern: domain}
+		} else if _, _, err := net.ParseCIDR(line); err == nil {
+			rc = RuleConfig{Schema: "IP-CIDR", Pattern: line}
+		} else if ip := net.ParseIP(line); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			rc = RuleConfig{Schema: "IP-CIDR", Pattern: fmt.Sprintf("%s/%d", ip, bits)}
+		} else {
+			rc = RuleConfig{Schema: "DOMAIN", Pattern: line}
+		}
+
+		// no nested rule set or geosite, and no final rule
+		switch strings.ToUpper(rc.Schema) {
+		case "RULE-SET", "GEOSITE", "FINAL", "MATCH":
+			skipped++
+			continue
+		}
+
+		rc.Proxy = proxy
+		pattern, err := parsePattern(rc)
+		if err != nil {
+			logger.Debugf("[rule-set] skip %q: %v", line, err)
+			skipped++
+			continue
+		}
+		if pattern != nil {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, skipped
+}
@@ -0,0 +1,157 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRuleSet(t *testing.T) {
+	data := `
+# surge list
+DOMAIN-SUFFIX,google.com
+IP-CIDR,91.108.4.0/22,no-resolve
+USER-AGENT,Telegram*
+DOMAIN-REGEX,^img[0-9]{1,2}\.cdn\.net$
+RULE-SET,https://example.com/other.list
+// clash payload
+payload:
+  - DOMAIN,www.twitter.com
+  - '+.telegram.org'
+  - "149.154.160.0/20"
+.facebook.com
+www.youtube.com # domain
+8.8.8.8
+2001:db8::/32
+`
+	patterns, skipped := parseRuleSet([]byte(data), "Proxy1")
+	assert.Len(t, patterns, 10)
+	assert.Equal(t, 2, skipped)
+
+	rule := &Rule{patterns: patterns, configs: make([]RuleConfig, len(patterns)), matcher: newRuleMatcher(patterns)}
+	for _, c := range []struct {
+		val     interface{}
+		matched bool
+	}{
+		{"mail.google.com", true},
+		{net.ParseIP("91.108.5.1"), true},
+		{"www.twitter.com", true},
+		{"api.twitter.com", false},
+		{"img12.cdn.net", true},
+		{"img123.cdn.net", false},
+		{"core.telegram.org", true},
+		{net.ParseIP("149.154.167.1"), true},
+		{"www.facebook.com", true},
+		{"www.youtube.com", true},
+		{net.ParseIP("8.8.8.8"), true},
+		{net.ParseIP("8.8.4.4"), false},
+		{net.ParseIP("2001:db8::1"), true},
+		{&Flow{Network: "tcp", DstIP: net.ParseIP("8.8.8.8"), DstPort: 443}, true},
+	} {
+		proxy := PolicyDirect
+		if c.matched {
+			proxy = "Proxy1"
+		}
+		assert.Equal(t, proxy, rule.Proxy(c.val), c.val)
+	}
+
+	// logical rule
+	patterns, skipped = parseRuleSet([]byte("AND,((NETWORK,udp),(DST-PORT,443))\n"), "Proxy1")
+	require.Len(t, patterns, 1)
+	assert.Zero(t, skipped)
+	assert.True(t, patterns[0].Match(&Flow{Network: "udp", DstIP: net.ParseIP("8.8.4.4"), DstPort: 443}))
+	assert.False(t, patterns[0].Match(&Flow{Network: "tcp", DstIP: net.ParseIP("8.8.4.4"), DstPort: 443}))
+}
+
+func TestRuleSetURL(t *testing.T) {
+	var lock sync.Mutex
+	list := "DOMAIN-SUFFIX,google.com\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Write([]byte(list))
+	}))
+	defer ts.Close()
+
+	cfg := &KoneConfig{}
+	cfg.General.RuleSetDir = t.TempDir()
+	cfg.General.RuleSetInterval = 3600
+
+	rule := NewRule([]RuleConfig{
+		{Schema: "DOMAIN", Pattern: "www.google.com", Proxy: PolicyDirect},
+		{Schema: "RULE-SET", Pattern: ts.URL + "/google.list", Proxy: "Proxy1"},
+		{Schema: "FINAL", Proxy: PolicyReject},
+	})
+	rule.LoadRuleSets(cfg, nil)
+	set := rule.ruleSets()[0]
+
+	// first match wins
+	assert.Equal(t, PolicyDirect, rule.Proxy("www.google.com"))
+	assert.Equal(t, "Proxy1", rule.Proxy("mail.google.com"))
+	assert.Equal(t, PolicyReject, rule.Proxy("www.twitter.com"))
+
+	// cached on disk
+	data, err := os.ReadFile(set.path)
+	require.NoError(t, err)
+	assert.Equal(t, list, string(data))
+	assert.Equal(t, cfg.General.RuleSetDir, filepath.Dir(set.path))
+
+	// refreshed by Serve
+	lock.Lock()
+	list = "DOMAIN-SUFFIX,twitter.com\n"
+	lock.Unlock()
+	updated := make(chan struct{}, 1)
+	set.onUpdate = func() { updated <- struct{}{} }
+	set.interval = 10 * time.Millisecond
+	go rule.Serve()
+	select {
+	case <-updated:
+	case <-time.After(3 * time.Second):
+		t.Fatal("rule set is not refreshed")
+	}
+	rule.Close()
+	assert.Equal(t, PolicyReject, rule.Proxy("mail.google.com"))
+	assert.Equal(t, "Proxy1", rule.Proxy("www.twitter.com"))
+
+	// fall back to cache if url is unavailable
+	ts.Close()
+	rule = NewRule([]RuleConfig{
+		{Schema: "RULE-SET", Pattern: ts.URL + "/google.list", Proxy: "Proxy1"},
+	})
+	stale := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(set.path, stale, stale))
+	rule.LoadRuleSets(cfg, nil)
+	assert.Equal(t, "Proxy1", rule.Proxy("www.twitter.com"))
+}
+
+func TestRuleSetFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cidr.list"), []byte("91.108.4.0/22\n"), 0644))
+
+	cfg := &KoneConfig{source: filepath.Join(dir, "kone.ini")}
+	rule := NewRule([]RuleConfig{
+		{Schema: "RULE-SET", Pattern: "cidr.list", Proxy: "Proxy1"},
+		{Schema: "RULE-SET", Pattern: "missing.list", Proxy: "Proxy2"},
+	})
+	rule.LoadRuleSets(cfg, nil)
+	assert.Equal(t, "Proxy1", rule.Proxy(net.ParseIP("91.108.5.1")))
+	assert.Equal(t, PolicyDirect, rule.Proxy(net.ParseIP("91.108.8.1")))
+
+	// rule set cidrs are routed to tun
+	one := &One{}
+	_, ipNet, _ := net.ParseCIDR("91.108.4.0/22")
+	assert.Equal(t, []*net.IPNet{ipNet}, one.ruleRoutes(rule))
+}
@@ -31,13 +31,39 @@ func initTun(tun string, ipNet *net.IPNet, mtu int) error {
 	return addRoute(tun, ipNet)
 }
 
+func initTun6(tun string, ipNet *net.IPNet) error {
+	ones, _ := ipNet.Mask.Size()
+	sargs := fmt.Sprintf("%s inet6 %s prefixlen %d", tun, ipNet.IP.String(), ones)
+	if err := execCommand("ifconfig", sargs); err != nil {
+		return err
+	}
+	return addRoute(tun, ipNet)
+}
+
 func addRoute(tun string, subnet *net.IPNet) error {
+	if subnet.IP.To4() == nil {
+		sargs := fmt.Sprintf("-n add -inet6 -net %s -interface %s", subnet.String(), tun)
+		return execCommand("route", sargs)
+	}
+
 	ip := subnet.IP
 	maskIP := net.IP(subnet.Mask)
 	sargs := fmt.Sprintf("-n add -net %s -netmask %s -interface %s", ip.String(), maskIP.String(), tun)
 	return execCommand("route", sargs)
 }
 
+func delRoute(tun string, subnet *net.IPNet) error {
+	if subnet.IP.To4() == nil {
+		sargs := fmt.Sprintf("-n delete -inet6 -net %s -interface %s", subnet.String(), tun)
+		return execCommand("route", sargs)
+	}
+
+	ip := subnet.IP
+	maskIP := net.IP(subnet.Mask)
+	sargs := fmt.Sprintf("-n delete -net %s -netmask %s -interface %s", ip.String(), maskIP.String(), tun)
+	return execCommand("route", sargs)
+}
+
 func createTun(ip net.IP, mask net.IPMask) (*water.Interface, error) {
 	ifce, err := water.New(water.Config{
 		DeviceType: water.TUN,
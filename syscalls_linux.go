@@ -32,11 +32,21 @@ func initTun(tun string, ipNet *net.IPNet, mtu int) error {
 	return execCommand("ip", sargs)
 }
 
+func initTun6(tun string, ipNet *net.IPNet) error {
+	sargs := fmt.Sprintf("-6 addr add %s dev %s", ipNet, tun)
+	return execCommand("ip", sargs)
+}
+
 func addRoute(tun string, subnet *net.IPNet) error {
 	sargs := fmt.Sprintf("route add %s dev %s", subnet, tun)
 	return execCommand("ip", sargs)
 }
 
+func delRoute(tun string, subnet *net.IPNet) error {
+	sargs := fmt.Sprintf("route del %s dev %s", subnet, tun)
+	return execCommand("ip", sargs)
+}
+
 func createTun(ip net.IP, mask net.IPMask) (*water.Interface, error) {
 	ifce, err := water.New(water.Config{
 		DeviceType: water.TUN,
@@ -19,10 +19,18 @@ func initTun(tun string, ipNet *net.IPNet, mtu int) error {
 	return errOS
 }
 
+func initTun6(tun string, ipNet *net.IPNet) error {
+	return errOS
+}
+
 func addRoute(tun string, subnet *net.IPNet) error {
 	return errOS
 }
 
+func delRoute(tun string, subnet *net.IPNet) error {
+	return errOS
+}
+
 func fixTunIP(ip net.IP) net.IP {
 	return ip
 }
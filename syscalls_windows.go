@@ -35,13 +35,26 @@ func clearRoute(tun string) {
 func addRoute(tun string, subnet *net.IPNet) error {
 	tun = fmt.Sprintf(`"%s"`, tun)
 	subnetArg := fmt.Sprintf(`"%s"`, subnet.String())
+
+	family, nextHop := "IPv4", tunNet
+	if subnet.IP.To4() == nil {
+		family, nextHop = "IPv6", "::" // on-link
+	}
 	return powershell(
 		"New-NetRoute",
 		"-DestinationPrefix", subnetArg,
 		"-InterfaceAlias", tun,
 		"-PolicyStore", "ActiveStore",
-		"-AddressFamily", "IPv4",
-		"-NextHop", tunNet)
+		"-AddressFamily", family,
+		"-NextHop", nextHop)
+}
+
+func delRoute(tun string, subnet *net.IPNet) error {
+	return powershell(
+		"Remove-NetRoute",
+		"-DestinationPrefix", fmt.Sprintf(`"%s"`, subnet.String()),
+		"-InterfaceAlias", fmt.Sprintf(`"%s"`, tun),
+		"-Confirm:$false")
 }
 
 func createTun(ip net.IP, mask net.IPMask) (*water.Interface, error) {
@@ -137,6 +150,19 @@ func initTun(tun string, ipNet *net.IPNet, mtu int) (err error) {
 		"-AddressFamily", "IPv4")
 }
 
+func initTun6(tun string, ipNet *net.IPNet) error {
+	tun = fmt.Sprintf(`"%s"`, tun)
+	ip := fmt.Sprintf(`"%s"`, ipNet.IP)
+	prefix := strings.Split(ipNet.String(), "/")[1]
+	return powershell(
+		"New-NetIPAddress",
+		"-InterfaceAlias", tun,
+		"-IPAddress", ip,
+		"-PrefixLength", prefix,
+		"-PolicyStore", "ActiveStore",
+		"-AddressFamily", "IPv6")
+}
+
 func fixTunIP(ip net.IP) net.IP {
 	return ip
 }
@@ -6,33 +6,45 @@
 package kone
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xjdrew/kone/tcpip"
 )
 
+const TCPDirectDialTimeout = 10 // seconds
+
 type TCPRelay struct {
 	one       *One
 	nat       *Nat
 	relayIP   net.IP
+	relayIP6  net.IP // nil if IPv6 is disabled
 	relayPort uint16
+
+	lock      sync.Mutex
+	closed    bool
+	listeners []net.Listener
+	conns     sync.WaitGroup // in-flight connections
 }
 
-func copy(src net.Conn, dst net.Conn, ch chan<- int64) {
+func copy(src net.Conn, dst net.Conn, counter *atomic.Int64, ch chan<- int64) {
 	defer dst.Close()
 
-	written, _ := io.Copy(dst, src)
+	written, _ := io.Copy(&countWriter{dst, counter}, src)
 	ch <- written
 }
 
-func (r *TCPRelay) realRemoteHost(conn net.Conn, connData *ConnData) (addr string, proxy string) {
+// return original source address, real remote address and proxy of conn matched by rt, and its nat session
+func (r *TCPRelay) realRemoteHost(conn net.Conn, connData *ConnData, rt *routing) (src string, addr string, proxy string, session *NatSession) {
 	remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
 	remotePort := uint16(remoteAddr.Port)
 
-	session := r.nat.getSession(remotePort)
+	session = r.nat.getSession(remotePort)
 	if session == nil {
 		logger.Errorf("[tcp relay] %s > %s no session", conn.LocalAddr(), remoteAddr)
 		return
@@ -42,61 +54,109 @@ func (r *TCPRelay) realRemoteHost(conn net.Conn, connData *ConnData) (addr strin
 	dstIP := session.dstIP
 
 	var host string
+	var record *DomainRecord
+	flow := &Flow{Network: "tcp", SrcIP: session.srcIP, DstPort: session.dstPort}
 	if one.dnsTable.IsLocalIP(dstIP) { // for dns hijacked traffic
-		record := one.dnsTable.GetByIP(dstIP)
+		record = one.dnsTable.GetByIP(dstIP)
 		if record == nil {
 			logger.Debugf("[tcp relay] %s:%d > %s:%d dns expired", session.srcIP, session.srcPort, dstIP, session.dstPort)
 			return
 		}
 
 		host = record.Hostname
-		proxy = record.Proxy
+		flow.Domain = host
 	} else { // for IP-CIDR rule traffic
 		host = dstIP.String()
-		proxy = one.rule.Proxy(dstIP)
+		flow.DstIP = dstIP
+	}
+	proxy = one.flowProxy(rt.rule, flow, record)
+
+	if proc := one.lookupProcess(rt.rule, "tcp", session); proc != nil {
+		connData.Process = proc.Name
+		if p, ok := rt.rule.ProcessProxy(proc); ok {
+			proxy = p
+		}
 	}
 
 	connData.Src = session.srcIP.String()
 	connData.Dst = host
 	connData.Proxy = proxy
 
-	addr = fmt.Sprintf("%s:%d", host, session.dstPort)
+	src = net.JoinHostPort(connData.Src, strconv.Itoa(int(session.srcPort)))
+	addr = net.JoinHostPort(host, strconv.Itoa(int(session.dstPort)))
+	if proxy == PolicyDirect { // by flow or process rules
+		if record == nil { // ip routed to tun can't be connected directly
+			logger.Errorf("[tcp relay] %s > %s traffic dead loop", src, addr)
+			addr = ""
+			return
+		}
+		// connect to real ip of domain
+		ip, err := one.dns.RealIP(record)
+		if err != nil {
+			logger.Errorf("[tcp relay] %s: %v", addr, err)
+			addr = ""
+			return
+		}
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(session.dstPort)))
+	}
 	logger.Debugf("[tcp relay] tunnel %s:%d > %s proxy %q", session.srcIP, session.srcPort, addr, proxy)
 	return
 }
 
 func (r *TCPRelay) handleConn(conn net.Conn) {
 	var connData ConnData
-	remoteAddr, proxy := r.realRemoteHost(conn, &connData)
+	rt := r.one.routing()
+	src, remoteAddr, proxy, session := r.realRemoteHost(conn, &connData, rt)
 	if remoteAddr == "" {
 		conn.Close()
 		return
 	}
 
-	if proxy == "DIRECT" { // impossible
+	if IsRejectPolicy(proxy) {
+		// reset connection: send RST instead of FIN
+		conn.(*net.TCPConn).SetLinger(0)
 		conn.Close()
-		logger.Errorf("[tcp relay] %s > %s traffic dead loop", conn.LocalAddr(), remoteAddr)
+		logger.Debugf("[tcp relay] reject %s by %s", remoteAddr, proxy)
+		if r.one.manager != nil {
+			r.one.manager.rejectTcp.Add(1)
+		}
 		return
 	}
 
-	proxies := r.one.proxies
-	tunnel, err := proxies.Dial(proxy, remoteAddr)
+	var tunnel net.Conn
+	var err error
+	if proxy == PolicyDirect {
+		tunnel, err = net.DialTimeout("tcp", remoteAddr, TCPDirectDialTimeout*time.Second)
+	} else {
+		tunnel, err = rt.proxies.Dial(proxy, remoteAddr)
+	}
 	if err != nil {
 		conn.Close()
 		logger.Errorf("[tcp relay] dial %s by proxy %q failed: %s", remoteAddr, proxy, err)
+		if r.one.manager != nil {
+			r.one.manager.dialFailed(proxy)
+		}
 		return
 	}
 
 	logger.Debugf("[tcp relay] new tunnel, to %s through %s", remoteAddr, proxy)
 
+	active := r.one.conns.add("tcp", src, remoteAddr, proxy, func() {
+		conn.Close()
+		tunnel.Close()
+	})
+	defer r.one.conns.remove(active)
+	r.one.labelProcess(active, rt.rule, connData.Process, "tcp", session)
+
 	uploadChan := make(chan int64)
 	downloadChan := make(chan int64)
 
-	go copy(conn, tunnel, uploadChan)
-	go copy(tunnel, conn, downloadChan)
+	go copy(conn, tunnel, &active.upload, uploadChan)
+	go copy(tunnel, conn, &active.download, downloadChan)
 
 	connData.Upload = <-uploadChan
 	connData.Download = <-downloadChan
+	connData.Process = active.processName()
 
 	logger.Debugf("[tcp relay] domain %s, upload %v bytes, download %v bytes", remoteAddr, connData.Upload, connData.Download)
 	if r.one.manager != nil {
@@ -104,30 +164,90 @@ func (r *TCPRelay) handleConn(conn net.Conn) {
 	}
 }
 
-func (r *TCPRelay) Serve() error {
-	addr := &net.TCPAddr{IP: r.relayIP, Port: int(r.relayPort)}
+func (r *TCPRelay) serve(ip net.IP) error {
+	addr := &net.TCPAddr{IP: ip, Port: int(r.relayPort)}
 	ln, err := net.ListenTCP("tcp", addr)
 	if err != nil {
 		logger.Errorf("[tcp relay] listen failed: %v", err)
 		return err
 	}
 
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		ln.Close()
+		return nil
+	}
+	r.listeners = append(r.listeners, ln)
+	r.lock.Unlock()
+
 	logger.Infof("[tcp relay] listen on %v", addr)
 
 	for {
 		conn, err := ln.AcceptTCP()
 		if err != nil {
+			if r.isClosed() {
+				return nil
+			}
 			logger.Errorf("[tcp relay] acceept failed temporary: %v", err)
 			time.Sleep(time.Second) //prevent log storms
 			continue
 		}
 		logger.Debugf("[tcp relay] new connection [%s > %s]", conn.RemoteAddr(), conn.LocalAddr())
-		go r.handleConn(conn)
+		r.conns.Add(1)
+		go func() {
+			defer r.conns.Done()
+			r.handleConn(conn)
+		}()
+	}
+}
+
+func (r *TCPRelay) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+// Shutdown stops accepting connections and waits in-flight connections to finish until ctx is done,
+// then closes the remaining ones
+func (r *TCPRelay) Shutdown(ctx context.Context) error {
+	r.lock.Lock()
+	r.closed = true
+	for _, ln := range r.listeners {
+		ln.Close()
+	}
+	r.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		n := r.one.conns.closeIf(func(c *activeConn) bool {
+			return c.info.Network == "tcp"
+		})
+		logger.Warningf("[tcp relay] drain timeout, close %d connections", n)
+		return ctx.Err()
 	}
 }
 
+func (r *TCPRelay) Serve() error {
+	if r.relayIP6 != nil {
+		errCh := make(chan error, 2)
+		go func() { errCh <- r.serve(r.relayIP) }()
+		go func() { errCh <- r.serve(r.relayIP6) }()
+		return <-errCh
+	}
+	return r.serve(r.relayIP)
+}
+
 // redirect tcp packet to relay
-func (r *TCPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
+func (r *TCPRelay) Filter(wr io.Writer, ipPacket tcpip.IPPacket) {
 	tcpPacket := tcpip.TCPPacket(ipPacket.Payload())
 
 	srcIP := ipPacket.SourceIP()
@@ -135,7 +255,16 @@ func (r *TCPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
 	srcPort := tcpPacket.SourcePort()
 	dstPort := tcpPacket.DestinationPort()
 
-	if r.relayIP.Equal(srcIP) && srcPort == r.relayPort {
+	relayIP := r.relayIP
+	if ipPacket.Version() == 6 {
+		relayIP = r.relayIP6
+		if relayIP == nil {
+			logger.Debugf("[tcp filter] %s:%d > %s:%d: ipv6 is disabled", srcIP, srcPort, dstIP, dstPort)
+			return
+		}
+	}
+
+	if relayIP.Equal(srcIP) && srcPort == r.relayPort {
 		// from relay
 		session := r.nat.getSession(dstPort)
 		if session == nil {
@@ -153,19 +282,19 @@ func (r *TCPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
 
 		ipPacket.SetSourceIP(dstIP)
 		tcpPacket.SetSourcePort(port)
-		ipPacket.SetDestinationIP(r.relayIP)
+		ipPacket.SetDestinationIP(relayIP)
 		tcpPacket.SetDestinationPort(r.relayPort)
 
 		if isNew {
 			logger.Debugf("[tcp filter] reshape connection from [%s:%d > %s:%d] to [%s:%d > %s:%d]",
-				srcIP, srcPort, dstIP, dstPort, dstIP, port, r.relayIP, r.relayPort)
+				srcIP, srcPort, dstIP, dstPort, dstIP, port, relayIP, r.relayPort)
 		}
 	}
 
 	// write back packet
 	tcpPacket.ResetChecksum(ipPacket.PseudoSum())
 	ipPacket.ResetChecksum()
-	wr.Write(ipPacket)
+	wr.Write(ipPacket.Bytes())
 }
 
 func NewTCPRelay(one *One, cfg CoreConfig) *TCPRelay {
@@ -173,6 +302,7 @@ func NewTCPRelay(one *One, cfg CoreConfig) *TCPRelay {
 	relay.one = one
 	relay.nat = NewNat(cfg.TcpNatPortStart, cfg.TcpNatPortEnd)
 	relay.relayIP = one.ip
+	relay.relayIP6 = one.ip6
 	relay.relayPort = cfg.TcpListenPort
 	return relay
 }
@@ -0,0 +1,91 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func freePort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestTCPRelayShutdown(t *testing.T) {
+	one := &One{conns: NewConnTable()}
+	r := &TCPRelay{
+		one:       one,
+		nat:       NewNat(10000, 10100),
+		relayIP:   net.ParseIP("127.0.0.1"),
+		relayPort: freePort(t),
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.Serve() }()
+	addr := net.JoinHostPort(r.relayIP.String(), strconv.Itoa(int(r.relayPort)))
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// a connection drains by itself
+	r.conns.Add(1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r.conns.Done()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	require.NoError(t, r.Shutdown(ctx))
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve does not exit")
+	}
+
+	// a stuck connection is closed on timeout
+	r.conns.Add(1)
+	stuck := one.conns.add("tcp", "10.0.0.2:5000", "www.google.com:443", "Proxy1", func() {
+		r.conns.Done()
+	})
+	one.conns.add("udp", "10.0.0.2:5001", "www.google.com:53", "Proxy1", func() {
+		t.Error("udp tunnel should not be closed")
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, r.Shutdown(ctx), context.DeadlineExceeded)
+	one.conns.remove(stuck)
+	r.conns.Wait()
+}
+
+func TestDnsTableClose(t *testing.T) {
+	ip, subnet, _ := net.ParseCIDR("10.192.0.1/16")
+	c := NewDnsTable(ip, subnet, nil, nil)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Serve() }()
+	c.Close()
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve does not exit")
+	}
+}
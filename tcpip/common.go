@@ -9,6 +9,20 @@ import (
 	"net"
 )
 
+// IPPacket is implemented by IPv4Packet and IPv6Packet
+type IPPacket interface {
+	Version() int
+	Protocol() IPProtocol
+	SourceIP() net.IP
+	SetSourceIP(ip net.IP)
+	DestinationIP() net.IP
+	SetDestinationIP(ip net.IP)
+	Payload() []byte
+	PseudoSum() uint32
+	ResetChecksum()
+	Bytes() []byte
+}
+
 func IsIPv4(packet []byte) bool {
 	return (packet[0] >> 4) == 4
 }
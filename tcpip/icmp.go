@@ -14,6 +14,9 @@ type ICMPType byte
 const (
 	ICMPEcho    ICMPType = 0x0
 	ICMPRequest ICMPType = 0x8
+
+	ICMPv6Request ICMPType = 0x80
+	ICMPv6Echo    ICMPType = 0x81
 )
 
 type ICMPPacket []byte
@@ -43,3 +46,9 @@ func (p ICMPPacket) ResetChecksum() {
 	p.SetChecksum(zeroChecksum)
 	p.SetChecksum(Checksum(0, p))
 }
+
+// icmpv6 checksum covers pseudo header
+func (p ICMPPacket) ResetChecksumV6(psum uint32) {
+	p.SetChecksum(zeroChecksum)
+	p.SetChecksum(Checksum(psum, p))
+}
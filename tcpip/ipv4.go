@@ -13,13 +13,18 @@ import (
 type IPProtocol byte
 
 const (
-	ICMP IPProtocol = 0x01
-	TCP  IPProtocol = 0x06
-	UDP  IPProtocol = 0x11
+	ICMP   IPProtocol = 0x01
+	TCP    IPProtocol = 0x06
+	UDP    IPProtocol = 0x11
+	ICMPv6 IPProtocol = 0x3a
 )
 
 type IPv4Packet []byte
 
+func (p IPv4Packet) Version() int {
+	return 4
+}
+
 func (p IPv4Packet) TotalLen() uint16 {
 	return binary.BigEndian.Uint16(p[2:])
 }
@@ -85,3 +90,7 @@ func (p IPv4Packet) PseudoSum() uint32 {
 	sum += uint32(p.DataLen())
 	return sum
 }
+
+func (p IPv4Packet) Bytes() []byte {
+	return p
+}
@@ -0,0 +1,73 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package tcpip
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const IPv6HeaderLen = 40
+
+// IPv6 packet without extension headers
+type IPv6Packet []byte
+
+func (p IPv6Packet) Version() int {
+	return 6
+}
+
+func (p IPv6Packet) PayloadLen() uint16 {
+	return binary.BigEndian.Uint16(p[4:])
+}
+
+func (p IPv6Packet) Payload() []byte {
+	return p[IPv6HeaderLen : IPv6HeaderLen+int(p.PayloadLen())]
+}
+
+// next header
+func (p IPv6Packet) Protocol() IPProtocol {
+	return IPProtocol(p[6])
+}
+
+func (p IPv6Packet) SourceIP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p[8:24])
+	return ip
+}
+
+func (p IPv6Packet) SetSourceIP(ip net.IP) {
+	if ip.To4() == nil {
+		copy(p[8:24], ip.To16())
+	}
+}
+
+func (p IPv6Packet) DestinationIP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p[24:40])
+	return ip
+}
+
+func (p IPv6Packet) SetDestinationIP(ip net.IP) {
+	if ip.To4() == nil {
+		copy(p[24:40], ip.To16())
+	}
+}
+
+// IPv6 has no header checksum
+func (p IPv6Packet) ResetChecksum() {
+}
+
+// for tcp/udp/icmpv6 checksum
+func (p IPv6Packet) PseudoSum() uint32 {
+	sum := Sum(p[8:40])
+	sum += uint32(p.Protocol())
+	sum += uint32(p.PayloadLen())
+	return sum
+}
+
+func (p IPv6Packet) Bytes() []byte {
+	return p
+}
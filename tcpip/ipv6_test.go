@@ -0,0 +1,48 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package tcpip
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPv6Packet(t *testing.T) {
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("2001:db8::2")
+	data := []byte("hello")
+
+	b := make([]byte, IPv6HeaderLen+8+len(data))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(8+len(data)))
+	b[6] = byte(UDP)
+	b[7] = 64
+	copy(b[IPv6HeaderLen+8:], data)
+
+	assert.True(t, IsIPv6(b))
+	p := IPv6Packet(b)
+	p.SetSourceIP(src)
+	p.SetDestinationIP(dst)
+	assert.Equal(t, UDP, p.Protocol())
+	assert.True(t, src.Equal(p.SourceIP()))
+	assert.True(t, dst.Equal(p.DestinationIP()))
+
+	udp := UDPPacket(p.Payload())
+	udp.SetSourcePort(1234)
+	udp.SetDestinationPort(53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	udp.ResetChecksum(p.PseudoSum())
+
+	// a valid checksum sums up to zero
+	assert.Equal(t, zeroChecksum, Checksum(p.PseudoSum(), udp))
+
+	// IPv4 address is ignored
+	p.SetSourceIP(net.ParseIP("1.2.3.4"))
+	assert.True(t, src.Equal(p.SourceIP()))
+}
@@ -6,7 +6,10 @@
 package kone
 
 import (
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/songgao/water"
 
@@ -18,6 +21,10 @@ var MTU = 1500
 type TunDriver struct {
 	ifce    *water.Interface
 	filters map[tcpip.IPProtocol]PacketFilter
+	closed  atomic.Bool
+
+	routesLock sync.Mutex
+	routes     []*net.IPNet // routes added by AddRoute
 }
 
 func (tun *TunDriver) Serve() error {
@@ -28,31 +35,130 @@ func (tun *TunDriver) Serve() error {
 	for {
 		n, err := ifce.Read(buffer)
 		if err != nil {
+			if tun.closed.Load() {
+				return nil
+			}
 			logger.Errorf("[tun] read failed: %v", err)
 			return err
 		}
 
 		packet := buffer[:n]
+
+		var ipPacket tcpip.IPPacket
 		if tcpip.IsIPv4(packet) {
-			ipPacket := tcpip.IPv4Packet(packet)
-			protocol := ipPacket.Protocol()
-			filter := filters[protocol]
-			if filter == nil {
-				logger.Noticef("%v > %v protocol %d unsupport", ipPacket.SourceIP(), ipPacket.DestinationIP(), protocol)
-				continue
-			}
+			ipPacket = tcpip.IPv4Packet(packet)
+		} else if tcpip.IsIPv6(packet) && len(packet) >= tcpip.IPv6HeaderLen {
+			ipPacket = tcpip.IPv6Packet(packet)
+		} else {
+			continue
+		}
 
-			filter.Filter(ifce, ipPacket)
+		protocol := ipPacket.Protocol()
+		filter := filters[protocol]
+		if filter == nil {
+			logger.Noticef("%v > %v protocol %d unsupport", ipPacket.SourceIP(), ipPacket.DestinationIP(), protocol)
+			continue
 		}
+
+		filter.Filter(ifce, ipPacket)
 	}
 }
 
 func (tun *TunDriver) AddRoute(ipNet *net.IPNet) bool {
-	addRoute(tun.ifce.Name(), ipNet)
+	if err := addRoute(tun.ifce.Name(), ipNet); err != nil {
+		logger.Errorf("add route %s by %s failed: %v", ipNet.String(), tun.ifce.Name(), err)
+		return false
+	}
 	logger.Infof("add route %s by %s", ipNet.String(), tun.ifce.Name())
+
+	tun.routesLock.Lock()
+	tun.routes = append(tun.routes, ipNet)
+	tun.routesLock.Unlock()
 	return true
 }
 
+// RemoveRoutes removes all routes added by AddRoute
+func (tun *TunDriver) RemoveRoutes() {
+	tun.routesLock.Lock()
+	defer tun.routesLock.Unlock()
+	for _, ipNet := range tun.routes {
+		if err := delRoute(tun.ifce.Name(), ipNet); err != nil {
+			logger.Warningf("remove route %s by %s failed: %v", ipNet.String(), tun.ifce.Name(), err)
+			continue
+		}
+		logger.Infof("remove route %s by %s", ipNet.String(), tun.ifce.Name())
+	}
+	tun.routes = nil
+}
+
+// compare routes by subnet, returns routes to add and routes to remove
+func diffRoutes(current []*net.IPNet, wanted []*net.IPNet) (added []*net.IPNet, removed []*net.IPNet) {
+	exists := make(map[string]bool)
+	for _, ipNet := range current {
+		exists[ipNet.String()] = true
+	}
+	keep := make(map[string]bool)
+	for _, ipNet := range wanted {
+		key := ipNet.String()
+		if !exists[key] && !keep[key] {
+			added = append(added, ipNet)
+		}
+		keep[key] = true
+	}
+	for _, ipNet := range current {
+		if !keep[ipNet.String()] {
+			removed = append(removed, ipNet)
+		}
+	}
+	return
+}
+
+// SetRoutes adds missing routes and removes stale ones, so routes of tun are exactly ipNets.
+// If a route fails to add, routes added by this call are removed and the error is returned.
+func (tun *TunDriver) SetRoutes(ipNets []*net.IPNet) error {
+	tun.routesLock.Lock()
+	defer tun.routesLock.Unlock()
+
+	name := tun.ifce.Name()
+	added, removed := diffRoutes(tun.routes, ipNets)
+	for i, ipNet := range added {
+		if err := addRoute(name, ipNet); err != nil {
+			for _, ipNet := range added[:i] {
+				if err := delRoute(name, ipNet); err != nil {
+					logger.Warningf("remove route %s by %s failed: %v", ipNet.String(), name, err)
+				}
+			}
+			return fmt.Errorf("add route %s by %s failed: %w", ipNet.String(), name, err)
+		}
+		logger.Infof("add route %s by %s", ipNet.String(), name)
+	}
+
+	stale := make(map[string]bool)
+	for _, ipNet := range removed {
+		if err := delRoute(name, ipNet); err != nil {
+			logger.Warningf("remove route %s by %s failed: %v", ipNet.String(), name, err)
+		} else {
+			logger.Infof("remove route %s by %s", ipNet.String(), name)
+		}
+		stale[ipNet.String()] = true
+	}
+
+	routes := make([]*net.IPNet, 0, len(tun.routes)+len(added))
+	for _, ipNet := range tun.routes {
+		if !stale[ipNet.String()] {
+			routes = append(routes, ipNet)
+		}
+	}
+	tun.routes = append(routes, added...)
+	return nil
+}
+
+// Close stops Serve
+func (tun *TunDriver) Close() error {
+	tun.closed.Store(true)
+	return tun.ifce.Close()
+}
+
 func (tun *TunDriver) AddRouteString(val string) bool {
 	_, subnet, err := net.ParseCIDR(val)
 	if err != nil {
@@ -61,10 +167,19 @@ func (tun *TunDriver) AddRouteString(val string) bool {
 	return tun.AddRoute(subnet)
 }
 
-func NewTunDriver(ip net.IP, subnet *net.IPNet, filters map[tcpip.IPProtocol]PacketFilter) (*TunDriver, error) {
+// ip6 & subnet6 are optional, IPv6 is disabled if they are nil
+func NewTunDriver(ip net.IP, subnet *net.IPNet, ip6 net.IP, subnet6 *net.IPNet, filters map[tcpip.IPProtocol]PacketFilter) (*TunDriver, error) {
 	ifce, err := createTun(ip, subnet.Mask)
 	if err != nil {
 		return nil, err
 	}
+
+	if ip6 != nil {
+		ipNet6 := &net.IPNet{IP: ip6, Mask: subnet6.Mask}
+		if err := initTun6(ifce.Name(), ipNet6); err != nil {
+			return nil, err
+		}
+		logger.Infof("[tun] ipv6 addr %s", ipNet6)
+	}
 	return &TunDriver{ifce: ifce, filters: filters}, nil
 }
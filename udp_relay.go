@@ -6,8 +6,10 @@
 package kone
 
 import (
+	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -21,7 +23,9 @@ type UDPTunnel struct {
 	cliaddr *net.UDPAddr
 
 	localConn  *net.UDPConn
-	remoteConn *net.UDPConn
+	remoteConn net.Conn // direct udp connection, or packet connection through proxy
+
+	active *activeConn
 }
 
 func (tunnel *UDPTunnel) SetDeadline(duration time.Duration) error {
@@ -33,7 +37,7 @@ func (tunnel *UDPTunnel) Pump() error {
 	for {
 		n, err := tunnel.remoteConn.Read(b)
 		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				return nil
 			}
 			return err
@@ -42,87 +46,194 @@ func (tunnel *UDPTunnel) Pump() error {
 		if err != nil {
 			return err
 		}
+		tunnel.active.download.Add(int64(n))
 	}
 }
 
 func (tunnel *UDPTunnel) Write(b []byte) (int, error) {
-	return tunnel.remoteConn.Write(b)
+	n, err := tunnel.remoteConn.Write(b)
+	tunnel.active.upload.Add(int64(n))
+	return n, err
 }
 
 type UDPRelay struct {
 	one       *One
 	nat       *Nat
 	relayIP   net.IP
+	relayIP6  net.IP // nil if IPv6 is disabled
 	relayPort uint16
 
-	lock    sync.Mutex
-	tunnels map[string]*UDPTunnel
+	lock      sync.Mutex
+	tunnels   map[string]*UDPTunnel
+	setups    map[string]*udpTunnelSetup // tunnels in setup, by address of client
+	closed    bool
+	listeners []*net.UDPConn
 }
 
-// bypass udp packet
-func (r *UDPRelay) grabTunnel(localConn *net.UDPConn, cliaddr *net.UDPAddr) *UDPTunnel {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	addr := cliaddr.String()
-	tunnel := r.tunnels[addr]
-	if tunnel == nil {
-		port := uint16(cliaddr.Port)
-		session := r.nat.getSession(port)
-		if session == nil {
-			return nil
-		}
-		record := r.one.dnsTable.GetByIP(session.dstIP)
-		if record == nil { // by IP-CIDR rule
-			return nil
-		}
+// connect to the real remote endpoint of host through proxy, record is nil if host is an ip routed by IP-CIDR rules
+func (r *UDPRelay) dialRemote(proxies *Proxies, host string, record *DomainRecord, proxy string, port uint16) (net.Conn, error) {
+	if proxy != PolicyDirect {
+		// let proxy resolve hostname
+		addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		return proxies.DialPacket(proxy, addr)
+	}
+	if record == nil {
+		return nil, fmt.Errorf("%s is routed to tun, can't be connected directly", host)
+	}
 
-		if record.RealIP == nil {
-			// try resolve real ip
-			msg, err := r.one.dns.Resolve(record.Hostname)
-			if err == nil {
-				record.SetRealIP(msg)
-			}
+	ip, err := r.one.dns.RealIP(record)
+	if err != nil {
+		return nil, err
+	}
+	srvaddr := &net.UDPAddr{IP: ip, Port: int(port)}
+	return net.DialUDP("udp", nil, srvaddr)
+}
 
-			if record.RealIP == nil {
-				// resolve real ip failed
-				return nil
-			}
+// tunnel in setup, packets of the same flow wait for it
+type udpTunnelSetup struct {
+	done   chan struct{}
+	tunnel *UDPTunnel // nil if setup failed
+}
+
+// newTunnel resolves, matches and connects remote endpoint of session, it's slow and runs without lock
+func (r *UDPRelay) newTunnel(localConn *net.UDPConn, cliaddr *net.UDPAddr, session *NatSession) (*UDPTunnel, string) {
+	host := session.dstIP.String()
+	flow := &Flow{Network: "udp", SrcIP: session.srcIP, DstPort: session.dstPort}
+	record := r.one.dnsTable.GetByIP(session.dstIP)
+	if record != nil {
+		host = record.Hostname
+		flow.Domain = host
+	} else if r.one.dnsTable.IsLocalIP(session.dstIP) { // dns expired
+		return nil, ""
+	} else { // by IP-CIDR rule
+		flow.DstIP = session.dstIP
+	}
+
+	rt := r.one.routing()
+	proxy := r.one.flowProxy(rt.rule, flow, record)
+	var process string
+	if proc := r.one.lookupProcess(rt.rule, "udp", session); proc != nil {
+		process = proc.Name
+		if p, ok := rt.rule.ProcessProxy(proc); ok {
+			proxy = p
 		}
+	}
+	if IsRejectPolicy(proxy) {
+		logger.Debugf("[udp relay] reject %s:%d by %s", host, session.dstPort, proxy)
+		if r.one.manager != nil {
+			r.one.manager.rejectUdp.Add(1)
+		}
+		return nil, ""
+	}
 
-		srvaddr := &net.UDPAddr{IP: record.RealIP, Port: int(session.dstPort)}
-		remoteConn, err := net.DialUDP("udp", nil, srvaddr)
-		if err != nil {
-			logger.Errorf("[udp relay] connect to %s failed: %v", srvaddr, err)
-			return nil
+	remoteConn, err := r.dialRemote(rt.proxies, host, record, proxy, session.dstPort)
+	if err != nil {
+		logger.Errorf("[udp relay] connect to %s:%d by proxy %q failed: %v", host, session.dstPort, proxy, err)
+		if r.one.manager != nil {
+			r.one.manager.dialFailed(proxy)
 		}
-		tunnel = &UDPTunnel{
-			session:    session,
-			record:     record,
-			cliaddr:    cliaddr,
-			localConn:  localConn,
-			remoteConn: remoteConn,
+		return nil, ""
+	}
+	logger.Debugf("[udp relay] %s:%d > %s:%d: new tunnel through %s", session.srcIP, session.srcPort, host, session.dstPort, proxy)
+
+	src := net.JoinHostPort(session.srcIP.String(), strconv.Itoa(int(session.srcPort)))
+	dst := net.JoinHostPort(host, strconv.Itoa(int(session.dstPort)))
+	tunnel := &UDPTunnel{
+		session:    session,
+		record:     record,
+		cliaddr:    cliaddr,
+		localConn:  localConn,
+		remoteConn: remoteConn,
+	}
+	tunnel.active = r.one.conns.add("udp", src, dst, proxy, func() {
+		remoteConn.Close()
+	})
+	r.one.labelProcess(tunnel.active, rt.rule, process, "udp", session)
+	return tunnel, host
+}
+
+// pump packets of tunnel until it's idle, then destroy it
+func (r *UDPRelay) pump(addr string, tunnel *UDPTunnel, host string) {
+	session := tunnel.session
+	err := tunnel.Pump()
+	if err != nil {
+		logger.Debugf("[udp relay] pump to %v failed: %v", tunnel.remoteConn.RemoteAddr(), err)
+	}
+	tunnel.remoteConn.Close()
+	r.one.conns.remove(tunnel.active)
+	if r.one.manager != nil {
+		r.one.manager.dataCh <- ConnData{
+			Src:      session.srcIP.String(),
+			Dst:      tunnel.active.info.Dst,
+			Proxy:    tunnel.active.info.Proxy,
+			Process:  tunnel.active.processName(),
+			Upload:   tunnel.active.upload.Load(),
+			Download: tunnel.active.download.Load(),
 		}
+	}
+	logger.Debugf("[udp relay] %s:%d > %s:%d: destroy tunnel", session.srcIP, session.srcPort, host, session.dstPort)
 
-		logger.Debugf("[udp relay] %s:%d > %v: new tunnel", session.srcIP, session.srcPort, srvaddr)
+	r.lock.Lock()
+	delete(r.tunnels, addr)
+	r.lock.Unlock()
+}
 
-		r.tunnels[addr] = tunnel
-		go func() {
-			err := tunnel.Pump()
-			if err != nil {
-				logger.Debugf("[udp relay] pump to %v failed: %v", tunnel.remoteConn.RemoteAddr(), err)
-			}
-			tunnel.remoteConn.Close()
-			logger.Debugf("[udp relay] %s:%d > %v: destroy tunnel", tunnel.session.srcIP, tunnel.session.srcPort, srvaddr)
+// bypass udp packet. The lock is held only to find and add tunnels, for setup of a tunnel may be slow,
+// such as udp association of SOCKS5 proxy.
+func (r *UDPRelay) grabTunnel(localConn *net.UDPConn, cliaddr *net.UDPAddr) *UDPTunnel {
+	addr := cliaddr.String()
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	tunnel := r.tunnels[addr]
+	setup := r.setups[addr]
+	if tunnel == nil && setup == nil {
+		setup = &udpTunnelSetup{done: make(chan struct{})}
+		r.setups[addr] = setup
+		r.lock.Unlock()
+		r.setupTunnel(addr, setup, localConn, cliaddr)
+	} else {
+		r.lock.Unlock()
+	}
 
-			r.lock.Lock()
-			delete(r.tunnels, addr)
-			r.lock.Unlock()
-		}()
+	if tunnel == nil {
+		<-setup.done
+		if tunnel = setup.tunnel; tunnel == nil {
+			return nil
+		}
 	}
 	tunnel.SetDeadline(NatSessionLifeSeconds * time.Second)
 	return tunnel
 }
 
+// setupTunnel creates tunnel for setup, and adds it unless relay is closed
+func (r *UDPRelay) setupTunnel(addr string, setup *udpTunnelSetup, localConn *net.UDPConn, cliaddr *net.UDPAddr) {
+	defer close(setup.done)
+
+	var tunnel *UDPTunnel
+	var host string
+	if session := r.nat.getSession(uint16(cliaddr.Port)); session != nil {
+		tunnel, host = r.newTunnel(localConn, cliaddr, session)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.setups, addr)
+	if tunnel == nil {
+		return
+	}
+	if r.closed {
+		tunnel.remoteConn.Close()
+		r.one.conns.remove(tunnel.active)
+		return
+	}
+	r.tunnels[addr] = tunnel
+	setup.tunnel = tunnel
+	go r.pump(addr, tunnel, host)
+}
+
 func (r *UDPRelay) handlePacket(localConn *net.UDPConn, cliaddr *net.UDPAddr, packet []byte) {
 	tunnel := r.grabTunnel(localConn, cliaddr)
 	if tunnel == nil {
@@ -135,18 +246,30 @@ func (r *UDPRelay) handlePacket(localConn *net.UDPConn, cliaddr *net.UDPAddr, pa
 	}
 }
 
-func (r *UDPRelay) Serve() error {
-	addr := &net.UDPAddr{IP: r.relayIP, Port: int(r.relayPort)}
+func (r *UDPRelay) serve(ip net.IP) error {
+	addr := &net.UDPAddr{IP: ip, Port: int(r.relayPort)}
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		logger.Errorf("[udp relay] listen failed: %v", err)
 		return err
 	}
 
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		conn.Close()
+		return nil
+	}
+	r.listeners = append(r.listeners, conn)
+	r.lock.Unlock()
+
 	for {
 		b := make([]byte, MTU)
 		n, cliaddr, err := conn.ReadFromUDP(b)
 		if err != nil {
+			if r.isClosed() {
+				return nil
+			}
 			logger.Errorf("[udp relay] acceept failed temporary: %v", err)
 			time.Sleep(time.Second) //prevent log storms
 			continue
@@ -155,8 +278,38 @@ func (r *UDPRelay) Serve() error {
 	}
 }
 
+func (r *UDPRelay) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+// Close stops relay and destroys all tunnels
+func (r *UDPRelay) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	for _, conn := range r.listeners {
+		conn.Close()
+	}
+	for _, tunnel := range r.tunnels {
+		tunnel.remoteConn.Close()
+	}
+	return nil
+}
+
+func (r *UDPRelay) Serve() error {
+	if r.relayIP6 != nil {
+		errCh := make(chan error, 2)
+		go func() { errCh <- r.serve(r.relayIP) }()
+		go func() { errCh <- r.serve(r.relayIP6) }()
+		return <-errCh
+	}
+	return r.serve(r.relayIP)
+}
+
 // redirect udp packet to relay
-func (r *UDPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
+func (r *UDPRelay) Filter(wr io.Writer, ipPacket tcpip.IPPacket) {
 	udpPacket := tcpip.UDPPacket(ipPacket.Payload())
 
 	srcIP := ipPacket.SourceIP()
@@ -166,7 +319,16 @@ func (r *UDPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
 
 	one := r.one
 
-	if net.IP.Equal(srcIP, r.relayIP) && srcPort == r.relayPort {
+	relayIP := r.relayIP
+	if ipPacket.Version() == 6 {
+		relayIP = r.relayIP6
+		if relayIP == nil {
+			logger.Debugf("[udp filter] %s:%d > %s:%d: ipv6 is disabled", srcIP, srcPort, dstIP, dstPort)
+			return
+		}
+	}
+
+	if net.IP.Equal(srcIP, relayIP) && srcPort == r.relayPort {
 		// from remote
 		session := r.nat.getSession(dstPort)
 		if session == nil {
@@ -177,28 +339,41 @@ func (r *UDPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
 		ipPacket.SetDestinationIP(session.srcIP)
 		udpPacket.SetSourcePort(session.dstPort)
 		udpPacket.SetDestinationPort(session.srcPort)
-	} else if one.dnsTable.Contains(dstIP) {
+	} else {
+		if !one.dnsTable.Contains(dstIP) { // for IP-CIDR rule traffic
+			proxy := one.routing().rule.Proxy(&Flow{Network: "udp", SrcIP: srcIP, DstIP: dstIP, DstPort: dstPort})
+			if IsRejectPolicy(proxy) {
+				// drop packet to rejected IP-CIDR
+				logger.Debugf("[udp filter] %s:%d > %s:%d: reject by %s", srcIP, srcPort, dstIP, dstPort, proxy)
+				if one.manager != nil {
+					one.manager.rejectUdp.Add(1)
+				}
+				return
+			}
+			if proxy == PolicyDirect {
+				logger.Errorf("[udp filter] %s:%d > %s:%d: invalid packet", srcIP, srcPort, dstIP, dstPort)
+				return
+			}
+		}
+
 		// redirect to relay
 		isNew, port := r.nat.allocSession(srcIP, dstIP, srcPort, dstPort)
 
 		ipPacket.SetSourceIP(dstIP)
 		udpPacket.SetSourcePort(port)
-		ipPacket.SetDestinationIP(r.relayIP)
+		ipPacket.SetDestinationIP(relayIP)
 		udpPacket.SetDestinationPort(r.relayPort)
 
 		if isNew {
 			logger.Debugf("[udp filter] reshape packet from [%s:%d > %s:%d] to [%s:%d > %s:%d]",
-				srcIP, srcPort, dstIP, dstPort, dstIP, port, r.relayIP, r.relayPort)
+				srcIP, srcPort, dstIP, dstPort, dstIP, port, relayIP, r.relayPort)
 		}
-	} else {
-		logger.Errorf("[udp filter] %s:%d > %s:%d: invalid packet", srcIP, srcPort, dstIP, dstPort)
-		return
 	}
 
 	// write back packet
 	udpPacket.ResetChecksum(ipPacket.PseudoSum())
 	ipPacket.ResetChecksum()
-	wr.Write(ipPacket)
+	wr.Write(ipPacket.Bytes())
 }
 
 func NewUDPRelay(one *One, cfg CoreConfig) *UDPRelay {
@@ -206,7 +381,9 @@ func NewUDPRelay(one *One, cfg CoreConfig) *UDPRelay {
 	r.one = one
 	r.nat = NewNat(cfg.UdpNatPortStart, cfg.UdpNatPortEnd)
 	r.relayIP = one.ip
+	r.relayIP6 = one.ip6
 	r.relayPort = cfg.UdpListenPort
 	r.tunnels = make(map[string]*UDPTunnel)
+	r.setups = make(map[string]*udpTunnelSetup)
 	return r
 }
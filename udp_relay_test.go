@@ -0,0 +1,97 @@
+//
+//   date  : 2026-10-18
+//   author: xjdrew
+//
+
+package kone
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPRelaySlowProxy(t *testing.T) {
+	// a silent socks5 proxy accepts, but never answers udp association
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer echo.Close()
+
+	d := newTestDns([]RuleConfig{
+		{Schema: "IP-CIDR", Pattern: "1.2.3.0/24", Proxy: "Proxy1"},
+	})
+	one := d.one
+	one.conns = NewConnTable()
+	setTestProxies(t, one, map[string]string{"Proxy1": "socks5://" + ln.Addr().String()}, nil)
+	r := NewUDPRelay(one, CoreConfig{UdpNatPortStart: 10000, UdpNatPortEnd: 10100})
+	localConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer localConn.Close()
+
+	// packets of a flow through the silent proxy wait for the same setup
+	_, slowPort := r.nat.allocSession(net.ParseIP("10.0.0.2"), net.ParseIP("1.2.3.4"), 5000, 443)
+	slow := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(slowPort)}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, r.grabTunnel(localConn, slow))
+		}()
+	}
+	var ctrl net.Conn
+	select {
+	case ctrl = <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("proxy is not connected")
+	}
+
+	// a direct flow is not blocked by it
+	record := one.dnsTable.Set("www.example.com", PolicyDirect)
+	record.RealIP = echo.LocalAddr().(*net.UDPAddr).IP
+	_, directPort := r.nat.allocSession(net.ParseIP("10.0.0.2"), record.IP, 5001, uint16(echo.LocalAddr().(*net.UDPAddr).Port))
+	done := make(chan *UDPTunnel, 1)
+	go func() {
+		done <- r.grabTunnel(localConn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(directPort)})
+	}()
+	select {
+	case tunnel := <-done:
+		assert.NotNil(t, tunnel)
+	case <-time.After(3 * time.Second):
+		t.Fatal("direct flow is blocked by slow proxy")
+	}
+
+	// close is not blocked either, and the slow setup is discarded when it fails
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("close is blocked by slow proxy")
+	}
+	ctrl.Close()
+	wg.Wait()
+	assert.Empty(t, accepted)
+	assert.Empty(t, r.setups)
+}